@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const (
+	// defines the source of a power action
+
+	// ActionSourceAPI is used for actions requested through the API
+	ActionSourceAPI = "api"
+	// ActionSourceLease is used for actions triggered by an expired lease
+	ActionSourceLease = "lease"
+	// ActionSourceSlack is used for actions requested through slack commands and buttons
+	ActionSourceSlack = "slack"
+	// ActionSourceBudget is used for actions triggered by budget enforcement
+	ActionSourceBudget = "budget"
+	// ActionSourceWakeProxy is used for actions triggered by requests to the wake proxy
+	ActionSourceWakeProxy = "wake_proxy"
+)
+
+// powerAction is a request to change the power state of an environment or of a single instance
+type powerAction struct {
+	// env ID is always set, instance ID only when a single instance is toggled
+	EnvID      string
+	InstanceID string
+	// only instances with these roles are toggled, all instances when empty
+	Roles []string
+	// start or stop
+	Action string
+	// who (or what) requested the action
+	Actor  string
+	Source string
+	// set when the actor was authenticated (trusted header or signed slack request)
+	ActorTrusted bool
+	// force will bypass refusals which the actor is allowed to override
+	Force bool
+	// confirmation token for actions over the safety limits
+	Confirm string
+	// set when a second user approved the action (see approvals)
+	Approved bool
+}
+
+// actionGuard inspects a power action before it is executed.
+// A non-nil error will refuse the action
+type actionGuard func(action powerAction) error
+
+// actionGuards are evaluated in order, the first refusal wins
+var actionGuards = []actionGuard{
+	checkFreeze,
+	checkReservation,
+	checkBudget,
+	checkLimits,
+	checkApproval,
+}
+
+// actionError is returned when a power action is refused before reaching the provider
+type actionError struct {
+	Status  int
+	Message string
+	// optional details which are added to the error response
+	Details map[string]interface{}
+}
+
+func (e actionError) Error() string {
+	return e.Message
+}
+
+// checkPowerAction runs all guards against the power action
+func checkPowerAction(action powerAction) error {
+	for _, guard := range actionGuards {
+		if err := guard(action); err != nil {
+			log.Warningf("%s of env [%s] by '%s' (%s) was refused: %v", action.Action, action.EnvID, action.Actor, action.Source, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// performPowerAction checks and then executes a power action
+func performPowerAction(action powerAction) (response []byte, err error) {
+	if err = checkPowerAction(action); err != nil {
+		return
+	}
+
+	// keep the state before the action for notifications
+	env, found := getEnvironmentByID(action.EnvID)
+	// the guards have accepted the confirmation token or approval of an action over the safety limits
+	confirmed := action.Approved || action.Confirm != ""
+
+	switch {
+	// single instance
+	case action.InstanceID != "":
+		response, err = toggleInstance(action.InstanceID, action.Action)
+	case action.Action == "start":
+		response, err = startupEnv(action.EnvID, confirmed, action.Roles...)
+	case action.Action == "stop":
+		response, err = shutdownEnv(action.EnvID, confirmed, action.Roles...)
+		if err == nil && len(action.Roles) == 0 {
+			// a lease has no meaning for a stopped environment
+			deleteEnvLease(action.EnvID)
+		}
+	default:
+		return nil, fmt.Errorf("invalid action: %s", action.Action)
+	}
+	if found {
+		notifyPowerAction(action, env, err)
+	}
+	return
+}
+
+// getInstanceEnvID returns the environment ID of an instance (internal id)
+func getInstanceEnvID(instanceID string) (envID string) {
+	for _, env := range cachedTable {
+		for _, instance := range env.Instances {
+			if instance.ID == instanceID {
+				return env.ID
+			}
+		}
+	}
+	return
+}
+
+// getStatusCode returns the http status code which is appropriate for the error
+func getStatusCode(err error) int {
+	if aErr, ok := err.(actionError); ok {
+		return aErr.Status
+	}
+	return http.StatusInternalServerError
+}
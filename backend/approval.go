@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defines approval states
+
+	// ApprovalPending means that the approval is waiting for a decision
+	ApprovalPending = "pending"
+	// ApprovalApproved means that the approval was approved and the action was executed
+	ApprovalApproved = "approved"
+	// ApprovalRejected means that the approval was rejected
+	ApprovalRejected = "rejected"
+	// ApprovalExpired means that no decision was made before the approval timeout
+	ApprovalExpired = "expired"
+	// ApprovalFailed means that the approval was approved but the action returned an error
+	ApprovalFailed = "failed"
+
+	// decided approvals are kept this long for the api response
+	approvalRetention = 24 * time.Hour
+)
+
+var (
+	// values are set by ConfigInit
+	approvalEnvironments []string
+	approvalTagKey       string
+	approvalApprovers    []string
+	approvalTimeout      time.Duration
+
+	// approvals by id
+	approvals = map[string]*approvalRequest{}
+	// lock to prevent concurrent access of the above map
+	approvalsLock sync.Mutex
+)
+
+// approvalRequest holds a stop request which needs to be approved by a second user
+type approvalRequest struct {
+	ID         string     `json:"id"`
+	EnvID      string     `json:"env_id"`
+	EnvName    string     `json:"env_name"`
+	InstanceID string     `json:"instance_id,omitempty"`
+	Roles      []string   `json:"roles,omitempty"`
+	Action     string     `json:"action"`
+	Requester  string     `json:"requester"`
+	Status     string     `json:"status"`
+	Approver   string     `json:"approver,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	DecidedAt  *time.Time `json:"decided_at,omitempty"`
+
+	// the action which is executed once approved
+	action powerAction
+}
+
+// requiresApproval returns true if stopping the environment needs to be approved.
+// this is determined by the environment name or by a tag on any of its members
+func requiresApproval(env environment) bool {
+	if matchesAnyPattern(env.Name, approvalEnvironments) {
+		return true
+	}
+	if approvalTagKey != "" {
+		for _, instance := range env.Instances {
+			if instance.Tags[approvalTagKey] == "true" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkApproval is an actionGuard which turns a stop of an environment requiring approval
+// into a pending approval. The action is executed once a second user approves it
+func checkApproval(action powerAction) error {
+	if action.Action != "stop" || action.Approved {
+		return nil
+	}
+	env, found := getEnvironmentByID(action.EnvID)
+	if !found || !requiresApproval(env) {
+		return nil
+	}
+	// the four-eyes rule relies on the identity of the requester, which must not be spoofed
+	if action.Actor == "" || !action.ActorTrusted {
+		return actionError{Status: http.StatusForbidden, Message: fmt.Sprintf("stopping environment %s requires approval, but the requester is not authenticated", env.Name)}
+	}
+
+	approval := createApproval(env, action)
+	return actionError{
+		Status:  http.StatusAccepted,
+		Message: fmt.Sprintf("stopping environment %s requires approval", env.Name),
+		Details: map[string]interface{}{
+			"approval_id":         approval.ID,
+			"approval_expires_at": approval.ExpiresAt.Format(time.RFC3339),
+		},
+	}
+}
+
+// createApproval creates a pending approval for the action.
+// if the same action is already pending, the existing approval is returned
+func createApproval(env environment, action powerAction) approvalRequest {
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	now := time.Now()
+	expireApprovals(now)
+	for _, existing := range approvals {
+		if existing.Status == ApprovalPending &&
+			existing.EnvID == action.EnvID &&
+			existing.InstanceID == action.InstanceID &&
+			strings.Join(existing.Roles, ",") == strings.Join(action.Roles, ",") &&
+			existing.Action == action.Action {
+			return *existing
+		}
+	}
+
+	approval := &approvalRequest{
+		ID:         generateRandomID(),
+		EnvID:      env.ID,
+		EnvName:    env.Name,
+		InstanceID: action.InstanceID,
+		Roles:      action.Roles,
+		Action:     action.Action,
+		Requester:  action.Actor,
+		Status:     ApprovalPending,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(approvalTimeout),
+		action:     action,
+	}
+	approvals[approval.ID] = approval
+	log.Infof("approval %s created: %s of env %s [%s] requested by %s", approval.ID, action.Action, env.Name, env.ID, action.Actor)
+	event := newEnvEvent(EventApprovalRequired, env)
+	event.Action = action.Action
+	event.Actor = action.Actor
+	event.InstanceID = action.InstanceID
+	event.Details = map[string]string{
+		"approval_id": approval.ID,
+		"expires_in":  approvalTimeout.String(),
+		"expires_at":  approval.ExpiresAt.Format(time.RFC3339),
+	}
+	sendNotification(event)
+	return *approval
+}
+
+// decideApproval approves or rejects a pending approval. An approved action is executed right away.
+// the approver must be another user than the requester and (when configured) one of the approvers
+func decideApproval(id, approver string, approve bool) (approval approvalRequest, err error) {
+	approvalsLock.Lock()
+	now := time.Now()
+	expireApprovals(now)
+	existing, found := approvals[id]
+	switch {
+	case !found:
+		err = actionError{Status: http.StatusNotFound, Message: "approval not found"}
+	case existing.Status != ApprovalPending:
+		err = actionError{Status: http.StatusConflict, Message: fmt.Sprintf("approval is already %s", existing.Status)}
+	case approver == "":
+		err = actionError{Status: http.StatusForbidden, Message: "approver is unknown"}
+	case approver == existing.Requester:
+		err = actionError{Status: http.StatusForbidden, Message: "approver must be different from the requester"}
+	case len(approvalApprovers) > 0 && !stringInSlice(approver, approvalApprovers):
+		err = actionError{Status: http.StatusForbidden, Message: fmt.Sprintf("%s is not an authorized approver", approver)}
+	}
+	if err != nil {
+		approvalsLock.Unlock()
+		return
+	}
+	// mark as decided before releasing the lock, so it can only be decided once
+	existing.Approver = approver
+	existing.DecidedAt = &now
+	existing.Status = ApprovalRejected
+	if approve {
+		existing.Status = ApprovalApproved
+	}
+	action := existing.action
+	approvalsLock.Unlock()
+
+	if approve {
+		log.Infof("approval %s approved by %s", id, approver)
+		action.Approved = true
+		if _, actionErr := performPowerAction(action); actionErr != nil {
+			approvalsLock.Lock()
+			existing.Status = ApprovalFailed
+			existing.Error = actionErr.Error()
+			approvalsLock.Unlock()
+		}
+	} else {
+		log.Infof("approval %s rejected by %s", id, approver)
+	}
+
+	approvalsLock.Lock()
+	approval = *existing
+	approvalsLock.Unlock()
+	sendNotification(approval.event(EventApprovalDecided))
+	return
+}
+
+// expireApprovals marks pending approvals past their timeout as expired
+// and removes decided approvals past their retention. approvalsLock must be held
+func expireApprovals(now time.Time) {
+	for id, approval := range approvals {
+		if approval.Status == ApprovalPending && !now.Before(approval.ExpiresAt) {
+			approval.Status = ApprovalExpired
+			approval.DecidedAt = &approval.ExpiresAt
+			log.Infof("approval %s has expired", id)
+			sendNotification(approval.event(EventApprovalExpired))
+		}
+		if approval.DecidedAt != nil && now.Sub(*approval.DecidedAt) > approvalRetention {
+			delete(approvals, id)
+		}
+	}
+}
+
+// event returns a notification event which describes the approval
+func (a approvalRequest) event(eventType string) notificationEvent {
+	env, _ := getEnvironmentByID(a.EnvID)
+	event := newEnvEvent(eventType, env)
+	event.EnvID, event.EnvName = a.EnvID, a.EnvName
+	event.Action = a.Action
+	event.Actor = a.Approver
+	event.InstanceID = a.InstanceID
+	event.Error = a.Error
+	event.Details = map[string]string{
+		"approval_id": a.ID,
+		"requester":   a.Requester,
+		"status":      a.Status,
+	}
+	return event
+}
+
+// getApprovals returns all known approvals, newest first
+func getApprovals() (list []approvalRequest) {
+	approvalsLock.Lock()
+	defer approvalsLock.Unlock()
+
+	expireApprovals(time.Now())
+	list = []approvalRequest{}
+	for _, approval := range approvals {
+		list = append(list, *approval)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return
+}
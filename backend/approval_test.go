@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestApproval(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	approvalEnvironments = []string{"mockenv7"}
+	approvalApprovers = []string{"approver"}
+	approvalTimeout = time.Hour
+	defer func() { approvalEnvironments = nil; approvalApprovers = nil }()
+
+	// a stop requires an approval instead of being executed
+	stop := powerAction{EnvID: envID, Action: "stop", Actor: "requester", Source: ActionSourceAPI, ActorTrusted: true}
+	_, err := performPowerAction(stop)
+	if getStatusCode(err) != http.StatusAccepted {
+		t.Fatalf("expected stop to wait for approval, got: %v", err)
+	}
+	id := err.(actionError).Details["approval_id"].(string)
+	if _, err = performPowerAction(stop); err.(actionError).Details["approval_id"] != id {
+		t.Errorf("expected the pending approval to be reused, got: %v", err)
+	}
+	if env, _ := getEnvironmentByID(envID); env.State != "running" {
+		t.Errorf("env was stopped without approval: %s", env.State)
+	}
+	// a stop of some roles is another action
+	env, _ := getEnvironmentByID(envID)
+	roles := stop
+	roles.Roles = []string{"web"}
+	if approval := createApproval(env, roles); approval.ID == id || !equalStrings(approval.Roles, roles.Roles) {
+		t.Errorf("expected a separate approval for the roles, got: %+v", approval)
+	} else {
+		delete(approvals, approval.ID)
+	}
+	// an unknown or unauthenticated requester can not request an approval
+	unknown := stop
+	unknown.Actor = ""
+	if _, err = performPowerAction(unknown); getStatusCode(err) != http.StatusForbidden {
+		t.Errorf("expected an anonymous stop to be refused, got: %v", err)
+	}
+	untrusted := stop
+	untrusted.ActorTrusted = false
+	if _, err = performPowerAction(untrusted); getStatusCode(err) != http.StatusForbidden {
+		t.Errorf("expected a stop by an unauthenticated actor to be refused, got: %v", err)
+	}
+
+	// only another authorized user may decide
+	for _, approver := range []string{"", "requester", "someone"} {
+		if _, err = decideApproval(id, approver, true); getStatusCode(err) != http.StatusForbidden {
+			t.Errorf("expected %q to be refused, got: %v", approver, err)
+		}
+	}
+	approval, err := decideApproval(id, "approver", true)
+	if err != nil || approval.Status != ApprovalApproved {
+		t.Fatalf("approval failed: %v (%s)", err, approval.Status)
+	}
+	updateEnvDetails()
+	if env, _ := getEnvironmentByID(envID); env.State != "stopped" {
+		t.Errorf("env was not stopped after approval: %s", env.State)
+	}
+	if _, err = decideApproval(id, "approver", false); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected a decided approval to be refused, got: %v", err)
+	}
+
+	// expired approvals can not be approved anymore
+	approvals["expired"] = &approvalRequest{ID: "expired", Status: ApprovalPending, Requester: "requester", ExpiresAt: time.Now().Add(-time.Second)}
+	if _, err = decideApproval("expired", "approver", true); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected an expired approval to be refused, got: %v", err)
+	}
+	if approvals["expired"].Status != ApprovalExpired {
+		t.Errorf("approval did not expire: %s", approvals["expired"].Status)
+	}
+}
+
+func TestRequiresApproval(t *testing.T) {
+	approvalEnvironments = []string{"prod-*"}
+	approvalTagKey = "power-toggle-require-approval"
+	defer func() { approvalEnvironments = nil }()
+
+	for env, expected := range map[*environment]bool{
+		{Name: "prod-eu"}: true,
+		{Name: "dev"}:     false,
+		{Name: "dev", Instances: []virtualMachine{{Tags: map[string]string{approvalTagKey: "true"}}}}:  true,
+		{Name: "dev", Instances: []virtualMachine{{Tags: map[string]string{approvalTagKey: "false"}}}}: false,
+	} {
+		if requiresApproval(*env) != expected {
+			t.Errorf("%s: expected %v", env.Name, expected)
+		}
+	}
+}
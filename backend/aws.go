@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -44,7 +43,9 @@ var (
 	awsRegions []string
 	// aws tags
 	requiredTagKey, requiredTagValue, environmentTagKey string
-	// safety, will refuse to shutdown if more than this amount of instances is requested
+	// instances (or ASGs) with this tag are never stopped as part of an environment
+	keepRunningTagKey, keepRunningTagValue string
+	// safety, will ask for confirmation to shutdown more than this amount of instances
 	maxInstancesToShutdown int
 	// ignore these instance types
 	instanceTypeIgnore []string
@@ -64,14 +65,24 @@ var (
 	toggledOffInstanceIds = map[string]bool{}
 	// lock to prevent concurrent access of the above map
 	toggledOffInstanceIdsLock sync.RWMutex
-	// last time aws api was accessed
-	lastRefreshedTimeUnixNano int64
 	// MockEnabled enable mocking of API calls to aws for development purposes
 	mockEnabled bool
 	// experimentalEnabled enable experimental features. Currently include billing stats
 	experimentalEnabled bool
 	// enable support for interacting with ASGs (Auto Scaling Groups)
 	asgEnabled bool
+	// tag keys (glob patterns) which are returned in the instance details
+	exposedTagKeys []string
+	// PlatformDetails by image ID (empty for images which were not found). images are immutable, so this is never invalidated
+	imagePlatformDetails = map[string]string{}
+	// last known price of a single ASG instance (by region/name), since stopped ASGs have no instances to price
+	asgInstancePricing = map[string]float64{}
+	// instance type of an ASG (by region/name) from its launch template or launch configuration (empty if it is unknown)
+	asgInstanceTypes = map[string]string{}
+	// last known desired capacity of a running ASG (by region/name), it is restored when the ASG is started
+	asgDesiredCapacity = map[string]int64{}
+	// lock to prevent concurrent access of the above map
+	asgDesiredCapacityLock sync.RWMutex
 )
 
 type virtualMachine struct {
@@ -91,12 +102,58 @@ type virtualMachine struct {
 	MemoryGB      float32 `json:"memory_gb" groups:"summary,details"`
 	PricingHourly float64 `json:"pricing" groups:"summary,details"`
 
+	// these values determine which rate of the pricing catalog is used
+	Platform       string `json:"platform,omitempty" groups:"summary,details"`
+	PurchaseOption string `json:"purchase_option,omitempty" groups:"summary,details"`
+	AccountID      string `json:"account_id,omitempty" groups:"details"`
+
 	// ASG values
-	IsASG            bool  `json:"is_asg groups:"summary,details""`
+	IsASG            bool  `json:"is_asg" groups:"summary,details"`
 	ASGInstanceCount int   `json:"asg_instance_count" groups:"summary,details"`
 	MinSize          int64 `json:"min_size" groups:"summary,details"`
 	MaxSize          int64 `json:"max_size" groups:"summary,details"`
 	DesiredCapacity  int64 `json:"desired_capacity" groups:"summary,details"`
+
+	// protected instances are skipped when the environment is stopped
+	Protected bool `json:"protected" groups:"details"`
+
+	// attached EBS volumes and associated elastic IPs
+	Volumes    []ebsVolume `json:"volumes,omitempty" groups:"details"`
+	ElasticIPs int         `json:"elastic_ips" groups:"details"`
+	// storage is billed while the instance is stopped, elastic IPs only while it is not running
+	StoragePricingHourly float64 `json:"storage_pricing" groups:"summary,details"`
+	IdlePricingHourly    float64 `json:"idle_pricing" groups:"summary,details"`
+
+	// these values help to identify an instance
+	PrivateIP        string     `json:"private_ip,omitempty" groups:"details"`
+	PublicIP         string     `json:"public_ip,omitempty" groups:"details"`
+	AvailabilityZone string     `json:"availability_zone,omitempty" groups:"details"`
+	LaunchTime       *time.Time `json:"launch_time,omitempty" groups:"details"`
+	// time since launch of a running instance (rounded to minutes)
+	Uptime  string `json:"uptime,omitempty" groups:"details"`
+	KeyName string `json:"key_name,omitempty" groups:"details"`
+	// value of the role tag (see aws.role_tag_key), used to toggle a part of an environment
+	Role string `json:"role,omitempty" groups:"summary,details"`
+	// tags allowed by aws.exposed_tag_keys
+	ExposedTags map[string]string `json:"tags,omitempty" groups:"details"`
+	// instances of an ASG. also used for billing
+	ASGMembers []asgMember `json:"asg_members,omitempty" groups:"details"`
+
+	// all tags of the instance (or ASG). for internal use only
+	Tags map[string]string `json:"-"`
+
+	// time at which the instance changed to its current state, if reported by aws. used for billing
+	stateChangedAt time.Time
+	// price of a single instance of an ASG. used for forecasts
+	asgInstancePricingHourly float64
+	// desired capacity of a stopped ASG when it was last seen running (0 if it is unknown)
+	toggledOffCapacity int64
+}
+
+type ebsVolume struct {
+	VolumeID   string `json:"volume_id"`
+	VolumeType string `json:"volume_type"`
+	SizeGB     int64  `json:"size_gb"`
 }
 
 type environment struct {
@@ -107,6 +164,12 @@ type environment struct {
 	Name      string           `json:"name" groups:"summary,details"`
 	Instances []virtualMachine `json:"instances" groups:"details"`
 
+	// these values are taken from the tags of the instances, or the config file
+	Owner       string   `json:"owner,omitempty" groups:"summary,details"`
+	Team        string   `json:"team,omitempty" groups:"summary,details"`
+	Description string   `json:"description,omitempty" groups:"summary,details"`
+	Links       []string `json:"links,omitempty" groups:"summary,details"`
+
 	// these values are calculated based on list of Instances
 	RunningInstances int     `json:"running_instances" groups:"summary,details"`
 	StoppedInstances int     `json:"stopped_instances" groups:"summary,details"`
@@ -116,6 +179,19 @@ type environment struct {
 	State            string  `json:"state" groups:"summary,details"`
 	BillsAccrued     string  `json:"bills_accrued,omitempty" groups:"summary,details"`
 	BillsSaved       string  `json:"bills_saved,omitempty" groups:"summary,details"`
+
+	// these values are set when the environment was started with a lease
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty" groups:"summary,details"`
+	LeaseOwner     string     `json:"lease_owner,omitempty" groups:"summary,details"`
+
+	// this value is set when the environment is reserved
+	Reservation *envReservation `json:"reservation,omitempty" groups:"summary,details"`
+
+	// this value is set when the environment has a monthly budget
+	Budget *envBudget `json:"budget,omitempty" groups:"summary,details"`
+
+	// state of the instances by role (see aws.role_tag_key), when they have roles
+	Roles []envRole `json:"roles,omitempty" groups:"details"`
 }
 
 // for global cached table
@@ -135,16 +211,6 @@ func updateEnvDetails() {
 			cachedTable[i].Region,
 			env.Name,
 		)
-		// add bills accrued and bills saved to env details
-		if experimentalEnabled {
-			if envbillAccrued, exists := billsAccruedMap[cachedTable[i].ID]; exists {
-				cachedTable[i].BillsAccrued = fmt.Sprintf("%.02f", envbillAccrued)
-			}
-			if envbillSaved, exists := billsSavedMap[cachedTable[i].ID]; exists {
-				cachedTable[i].BillsSaved = fmt.Sprintf("%.02f", envbillSaved)
-			}
-		}
-
 		// vm total count
 		cachedTable[i].TotalInstances = len(env.Instances)
 		// reset counts
@@ -176,51 +242,85 @@ func updateEnvDetails() {
 			}
 		}
 
-		// determine environment state
-		switch {
-		case cachedTable[i].TotalInstances == cachedTable[i].RunningInstances:
-			cachedTable[i].State = EnvStateRunning
-		case cachedTable[i].TotalInstances == cachedTable[i].StoppedInstances:
-			cachedTable[i].State = EnvStateStopped
-		case cachedTable[i].TotalInstances == (cachedTable[i].RunningInstances + cachedTable[i].StoppedInstances):
-			cachedTable[i].State = EnvStateMixed
-		default:
-			cachedTable[i].State = EnvStateChanging
-		}
+		// determine environment state, and the state of each role (a partially toggled environment is mixed)
+		cachedTable[i].State = computeEnvState(cachedTable[i].TotalInstances, cachedTable[i].RunningInstances, cachedTable[i].StoppedInstances)
+		cachedTable[i].Roles = getEnvRoles(cachedTable[i])
 	}
+
+	// add owner, team, description and links
+	applyEnvMetadata()
+
+	// add lease and reservation details
+	applyEnvLeases()
+	applyEnvReservations()
+
+	// add bills accrued and bills saved to env details (forecasts depend on leases)
+	applyEnvBills()
+
+	// keep track of state changes for reports
+	recordStateTransitions(time.Now())
 }
 
-// calculateEnvBills calculate bills accrued / saved since the last aws poll
-// return a map of env IDs with their respective bills accrued/saved
+// calculateEnvBills calculate bills accrued / saved since the last aws poll.
+// it must be called after the cache has been rebuilt (and updateEnvDetails), so that state changes can be placed on the billing timeline.
+// the usage is recorded for reports in any case, the bills (and costs of the usage) only when billing is enabled
 func calculateEnvBills() {
 	// acquire and release lock on instance id map only once here, to avoid doing it for every map read
 	toggledOffInstanceIdsLock.RLock()
-	defer toggledOffInstanceIdsLock.RUnlock()
+	units := getBillableUnits()
+	toggledOffInstanceIdsLock.RUnlock()
 
-	newRefreshedTimeUnixNano := time.Now().UnixNano()
-	elapsedTimeInHour := (float64(newRefreshedTimeUnixNano) - float64(lastRefreshedTimeUnixNano)) * float64(time.Nanosecond) / float64(time.Hour)
-	lastRefreshedTimeUnixNano = newRefreshedTimeUnixNano
+	now := time.Now()
+	results := billUnits(units, now)
 	for _, env := range cachedTable {
-		var envBillsAccrued float64
-		var envBillsSaved float64
-		for _, instance := range env.Instances {
-			// calculate bills as if state of instances are unchanged since the last poll. It's the best we can do for now (or so I believe)
-			instanceBill := instance.PricingHourly * elapsedTimeInHour
-			switch instance.State {
-			case "running":
-				envBillsAccrued += instanceBill
-			case "stopped":
-				// before claiming any responsibilities, need to find out whether the instance was actually stopped by aws-power-toggle :)
-				if toggledOffInstanceIds[instance.InstanceID] {
-					envBillsSaved += instanceBill
-				}
-			default:
-			}
+		result, found := results[env.ID]
+		if !found {
+			continue
+		}
+		if experimentalEnabled {
+			billsAccruedMap[env.ID] = billsAccruedMap[env.ID] + result.accrued
+			billsSavedMap[env.ID] = billsSavedMap[env.ID] + result.saved
+			totalBillsAccrued += result.accrued
+			totalBillsSaved += result.saved
+		} else {
+			// without billing, only the running time is recorded
+			result.accrued, result.saved = 0, 0
+		}
+		// keep track of the usage for reports
+		recordEnvUsage(env, *result, now)
+	}
+	applyEnvBills()
+	saveHistory(now)
+	return
+}
+
+// applyEnvBills adds the bills accrued and bills saved to the env details
+func applyEnvBills() {
+	if !experimentalEnabled {
+		return
+	}
+	for i := range cachedTable {
+		if envbillAccrued, exists := billsAccruedMap[cachedTable[i].ID]; exists {
+			cachedTable[i].BillsAccrued = fmt.Sprintf("%.02f", envbillAccrued)
+		}
+		if envbillSaved, exists := billsSavedMap[cachedTable[i].ID]; exists {
+			cachedTable[i].BillsSaved = fmt.Sprintf("%.02f", envbillSaved)
 		}
-		billsAccruedMap[env.ID] = billsAccruedMap[env.ID] + envBillsAccrued
-		billsSavedMap[env.ID] = billsSavedMap[env.ID] + envBillsSaved
-		totalBillsAccrued += envBillsAccrued
-		totalBillsSaved += envBillsSaved
+	}
+	// budgets are based on the bills accrued
+	applyEnvBudgets()
+}
+
+// getExposedTags returns the tags which are allowed by aws.exposed_tag_keys
+func getExposedTags(tags map[string]string) (exposed map[string]string) {
+	for key, value := range tags {
+		if !matchesAnyPattern(key, exposedTagKeys) {
+			continue
+		}
+		if exposed == nil {
+			exposed = map[string]string{}
+		}
+		exposed[key] = value
 	}
 	return
 }
@@ -256,7 +356,13 @@ func validateEnvName(envName string) (ok bool) {
 	return
 }
 
-// adds and instance to the global cachedTable
+// checks if a tag marks an instance (or ASG) as protected from environment stops
+func isKeepRunningTag(key, value string) bool {
+	return keepRunningTagKey != "" && key == keepRunningTagKey && value == keepRunningTagValue
+}
+
+// adds and instance to the global cachedTable.
+// instances are grouped by their computed environment key (see getEnvironmentKey), which is also the environment name
 func addInstance(instance *virtualMachine) {
 	// check if we should ignore instance based on:
 	//  - instance is not part of an ASG
@@ -304,6 +410,7 @@ func pollForASG() (instances []virtualMachine, err error) {
 				InstanceID:       ASGLabel,
 				InstanceType:     ASGLabel,
 				Region:           region,
+				AccountID:        getARNAccountID(aws.StringValue(asg.AutoScalingGroupARN)),
 				ASGInstanceCount: len(asg.Instances),
 				MinSize:          *asg.MinSize,
 				MaxSize:          *asg.MaxSize,
@@ -311,34 +418,63 @@ func pollForASG() (instances []virtualMachine, err error) {
 			}
 
 			isValidASG := false
+			instanceObj.Tags = make(map[string]string, len(asg.Tags))
 			for _, tag := range asg.Tags {
+				instanceObj.Tags[*tag.Key] = *tag.Value
 				if *tag.Key == "power-toggle-enabled" && *tag.Value == "true" {
 					isValidASG = true
 					// gather some additional information about this ASG
 					if len(asg.Instances) > 0 && *asg.DesiredCapacity > 0 {
 						instanceObj.State = "running"
 						for _, i := range asg.Instances {
-							// We sum the memory and vcpu of all the instances in an ASG (they appear as a single entry)
-							if details, found := getInstanceTypeDetails(*i.InstanceType); found {
+							member := asgMember{InstanceID: *i.InstanceId, LifecycleState: string(i.LifecycleState)}
+							if i.InstanceType != nil {
+								member.InstanceType = *i.InstanceType
+							}
+							if i.HealthStatus != nil {
+								member.HealthStatus = *i.HealthStatus
+							}
+							if i.AvailabilityZone != nil {
+								member.AvailabilityZone = *i.AvailabilityZone
+							}
+							// We sum the memory, vcpu and pricing of all the instances in an ASG (they appear as a single entry)
+							if details, found := getInstanceTypeDetails(member.InstanceType); found {
 								instanceObj.MemoryGB += details.MemoryGB
 								instanceObj.VCPU += details.VCPU
-								if pricingStr, ok := details.PricingHourlyByRegion[region]; ok {
-									pricing, errPrice := strconv.ParseFloat(pricingStr, 64)
-									if errPrice != nil {
-										log.Errorf("failed to parse pricing info to float: %s", pricingStr)
-									}
-									instanceObj.PricingHourly = pricing
-								}
 							}
+							// the platform of ASG members is unknown, linux pricing is used
+							memberObj := virtualMachine{InstanceType: member.InstanceType, Region: region}
+							applyInstancePricing(&memberObj)
+							member.PricingHourly = memberObj.PricingHourly
+							instanceObj.PricingHourly += memberObj.PricingHourly
+							instanceObj.ASGMembers = append(instanceObj.ASGMembers, member)
 						}
+						asgInstancePricing[region+"/"+instanceObj.Name] = instanceObj.PricingHourly / float64(len(instanceObj.ASGMembers))
+						putASGDesiredCapacity(region, instanceObj.Name, *asg.DesiredCapacity)
 					} else {
 						instanceObj.State = "stopped"
+						instanceObj.toggledOffCapacity = getASGDesiredCapacity(region, instanceObj.Name)
+						// an ASG which was not seen running is priced by the instance type it would launch
+						if _, found := asgInstancePricing[region+"/"+instanceObj.Name]; !found {
+							instanceType, typeErr := getASGInstanceType(asg, region)
+							if typeErr != nil {
+								log.Warningf("failed to determine the instance type of ASG %s, %s: %v", instanceObj.Name, region, typeErr)
+							} else if instanceType != "" {
+								typeObj := virtualMachine{InstanceType: instanceType, Region: region}
+								applyInstancePricing(&typeObj)
+								asgInstancePricing[region+"/"+instanceObj.Name] = typeObj.PricingHourly
+							}
+						}
 					}
+					instanceObj.asgInstancePricingHourly = asgInstancePricing[region+"/"+instanceObj.Name]
 				}
-				if *tag.Key == environmentTagKey && *tag.Value != "" {
-					instanceObj.Environment = *tag.Value
+				if isKeepRunningTag(*tag.Key, *tag.Value) {
+					instanceObj.Protected = true
 				}
 			}
+			instanceObj.Environment = getEnvironmentKey(instanceObj)
+			instanceObj.Role = instanceObj.Tags[roleTagKey]
+			instanceObj.ExposedTags = getExposedTags(instanceObj.Tags)
 			if isValidASG && validateEnvName(instanceObj.Environment) {
 				// if the ASG matches tags we add it like if it was a EC2.
 				instances = append(instances, instanceObj)
@@ -350,6 +486,62 @@ func pollForASG() (instances []virtualMachine, err error) {
 	return
 }
 
+// getASGInstanceType returns the instance type launched by an ASG, taken from its launch template
+// (or the first override of its mixed instances policy) or its launch configuration.
+// the result is cached, an empty type means it could not be determined
+func getASGInstanceType(asg autoscaling.AutoScalingGroup, region string) (instanceType string, err error) {
+	key := region + "/" + aws.StringValue(asg.AutoScalingGroupName)
+	if cached, found := asgInstanceTypes[key]; found {
+		return cached, nil
+	}
+
+	template := asg.LaunchTemplate
+	if policy := asg.MixedInstancesPolicy; policy != nil && policy.LaunchTemplate != nil {
+		template = policy.LaunchTemplate.LaunchTemplateSpecification
+		for _, override := range policy.LaunchTemplate.Overrides {
+			if override.InstanceType != nil {
+				instanceType = *override.InstanceType
+				break
+			}
+		}
+	}
+	switch {
+	case instanceType != "":
+	case template != nil && awsClients[region] != nil:
+		version := aws.StringValue(template.Version)
+		if version == "" {
+			version = "$Default"
+		}
+		params := &ec2.DescribeLaunchTemplateVersionsInput{
+			LaunchTemplateId:   template.LaunchTemplateId,
+			LaunchTemplateName: template.LaunchTemplateName,
+			Versions:           []string{version},
+		}
+		resp, respErr := awsClients[region].DescribeLaunchTemplateVersionsRequest(params).Send(context.Background())
+		if respErr != nil {
+			err = respErr
+			return
+		}
+		for _, templateVersion := range resp.LaunchTemplateVersions {
+			if templateVersion.LaunchTemplateData != nil {
+				instanceType = string(templateVersion.LaunchTemplateData.InstanceType)
+			}
+		}
+	case asg.LaunchConfigurationName != nil && awsASGClients[region] != nil:
+		params := &autoscaling.DescribeLaunchConfigurationsInput{LaunchConfigurationNames: []string{*asg.LaunchConfigurationName}}
+		resp, respErr := awsASGClients[region].DescribeLaunchConfigurationsRequest(params).Send(context.Background())
+		if respErr != nil {
+			err = respErr
+			return
+		}
+		for _, launchConfiguration := range resp.LaunchConfigurations {
+			instanceType = aws.StringValue(launchConfiguration.InstanceType)
+		}
+	}
+	asgInstanceTypes[key] = instanceType
+	return
+}
+
 // returns a list of discovered EC2 instances.
 func pollForEC2() (instances []virtualMachine, err error) {
 	params := &ec2.DescribeInstancesInput{
@@ -373,6 +565,23 @@ func pollForEC2() (instances []virtualMachine, err error) {
 			return
 		}
 
+		// the operating system of an instance is part of its image
+		var imageIDs []string
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.ImageId != nil {
+					imageIDs = append(imageIDs, *instance.ImageId)
+				}
+			}
+		}
+		// it is only needed for billing, which also requires an additional permission (ec2:DescribeImages)
+		if experimentalEnabled {
+			if errImages := pollForImagePlatformDetails(imageIDs, awsSvcClient); errImages != nil {
+				log.Errorf("failed to describe images, %s, %v", region, errImages)
+			}
+		}
+
+		var regionInstances []virtualMachine
 		for _, reservation := range resp.Reservations {
 			for _, instance := range reservation.Instances {
 				instanceObj := virtualMachine{
@@ -380,47 +589,209 @@ func pollForEC2() (instances []virtualMachine, err error) {
 					InstanceType: string(instance.InstanceType),
 					Region:       region,
 				}
+				if reservation.OwnerId != nil {
+					instanceObj.AccountID = *reservation.OwnerId
+				}
 				// populate info from tags
 				isASG := false
+				instanceObj.Tags = make(map[string]string, len(instance.Tags))
 				for _, tag := range instance.Tags {
-					if *tag.Key == environmentTagKey && *tag.Value != "" {
-						instanceObj.Environment = *tag.Value
-					}
+					instanceObj.Tags[*tag.Key] = *tag.Value
 					if *tag.Key == "Name" {
 						instanceObj.Name = *tag.Value
 					}
 					if *tag.Key == "aws:autoscaling:groupName" {
 						isASG = true
 					}
+					if isKeepRunningTag(*tag.Key, *tag.Value) {
+						instanceObj.Protected = true
+					}
 				}
 				// if true Instance is part of ASG. bypass this instance
 				if isASG {
 					continue // goto next instance
 				}
+				instanceObj.Environment = getEnvironmentKey(instanceObj)
+				instanceObj.Role = instanceObj.Tags[roleTagKey]
+				instanceObj.ExposedTags = getExposedTags(instanceObj.Tags)
+				// details which help to identify the instance
+				if instance.PrivateIpAddress != nil {
+					instanceObj.PrivateIP = *instance.PrivateIpAddress
+				}
+				if instance.PublicIpAddress != nil {
+					instanceObj.PublicIP = *instance.PublicIpAddress
+				}
+				if instance.Placement != nil && instance.Placement.AvailabilityZone != nil {
+					instanceObj.AvailabilityZone = *instance.Placement.AvailabilityZone
+				}
+				if instance.KeyName != nil {
+					instanceObj.KeyName = *instance.KeyName
+				}
+				if instance.LaunchTime != nil {
+					instanceObj.LaunchTime = instance.LaunchTime
+					if instanceObj.State == "running" {
+						instanceObj.Uptime = time.Since(*instance.LaunchTime).Round(time.Minute).String()
+					}
+				}
+				// determine when the instance changed to its current state (used for billing)
+				switch {
+				case instanceObj.State == "running" && instance.LaunchTime != nil:
+					instanceObj.stateChangedAt = *instance.LaunchTime
+				case instance.StateTransitionReason != nil:
+					instanceObj.stateChangedAt, _ = parseStateTransitionTime(*instance.StateTransitionReason)
+				}
 				// determine instance cpu and memory
 				if details, found := getInstanceTypeDetails(instanceObj.InstanceType); found {
 					instanceObj.MemoryGB = details.MemoryGB
 					instanceObj.VCPU = details.VCPU
-					if pricingstr, ok := details.PricingHourlyByRegion[region]; ok {
-						pricing, err := strconv.ParseFloat(pricingstr, 64)
-						if err != nil {
-							log.Errorf("failed to parse pricing info to float: %s", pricingstr)
-						}
-						instanceObj.PricingHourly = pricing
-					}
 				}
+				// determine the pricing for the operating system and purchase option
+				platformDetails := ""
+				if instance.ImageId != nil {
+					platformDetails = imagePlatformDetails[*instance.ImageId]
+				}
+				instanceObj.Platform = getPlatform(string(instance.Platform), platformDetails)
+				if instance.InstanceLifecycle == ec2.InstanceLifecycleTypeSpot {
+					instanceObj.PurchaseOption = PurchaseSpot
+				}
+				applyInstancePricing(&instanceObj)
 				if validateEnvName(instanceObj.Environment) {
-					instances = append(instances, instanceObj)
+					regionInstances = append(regionInstances, instanceObj)
 				}
 			}
 
 		}
+		// storage costs are not critical, so errors are only logged. they are only needed for billing,
+		// which also requires additional permissions (ec2:DescribeVolumes, ec2:DescribeAddresses)
+		if experimentalEnabled && len(regionInstances) > 0 {
+			addInstanceStorage(regionInstances, region, awsSvcClient)
+		}
+		instances = append(instances, regionInstances...)
 		elapsed := time.Since(pollEC2StartTime)
 		log.Debugf("polling for EC2s in region %s took %s", region, elapsed)
 	}
 	return
 }
 
+// addInstanceStorage adds the attached EBS volumes and associated elastic IPs (with their pricing) to the instances of a region
+func addInstanceStorage(instances []virtualMachine, region string, awsSvcClient *ec2.Client) {
+	instanceIDs := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		instanceIDs = append(instanceIDs, instance.InstanceID)
+	}
+	volumes, err := pollForVolumes(instanceIDs, awsSvcClient)
+	if err != nil {
+		log.Errorf("failed to describe volumes, %s, %v", region, err)
+	}
+	elasticIPs, err := pollForElasticIPs(awsSvcClient)
+	if err != nil {
+		log.Errorf("failed to describe addresses, %s, %v", region, err)
+	}
+
+	for i, instance := range instances {
+		instances[i].Volumes = volumes[instance.InstanceID]
+		instances[i].ElasticIPs = elasticIPs[instance.InstanceID]
+		for _, volume := range instances[i].Volumes {
+			if pricing, found := getVolumePricingHourly(volume.VolumeType, region, volume.SizeGB); found {
+				instances[i].StoragePricingHourly += pricing
+			} else {
+				log.Debugf("no pricing found for volume type %s in region %s", volume.VolumeType, region)
+			}
+		}
+		instances[i].IdlePricingHourly = float64(instances[i].ElasticIPs) * awsElasticIPIdlePricingHourly
+	}
+}
+
+// adds the PlatformDetails of the given images to imagePlatformDetails (if they are not known yet).
+// images which no longer exist (or are not accessible) are not returned by aws, they are cached without details
+// so they are not requested again. their instances fall back to the instance Platform
+func pollForImagePlatformDetails(imageIDs []string, awsSvcClient *ec2.Client) (err error) {
+	var unknown []string
+	for _, imageID := range imageIDs {
+		if _, found := imagePlatformDetails[imageID]; !found && !stringInSlice(imageID, unknown) {
+			unknown = append(unknown, imageID)
+		}
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	req := awsSvcClient.DescribeImagesRequest(&ec2.DescribeImagesInput{ImageIds: unknown})
+	resp, err := req.Send(context.Background())
+	if err != nil {
+		return
+	}
+	for _, imageID := range unknown {
+		imagePlatformDetails[imageID] = ""
+	}
+	for _, image := range resp.Images {
+		if image.ImageId != nil && image.PlatformDetails != nil {
+			imagePlatformDetails[*image.ImageId] = *image.PlatformDetails
+		}
+	}
+	return
+}
+
+// returns the EBS volumes attached to the given instances (by instance ID)
+func pollForVolumes(instanceIDs []string, awsSvcClient *ec2.Client) (volumes map[string][]ebsVolume, err error) {
+	volumes = make(map[string][]ebsVolume)
+	// a filter accepts up to 200 values
+	for start := 0; start < len(instanceIDs); start += 200 {
+		end := start + 200
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+		params := &ec2.DescribeVolumesInput{
+			Filters: []ec2.Filter{
+				{
+					Name:   aws.String("attachment.instance-id"),
+					Values: instanceIDs[start:end],
+				},
+			},
+		}
+		for {
+			req := awsSvcClient.DescribeVolumesRequest(params)
+			resp, respErr := req.Send(context.Background())
+			if respErr != nil {
+				err = respErr
+				return
+			}
+			for _, volume := range resp.Volumes {
+				for _, attachment := range volume.Attachments {
+					if attachment.InstanceId == nil || volume.VolumeId == nil || volume.Size == nil {
+						continue
+					}
+					volumes[*attachment.InstanceId] = append(volumes[*attachment.InstanceId], ebsVolume{
+						VolumeID:   *volume.VolumeId,
+						VolumeType: string(volume.VolumeType),
+						SizeGB:     *volume.Size,
+					})
+				}
+			}
+			if resp.NextToken == nil || *resp.NextToken == "" {
+				break
+			}
+			params.NextToken = resp.NextToken
+		}
+	}
+	return
+}
+
+// returns the amount of elastic IPs associated with each instance (by instance ID)
+func pollForElasticIPs(awsSvcClient *ec2.Client) (elasticIPs map[string]int, err error) {
+	elasticIPs = make(map[string]int)
+	req := awsSvcClient.DescribeAddressesRequest(&ec2.DescribeAddressesInput{})
+	resp, err := req.Send(context.Background())
+	if err != nil {
+		return
+	}
+	for _, address := range resp.Addresses {
+		if address.InstanceId != nil {
+			elasticIPs[*address.InstanceId]++
+		}
+	}
+	return
+}
+
 // polls aws for updates to cachedTable
 func refreshTable() (err error) {
 	cachedTableLock.Lock()
@@ -431,11 +802,6 @@ func refreshTable() (err error) {
 		return mockRefreshTable()
 	}
 
-	// calculate billing information before old table is ditched
-	if experimentalEnabled {
-		calculateEnvBills()
-	}
-
 	// used to calculate the time it took to poll aws
 	pollStartTime := time.Now()
 
@@ -464,18 +830,24 @@ func refreshTable() (err error) {
 		addInstance(&discoveredInstance)
 	}
 	updateEnvDetails()
+	// calculate usage (and billing information when enabled) with the new states
+	calculateEnvBills()
 
 	elapsed := time.Since(pollStartTime)
 	log.Debugf("total polling time took %s; valid environment(s) in cache: %d", elapsed, len(cachedTable))
 	return
 }
 
-// get instance ids for an environment with a specific state
+// get instance ids for an environment with a specific state (and optionally roles)
 // this is used for power up/down commands against aws API
-func getInstanceIDs(envID, state string) (instanceIds []string) {
+// protected instances are excluded when requested (by environment stops)
+func getInstanceIDs(envID, state string, excludeProtected bool, roles ...string) (instanceIds []string) {
 	for _, env := range cachedTable {
 		if env.ID == envID {
 			for _, instance := range env.Instances {
+				if (instance.Protected && excludeProtected) || !hasRole(instance, roles) {
+					continue
+				}
 				if !instance.IsASG && instance.State == state {
 					instanceIds = append(instanceIds, instance.InstanceID)
 				}
@@ -485,12 +857,16 @@ func getInstanceIDs(envID, state string) (instanceIds []string) {
 	return
 }
 
-// get ASG name for an environment with a specific state
+// get ASG name for an environment with a specific state (and optionally roles)
 // this is used for power up/down commands against aws API
-func getASGs(envID, state string) (asgNames []string, instanceCount int) {
+// protected ASGs are excluded when requested (by environment stops)
+func getASGs(envID, state string, excludeProtected bool, roles ...string) (asgNames []string, instanceCount int) {
 	for _, env := range cachedTable {
 		if env.ID == envID {
 			for _, instance := range env.Instances {
+				if (instance.Protected && excludeProtected) || !hasRole(instance, roles) {
+					continue
+				}
 				if instance.IsASG && instance.State == state {
 					asgNames = append(asgNames, instance.Name)
 					instanceCount += instance.ASGInstanceCount
@@ -560,10 +936,14 @@ func toggleASGs(asgNames []string, desiredState string, awsASGClient *autoscalin
 	case "start":
 		for _, asg := range asgNames {
 			// Must: DesiredCapacity >= MinSize , need to set both
-			// At start setting ASG to 1 as we haven't cached the original value.
+			// At start the capacity the ASG last had while running is restored (1 if it was not seen running).
+			capacity := getASGDesiredCapacity(awsASGClient.Config.Region, asg)
+			if capacity < 1 {
+				capacity = 1
+			}
 			input := &autoscaling.UpdateAutoScalingGroupInput{
 				AutoScalingGroupName: aws.String(asg),
-				DesiredCapacity:      aws.Int64(1),
+				DesiredCapacity:      aws.Int64(capacity),
 				MinSize:              aws.Int64(1),
 			}
 			req := awsASGClient.UpdateAutoScalingGroupRequest(input)
@@ -572,7 +952,7 @@ func toggleASGs(asgNames []string, desiredState string, awsASGClient *autoscalin
 			err = reqErr
 			if experimentalEnabled && err == nil {
 				// BILLING: update toggled off instances map
-				putToggledOffInstanceIDs(asgNames)
+				deleteToggledOffInstanceIDs(asgNames)
 			}
 		}
 		return
@@ -600,6 +980,27 @@ func toggleASGs(asgNames []string, desiredState string, awsASGClient *autoscalin
 	}
 }
 
+func putASGDesiredCapacity(region, name string, capacity int64) {
+	asgDesiredCapacityLock.Lock()
+	asgDesiredCapacity[region+"/"+name] = capacity
+	asgDesiredCapacityLock.Unlock()
+}
+
+func getASGDesiredCapacity(region, name string) int64 {
+	asgDesiredCapacityLock.RLock()
+	defer asgDesiredCapacityLock.RUnlock()
+	return asgDesiredCapacity[region+"/"+name]
+}
+
+// getASGStartCapacity returns the desired capacity of an ASG once it is started:
+// its capacity when it was last seen running, or 1 if it is unknown
+func getASGStartCapacity(instance virtualMachine) int64 {
+	if instance.toggledOffCapacity > 0 {
+		return instance.toggledOffCapacity
+	}
+	return 1
+}
+
 func putToggledOffInstanceIDs(instanceIDs []string) {
 	toggledOffInstanceIdsLock.Lock()
 	for _, instanceID := range instanceIDs {
@@ -617,10 +1018,19 @@ func deleteToggledOffInstanceIDs(instanceIDs []string) {
 }
 
 // shuts down an env
-func shutdownEnv(envID string) (response []byte, err error) {
+// confirmed is set when a stop over the safety limits was confirmed or approved (see checkLimits)
+func shutdownEnv(envID string, confirmed bool, roles ...string) (response []byte, err error) {
+	// the safety limits also apply to callers which do not go through performPowerAction
+	if !confirmed {
+		if err = checkSafetyLimits(envID, "stop", roles); err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+	}
+
 	// use the mock function if enabled
 	if mockEnabled {
-		return mockShutdownEnv(envID)
+		return mockShutdownEnv(envID, roles...)
 	}
 
 	// get env details
@@ -631,16 +1041,10 @@ func shutdownEnv(envID string) (response []byte, err error) {
 	}
 
 	// get ASGs for this environment
-	asgNames, asgInstanceCount := getASGs(envID, "running")
-	// get instance IDs for this environment
-	instanceIds := getInstanceIDs(envID, "running")
-	// calculate the total instances running in this environment
-	totalInstanceCount := len(instanceIds) + asgInstanceCount
-	if totalInstanceCount > maxInstancesToShutdown {
-		err = fmt.Errorf("SAFETY: env %s [%s] has too many associated instances to shutdown %d", env.Name, envID, totalInstanceCount)
-		log.Debugf("SAFETY: instances: %v", instanceIds)
-		return
-	}
+	asgNames, asgInstanceCount := getASGs(envID, "running", true, roles...)
+	// get instance IDs for this environment (protected instances keep running)
+	instanceIds := getInstanceIDs(envID, "running", true, roles...)
+	log.Debugf("stopping %d instance(s) and %d ASG instance(s) for env %s [%s]", len(instanceIds), asgInstanceCount, env.Name, envID)
 
 	// shutdown non-ASG EC2 instances
 	var errInstance error
@@ -658,38 +1062,29 @@ func shutdownEnv(envID string) (response []byte, err error) {
 		}
 	}
 
-	// determine if there's any errors
+	// determine if there's any errors (notifications are sent by performPowerAction)
 	if errInstance == nil && errASG == nil {
 		log.Infof("successfully stopped env %s [%s]", env.Name, envID)
-		slackSendMessage(
-			fmt.Sprintf(
-				"*STOPPING* environment *`%s`* in region _%s_ --> *%v instance(s)* totaling *%v vCPU(s)* & *%vGB* memory",
-				env.Name,
-				env.Region,
-				env.TotalInstances,
-				env.TotalVCPU,
-				env.TotalMemoryGB,
-			),
-		)
 	} else {
 		err = fmt.Errorf("%v %v", errInstance, errASG)
-		slackSendMessage(
-			fmt.Sprintf(
-				"*ERROR STOPPING* environment *`%s`* in region _%s_ --> `%v`",
-				env.Name,
-				env.Region,
-				err,
-			),
-		)
 	}
 	return
 }
 
 // starts up an env
-func startupEnv(envID string) (response []byte, err error) {
+// confirmed is set when a start over the safety limits was confirmed or approved (see checkLimits)
+func startupEnv(envID string, confirmed bool, roles ...string) (response []byte, err error) {
+	// the safety limits also apply to callers which do not go through performPowerAction
+	if !confirmed {
+		if err = checkSafetyLimits(envID, "start", roles); err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+	}
+
 	// use the mock function if enabled
 	if mockEnabled {
-		return mockStartupEnv(envID)
+		return mockStartupEnv(envID, roles...)
 	}
 
 	// get env details
@@ -700,9 +1095,9 @@ func startupEnv(envID string) (response []byte, err error) {
 	}
 
 	// get ASGs for this environment
-	asgNames, _ := getASGs(envID, "stopped")
+	asgNames, _ := getASGs(envID, "stopped", false, roles...)
 	// get instance IDs for this environment
-	instanceIds := getInstanceIDs(envID, "stopped")
+	instanceIds := getInstanceIDs(envID, "stopped", false, roles...)
 
 	// start non-ASG EC2 instances
 	var errInstance error
@@ -720,29 +1115,11 @@ func startupEnv(envID string) (response []byte, err error) {
 		}
 	}
 
-	// determine if there's any errors
+	// determine if there's any errors (notifications are sent by performPowerAction)
 	if errInstance == nil && errASG == nil {
 		log.Infof("successfully started env %s [%s]", env.Name, envID)
-		slackSendMessage(
-			fmt.Sprintf(
-				"*STARTING* environment *`%s`* in region _%s_ --> *%v instance(s)* totaling *%v vCPU(s)* & *%vGB* memory",
-				env.Name,
-				env.Region,
-				env.TotalInstances,
-				env.TotalVCPU,
-				env.TotalMemoryGB,
-			),
-		)
 	} else {
 		err = fmt.Errorf("%v %v", errInstance, errASG)
-		slackSendMessage(
-			fmt.Sprintf(
-				"*ERROR STARTING* environment *`%s`* in region _%s_ --> `%v`",
-				env.Name,
-				env.Region,
-				err,
-			),
-		)
 	}
 	return
 }
@@ -803,6 +1180,23 @@ func getEnvironmentByID(envID string) (environment, bool) {
 	return environment{}, false
 }
 
+// getCachedTableCopy returns a copy of the cached environments, which is safe to use while the cache is refreshed
+func getCachedTableCopy() envList {
+	cachedTableLock.Lock()
+	defer cachedTableLock.Unlock()
+	return append(envList{}, cachedTable...)
+}
+
+// returns a single environment by name (or id)
+func getEnvironmentByName(name string) (environment, bool) {
+	for _, env := range cachedTable {
+		if env.Name == name || env.ID == name {
+			return env, true
+		}
+	}
+	return environment{}, false
+}
+
 // returns awsClient for the specific environment ID
 func getEnvironmentAwsClient(envID string) *ec2.Client {
 	for _, env := range cachedTable {
@@ -157,7 +157,7 @@ func TestEnvStartStop(t *testing.T) {
 	}
 	envID := "4f9f1afb29f1"
 
-	_, err := startupEnv(envID)
+	_, err := startupEnv(envID, false)
 	if err != nil {
 		t.Errorf("startupEnv return and error: %v", err)
 	}
@@ -167,7 +167,7 @@ func TestEnvStartStop(t *testing.T) {
 		t.Errorf("test env is not in running state: %s", state)
 	}
 
-	_, err = shutdownEnv(envID)
+	_, err = shutdownEnv(envID, false)
 	if err != nil {
 		t.Errorf("startupEnv return and error: %v", err)
 	}
@@ -182,7 +182,8 @@ func resetMockData() error {
 	// disabled mock delays and chance of errors
 	unitTestRunning = true
 	mockEnabled = true
-	cachedTable = cachedTable[:0]
+	// do not reuse the backing array, json.Unmarshal would keep stale fields
+	cachedTable = nil
 	return mockRefreshTable()
 }
 
@@ -193,3 +194,60 @@ func getEnvState(envID string) (string, bool) {
 	}
 	return env.State, found
 }
+
+func TestProtectedInstances(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	env, _ := getEnvironmentByID(envID)
+	protectedID := env.Instances[0].InstanceID
+	for e := range cachedTable {
+		if cachedTable[e].ID == envID {
+			cachedTable[e].Instances[0].Protected = true
+		}
+	}
+
+	// protected instances can be started
+	if instanceIds := getInstanceIDs(envID, "stopped", false); len(instanceIds) != len(env.Instances) {
+		t.Errorf("protected instance should be included for start: %v", instanceIds)
+	}
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	// but not stopped with the environment, other lookups of running instances still include them
+	for _, instanceID := range getInstanceIDs(envID, "running", true) {
+		if instanceID == protectedID {
+			t.Errorf("protected instance should not be included for stop")
+		}
+	}
+	if !stringInSlice(protectedID, getInstanceIDs(envID, "running", false)) {
+		t.Errorf("protected instance should be included when not excluded")
+	}
+	if _, err := shutdownEnv(envID, false); err != nil {
+		t.Fatalf("shutdownEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+	env, _ = getEnvironmentByID(envID)
+	if env.State != EnvStateMixed || env.Instances[0].State != "running" {
+		t.Errorf("protected instance was stopped: env state %s", env.State)
+	}
+}
+
+func TestGetExposedTags(t *testing.T) {
+	exposedTagKeys = []string{"owner", "team-*"}
+	defer func() { exposedTagKeys = nil }()
+
+	tags := map[string]string{"owner": "alice", "team-name": "dev", "db-password": "secret"}
+	exposed := getExposedTags(tags)
+	if len(exposed) != 2 || exposed["owner"] != "alice" || exposed["team-name"] != "dev" {
+		t.Errorf("unexpected exposed tags: %v", exposed)
+	}
+
+	exposedTagKeys = nil
+	if exposed = getExposedTags(tags); exposed != nil {
+		t.Errorf("expected no tags to be exposed by default, got: %v", exposed)
+	}
+}
@@ -19,9 +19,21 @@ func StartBackendDeamon(cfgFile string) {
 	// init the config
 	ConfigInit(cfgFile, true)
 
+	// load the pricing catalog (the embedded catalog is used if this fails)
+	if _, err := refreshPricingCatalog(); err != nil {
+		log.Errorf("%v", err)
+	}
+	go StartPricingRefresher()
+
+	// start delivering notifications
+	StartNotificationWorkers()
+
 	// start http server
 	go startHTTPServer()
 
+	// start the proxy which starts environments on demand
+	go StartWakeProxy()
+
 	// init the aws clients
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
@@ -38,6 +50,15 @@ func StartBackendDeamon(cfgFile string) {
 		}
 	}
 
+	// start enforcing environment leases
+	go StartLeaseWatcher()
+
+	// start sending scheduled cost reports
+	go StartReportScheduler()
+
+	// start checking environment budgets
+	go StartBudgetWatcher()
+
 	// start the poller
 	StartPoller()
 }
@@ -0,0 +1,236 @@
+package backend
+
+import (
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	// billing timeline of everything we pay for (by billing key, see getBillableUnits)
+	billingTimeline = map[string]*billingEntry{}
+	// lock to prevent concurrent access of the above timeline
+	billingTimelineLock sync.Mutex
+
+	// the time of a state change is part of the EC2 StateTransitionReason (ie. "User initiated (2020-03-10 12:00:00 GMT)")
+	stateTransitionTimeRegex = regexp.MustCompile(`\((\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) GMT\)`)
+)
+
+// asgMember is a single instance of an ASG
+type asgMember struct {
+	InstanceID       string  `json:"instance_id" groups:"details"`
+	InstanceType     string  `json:"instance_type" groups:"details"`
+	AvailabilityZone string  `json:"availability_zone,omitempty" groups:"details"`
+	HealthStatus     string  `json:"health_status,omitempty" groups:"details"`
+	LifecycleState   string  `json:"lifecycle_state,omitempty" groups:"details"`
+	PricingHourly    float64 `json:"pricing" groups:"details"`
+}
+
+// billableUnit is something which costs money while running: an EC2 instance or an ASG member.
+// a stopped ASG is also a billable unit, since it saves the cost of its members
+type billableUnit struct {
+	key           string
+	envID         string
+	running       bool
+	pricingHourly float64
+	// billed regardless of the state (ie. EBS volumes)
+	storagePricingHourly float64
+	// billed while not running (ie. elastic IPs)
+	idlePricingHourly float64
+	// time at which the unit changed to its current state (if known)
+	stateChangedAt time.Time
+	// running time is added to the bills accrued
+	accrues bool
+	// stopped time is added to the bills saved
+	saves bool
+}
+
+// billingEntry is the last known state of a billable unit
+type billingEntry struct {
+	envID                string
+	running              bool
+	pricingHourly        float64
+	storagePricingHourly float64
+	idlePricingHourly    float64
+	accrues              bool
+	// everything up to this time has been billed
+	billedUntil time.Time
+}
+
+// billingResult is the amount billed for an environment during a single calculation
+type billingResult struct {
+	accrued float64
+	saved   float64
+	// hours during which any unit was running
+	runningHours float64
+	// sum of the running hours of all units
+	instanceHours float64
+}
+
+// parseStateTransitionTime returns the time of a state change from an EC2 StateTransitionReason
+func parseStateTransitionTime(reason string) (t time.Time, found bool) {
+	matches := stateTransitionTimeRegex.FindStringSubmatch(reason)
+	if len(matches) != 2 {
+		return
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", matches[1])
+	return t, err == nil
+}
+
+// getBillableUnits returns the billable units of all cached environments.
+// toggledOffInstanceIdsLock must be held
+func getBillableUnits() (units []billableUnit) {
+	for _, env := range cachedTable {
+		for _, instance := range env.Instances {
+			if !instance.IsASG {
+				units = append(units, billableUnit{
+					key:                  instance.InstanceID,
+					envID:                env.ID,
+					running:              instance.State == "running",
+					pricingHourly:        instance.PricingHourly,
+					storagePricingHourly: instance.StoragePricingHourly,
+					idlePricingHourly:    instance.IdlePricingHourly,
+					stateChangedAt:       instance.stateChangedAt,
+					accrues:              true,
+					// before claiming any responsibilities, need to find out whether the instance was actually stopped by aws-power-toggle :)
+					saves: instance.State == "stopped" && toggledOffInstanceIds[instance.InstanceID],
+				})
+				continue
+			}
+			// each member of an ASG is charged with its own price
+			for _, member := range instance.ASGMembers {
+				units = append(units, billableUnit{
+					key:           member.InstanceID,
+					envID:         env.ID,
+					running:       true,
+					pricingHourly: member.PricingHourly,
+					accrues:       true,
+				})
+			}
+			// a stopped ASG saves what its members would cost at the capacity it had while running
+			pricingHourly := instance.PricingHourly
+			if instance.State != "running" {
+				pricingHourly = getASGHourlyCost(instance, true)
+			}
+			units = append(units, billableUnit{
+				key:           "asg/" + instance.Region + "/" + instance.Name,
+				envID:         env.ID,
+				running:       instance.State == "running",
+				pricingHourly: pricingHourly,
+				saves:         instance.State == "stopped" && toggledOffInstanceIds[instance.Name],
+			})
+		}
+	}
+	return
+}
+
+// billUnits integrates the cost of all billable units over their running intervals since they were last billed.
+// a state change is placed at the time reported by aws when known, otherwise at the time it was detected.
+// units seen for the first time are not billed, since we do not know what they did before
+func billUnits(units []billableUnit, now time.Time) map[string]*billingResult {
+	billingTimelineLock.Lock()
+	defer billingTimelineLock.Unlock()
+
+	results := map[string]*billingResult{}
+	seen := make(map[string]bool, len(units))
+	for _, unit := range units {
+		seen[unit.key] = true
+		result, found := results[unit.envID]
+		if !found {
+			result = &billingResult{}
+			results[unit.envID] = result
+		}
+
+		entry, found := billingTimeline[unit.key]
+		if !found {
+			billingTimeline[unit.key] = &billingEntry{
+				envID:                unit.envID,
+				running:              unit.running,
+				pricingHourly:        unit.pricingHourly,
+				storagePricingHourly: unit.storagePricingHourly,
+				idlePricingHourly:    unit.idlePricingHourly,
+				accrues:              unit.accrues,
+				billedUntil:          now,
+			}
+			continue
+		}
+
+		// split the interval at the state change (if any)
+		var runningHours, stoppedHours float64
+		changedAt := now
+		if entry.running != unit.running && unit.stateChangedAt.After(entry.billedUntil) && unit.stateChangedAt.Before(now) {
+			changedAt = unit.stateChangedAt
+		}
+		before := changedAt.Sub(entry.billedUntil).Hours()
+		after := now.Sub(changedAt).Hours()
+		if entry.running {
+			runningHours += before
+		} else {
+			stoppedHours += before
+		}
+		if unit.running {
+			runningHours += after
+		} else {
+			stoppedHours += after
+		}
+
+		if unit.accrues {
+			// the prices of the previous state apply until the state has changed
+			result.accrued += getHourlyCost(entry.running, entry.pricingHourly, entry.storagePricingHourly, entry.idlePricingHourly)*before +
+				getHourlyCost(unit.running, unit.pricingHourly, unit.storagePricingHourly, unit.idlePricingHourly)*after
+			result.instanceHours += runningHours
+			if runningHours > result.runningHours {
+				result.runningHours = runningHours
+			}
+		}
+		if unit.saves {
+			// the compute price of a stopped unit is the price it had while running.
+			// storage and elastic IPs are still billed, so they are not saved
+			result.saved += entry.pricingHourly * stoppedHours
+		}
+
+		entry.envID = unit.envID
+		entry.running = unit.running
+		entry.accrues = unit.accrues
+		entry.billedUntil = now
+		entry.storagePricingHourly = unit.storagePricingHourly
+		entry.idlePricingHourly = unit.idlePricingHourly
+		// a stopped ASG has no members, so its last running price is kept
+		if unit.pricingHourly > 0 || unit.accrues {
+			entry.pricingHourly = unit.pricingHourly
+		}
+	}
+
+	// units which are gone (ie. terminated instances or ASG members after a scale-in) are billed in their
+	// last known state until now, since the time at which they disappeared is unknown. then they are no longer billed
+	for key, entry := range billingTimeline {
+		if seen[key] {
+			continue
+		}
+		if entry.accrues {
+			result, found := results[entry.envID]
+			if !found {
+				result = &billingResult{}
+				results[entry.envID] = result
+			}
+			hours := now.Sub(entry.billedUntil).Hours()
+			result.accrued += getHourlyCost(entry.running, entry.pricingHourly, entry.storagePricingHourly, entry.idlePricingHourly) * hours
+			if entry.running {
+				result.instanceHours += hours
+				if hours > result.runningHours {
+					result.runningHours = hours
+				}
+			}
+		}
+		delete(billingTimeline, key)
+	}
+	return results
+}
+
+// getHourlyCost returns the hourly cost of a unit in the given state
+func getHourlyCost(running bool, pricing, storagePricing, idlePricing float64) float64 {
+	if running {
+		return pricing + storagePricing
+	}
+	return storagePricing + idlePricing
+}
@@ -0,0 +1,104 @@
+package backend
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseStateTransitionTime(t *testing.T) {
+	reasonTime, found := parseStateTransitionTime("User initiated (2020-03-10 12:30:00 GMT)")
+	if !found || !reasonTime.Equal(time.Date(2020, 3, 10, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("unexpected state transition time: %v %v", reasonTime, found)
+	}
+	if _, found = parseStateTransitionTime(""); found {
+		t.Error("expected no time for an empty reason")
+	}
+}
+
+func TestBillUnits(t *testing.T) {
+	billingTimeline = map[string]*billingEntry{}
+	defer func() { billingTimeline = map[string]*billingEntry{} }()
+
+	start := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	units := []billableUnit{
+		{key: "i-1", envID: "env", running: true, pricingHourly: 1, accrues: true},
+		{key: "i-2", envID: "env", running: true, pricingHourly: 2, accrues: true},
+		// members of a running ASG
+		{key: "i-asg-1", envID: "env", running: true, pricingHourly: 0.5, accrues: true},
+		{key: "i-asg-2", envID: "env", running: true, pricingHourly: 0.25, accrues: true},
+		{key: "asg/region/asg", envID: "env", running: true, pricingHourly: 0.75},
+	}
+
+	// units seen for the first time are not billed
+	if result := billUnits(units, start); result["env"].accrued != 0 {
+		t.Errorf("expected nothing to be billed on the first calculation, got: %+v", result["env"])
+	}
+
+	// i-1 was stopped by us half an hour after the last poll (as reported by aws),
+	// i-2 was stopped at an unknown time and the ASG was scaled down to 0
+	now := start.Add(2 * time.Hour)
+	units = []billableUnit{
+		{key: "i-1", envID: "env", running: false, pricingHourly: 1, stateChangedAt: start.Add(30 * time.Minute), accrues: true, saves: true},
+		{key: "i-2", envID: "env", running: false, pricingHourly: 2, accrues: true},
+		{key: "asg/region/asg", envID: "env", running: false, saves: true},
+	}
+	result := billUnits(units, now)["env"]
+	// i-1: 0.5h * 1, i-2: 2h * 2 (detected at the poll), ASG members are gone: 2h * 0.75 up to the poll
+	if math.Abs(result.accrued-6) > 0.0001 {
+		t.Errorf("expected 6 to be accrued, got: %v", result.accrued)
+	}
+	// i-1 saved 1.5h * 1
+	if math.Abs(result.saved-1.5) > 0.0001 || result.runningHours != 2 || result.instanceHours != 6.5 {
+		t.Errorf("unexpected billing result: %+v", result)
+	}
+	if _, found := billingTimeline["i-asg-1"]; found {
+		t.Error("expected units which are gone to be removed from the timeline")
+	}
+
+	// a stopped ASG saves the price its members had while it was running
+	result = billUnits(units, now.Add(time.Hour))["env"]
+	if math.Abs(result.saved-1.75) > 0.0001 || result.accrued != 0 {
+		t.Errorf("unexpected billing result: %+v", result)
+	}
+}
+
+func TestBillUnitsStorage(t *testing.T) {
+	billingTimeline = map[string]*billingEntry{}
+	defer func() { billingTimeline = map[string]*billingEntry{} }()
+
+	start := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	unit := billableUnit{key: "i-1", envID: "env", running: true, pricingHourly: 1, storagePricingHourly: 0.1, idlePricingHourly: 0.005, accrues: true}
+	billUnits([]billableUnit{unit}, start)
+
+	// a running instance accrues compute and storage
+	result := billUnits([]billableUnit{unit}, start.Add(time.Hour))["env"]
+	if math.Abs(result.accrued-1.1) > 0.0001 {
+		t.Errorf("expected 1.1 to be accrued, got: %v", result.accrued)
+	}
+
+	// a stopped instance still accrues storage and its idle elastic IPs, only compute is saved
+	unit.running, unit.saves = false, true
+	billUnits([]billableUnit{unit}, start.Add(time.Hour))
+	result = billUnits([]billableUnit{unit}, start.Add(3*time.Hour))["env"]
+	if math.Abs(result.accrued-0.21) > 0.0001 || math.Abs(result.saved-2) > 0.0001 {
+		t.Errorf("unexpected billing result: %+v", result)
+	}
+}
+
+func TestGetBillableUnitsStoppedASG(t *testing.T) {
+	defer func() { cachedTable = envList{} }()
+	toggledOffInstanceIdsLock.Lock()
+	defer toggledOffInstanceIdsLock.Unlock()
+	toggledOffInstanceIds["asg"] = true
+	defer delete(toggledOffInstanceIds, "asg")
+
+	// a stopped ASG which was not seen running is priced by its instance type and last known capacity
+	cachedTable = envList{{ID: "env", Instances: []virtualMachine{
+		{IsASG: true, Name: "asg", Region: "region", State: "stopped", asgInstancePricingHourly: 0.25, toggledOffCapacity: 3},
+	}}}
+	units := getBillableUnits()
+	if len(units) != 1 || math.Abs(units[0].pricingHourly-0.75) > 0.0001 || !units[0].saves || units[0].accrues {
+		t.Errorf("unexpected billable units: %+v", units)
+	}
+}
@@ -0,0 +1,247 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defines how budgets are enforced
+
+	// BudgetEnforcementNone only sends alerts
+	BudgetEnforcementNone = "none"
+	// BudgetEnforcementRefuseStart refuses to start an environment which is over its budget
+	BudgetEnforcementRefuseStart = "refuse_start"
+	// BudgetEnforcementStop also stops an environment once it goes over its budget
+	BudgetEnforcementStop = "stop"
+
+	// EventBudgetThreshold is sent when an environment has spent a configured percentage of its budget
+	EventBudgetThreshold = "budget_threshold"
+
+	// format of the month in which alerts were sent
+	budgetMonthFormat = "2006-01"
+)
+
+var (
+	// values are set by ConfigInit
+	budgetDefaultMonthly float64
+	budgetTagKey         string
+	budgetThresholds     []float64
+	budgetEnforcement    string
+	budgetCheckInterval  time.Duration
+	envBudgetOverrides   []envBudgetOverride
+
+	// highest threshold alerted for each environment (by env ID) during the current month
+	budgetAlertsSent = map[string]budgetAlert{}
+	// month in which the stop of an environment over its budget was attempted (by env ID).
+	// the stop is only attempted once a month, a refused stop (ie. it requires approval) would be refused again
+	budgetStopsAttempted = map[string]string{}
+)
+
+// envBudgetOverride sets the monthly budget for environments matching a name pattern
+type envBudgetOverride struct {
+	Environments []string `mapstructure:"environments"`
+	Monthly      float64  `mapstructure:"monthly"`
+}
+
+// envBudget is the budget status of an environment, used for api responses
+type envBudget struct {
+	Monthly float64 `json:"monthly" groups:"summary,details"`
+	// month-to-date accrued cost
+	Spent float64 `json:"spent" groups:"summary,details"`
+	// expected cost at the end of the month, if the environment stays in its current state
+	Forecast    float64 `json:"forecast" groups:"summary,details"`
+	UsedPercent float64 `json:"used_percent" groups:"summary,details"`
+	Exceeded    bool    `json:"exceeded" groups:"summary,details"`
+}
+
+// budgetAlert is the last alert sent for an environment
+type budgetAlert struct {
+	Month     string
+	Threshold float64
+}
+
+// loadEnvBudgetOverrides parses the per environment budgets from the config file
+func loadEnvBudgetOverrides() {
+	envBudgetOverrides = nil
+	if err := viper.UnmarshalKey("budgets.environments", &envBudgetOverrides); err != nil {
+		log.Errorf("could not parse budgets.environments from config: %v", err)
+	}
+}
+
+// parseBudgetEnforcement validates the configured enforcement, which defaults to alerts only
+func parseBudgetEnforcement(enforcement string) string {
+	switch enforcement {
+	case BudgetEnforcementNone, BudgetEnforcementRefuseStart, BudgetEnforcementStop:
+		return enforcement
+	case "":
+		return BudgetEnforcementNone
+	}
+	log.Warningf("ignoring invalid budget enforcement: %s", enforcement)
+	return BudgetEnforcementNone
+}
+
+// parseBudgetThresholds converts the configured alert thresholds (in percent) to numbers.
+// they are sorted from the lowest to the highest threshold
+func parseBudgetThresholds(thresholds []string) (parsed []float64) {
+	for _, t := range thresholds {
+		threshold, err := strconv.ParseFloat(t, 64)
+		if err != nil || threshold <= 0 {
+			log.Warningf("ignoring invalid budget threshold: %s", t)
+			continue
+		}
+		parsed = append(parsed, threshold)
+	}
+	sort.Float64s(parsed)
+	return
+}
+
+// getEnvMonthlyBudget determines the monthly budget of an environment (0 when it has none).
+// tags on its members take precedence over the config file, which takes precedence over the default budget.
+// when members have conflicting tag values, the lowest value is used
+func getEnvMonthlyBudget(env environment) (monthly float64) {
+	monthly = budgetDefaultMonthly
+	for _, override := range envBudgetOverrides {
+		if matchesAnyPattern(env.Name, override.Environments) {
+			monthly = override.Monthly
+			break
+		}
+	}
+
+	if budgetTagKey == "" {
+		return
+	}
+	var tagged float64
+	for _, instance := range env.Instances {
+		if v, err := strconv.ParseFloat(instance.Tags[budgetTagKey], 64); err == nil && v > 0 {
+			if tagged == 0 || v < tagged {
+				tagged = v
+			}
+		}
+	}
+	if tagged > 0 {
+		monthly = tagged
+	}
+	return
+}
+
+// getEnvBudget returns the budget status of an environment.
+// found is false when the environment has no budget
+func getEnvBudget(env environment, now time.Time) (budget envBudget, found bool) {
+	monthly := getEnvMonthlyBudget(env)
+	if monthly <= 0 {
+		return
+	}
+	budget.Monthly = monthly
+	budget.Spent, budget.Forecast = getEnvMonthEndForecast(env, now)
+	budget.UsedPercent = budget.Spent / monthly * 100
+	budget.Exceeded = budget.Spent >= monthly
+	return budget, true
+}
+
+// applyEnvBudgets adds budget information to the cached environments
+func applyEnvBudgets() {
+	now := time.Now()
+	for i := range cachedTable {
+		cachedTable[i].Budget = nil
+		if budget, found := getEnvBudget(cachedTable[i], now); found {
+			cachedTable[i].Budget = &budget
+		}
+	}
+}
+
+// checkBudget is an actionGuard which refuses to start an environment (or its instances) which is over its budget
+func checkBudget(action powerAction) error {
+	if action.Action != "start" || budgetEnforcement == BudgetEnforcementNone || !experimentalEnabled {
+		return nil
+	}
+	env, found := getEnvironmentByID(action.EnvID)
+	if !found {
+		return nil
+	}
+	budget, found := getEnvBudget(env, time.Now())
+	if !found || !budget.Exceeded {
+		return nil
+	}
+	return actionError{
+		Status:  http.StatusPaymentRequired,
+		Message: fmt.Sprintf("environment %s is over its monthly budget: spent %.02f of %.02f", env.Name, budget.Spent, budget.Monthly),
+	}
+}
+
+// checkBudgets sends alerts for the budget thresholds which have been reached
+// and stops environments over their budget (if enforced, once a month)
+func checkBudgets(now time.Time) {
+	month := now.UTC().Format(budgetMonthFormat)
+	var overBudget []environment
+	for _, env := range getCachedTableCopy() {
+		budget, found := getEnvBudget(env, now)
+		if !found {
+			continue
+		}
+		// protected instances keep running, an environment with only those left is considered stopped
+		if budget.Exceeded && !envReachedState(env, EnvStateStopped) && budgetStopsAttempted[env.ID] != month {
+			overBudget = append(overBudget, env)
+		}
+
+		// only the highest threshold reached is alerted, lower thresholds are then considered sent
+		var reached float64
+		for _, threshold := range budgetThresholds {
+			if budget.UsedPercent >= threshold {
+				reached = threshold
+			}
+		}
+		sent := budgetAlertsSent[env.ID]
+		if reached == 0 || (sent.Month == month && sent.Threshold >= reached) {
+			continue
+		}
+		budgetAlertsSent[env.ID] = budgetAlert{Month: month, Threshold: reached}
+		event := newEnvEvent(EventBudgetThreshold, env)
+		event.Details = map[string]string{
+			"threshold": fmt.Sprintf("%v%%", reached),
+			"budget":    fmt.Sprintf("%.02f", budget.Monthly),
+			"spent":     fmt.Sprintf("%.02f", budget.Spent),
+			"forecast":  fmt.Sprintf("%.02f", budget.Forecast),
+		}
+		sendNotification(event)
+		log.Infof("env %s [%s] reached %v%% of its monthly budget", env.Name, env.ID, reached)
+	}
+
+	if budgetEnforcement != BudgetEnforcementStop {
+		return
+	}
+	for _, env := range overBudget {
+		log.Infof("env %s [%s] is over its monthly budget, stopping it", env.Name, env.ID)
+		action := powerAction{
+			EnvID:  env.ID,
+			Action: "stop",
+			Actor:  ActionSourceBudget,
+			Source: ActionSourceBudget,
+		}
+		budgetStopsAttempted[env.ID] = month
+		if _, err := performPowerAction(action); err != nil {
+			log.Errorf("failed to stop env %s [%s] over its budget: %v", env.Name, env.ID, err)
+		}
+	}
+}
+
+// StartBudgetWatcher is an infinite loop which periodically checks environment budgets
+func StartBudgetWatcher() {
+	if !experimentalEnabled {
+		return
+	}
+	interval := budgetCheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	log.Infof("start budget watcher with interval %v", interval)
+
+	for now := range time.Tick(interval) {
+		checkBudgets(now)
+	}
+}
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseBudgetThresholds(t *testing.T) {
+	thresholds := parseBudgetThresholds([]string{"100", "50", "wrong", "-1", "80"})
+	if len(thresholds) != 3 || thresholds[0] != 50 || thresholds[1] != 80 || thresholds[2] != 100 {
+		t.Errorf("unexpected thresholds: %v", thresholds)
+	}
+	if enforcement := parseBudgetEnforcement("wrong"); enforcement != BudgetEnforcementNone {
+		t.Errorf("expected an invalid enforcement to be ignored, got: %s", enforcement)
+	}
+}
+
+func TestGetEnvMonthlyBudget(t *testing.T) {
+	budgetDefaultMonthly = 100
+	budgetTagKey = "budget"
+	envBudgetOverrides = []envBudgetOverride{{Environments: []string{"prod-*"}, Monthly: 1000}}
+	defer func() {
+		budgetDefaultMonthly = 0
+		budgetTagKey = ""
+		envBudgetOverrides = nil
+	}()
+
+	for _, tc := range []struct {
+		env      environment
+		expected float64
+	}{
+		{environment{Name: "dev"}, 100},
+		{environment{Name: "prod-eu"}, 1000},
+		// the lowest tag value wins over the config
+		{environment{Name: "prod-eu", Instances: []virtualMachine{
+			{Tags: map[string]string{"budget": "500"}},
+			{Tags: map[string]string{"budget": "250"}},
+			{Tags: map[string]string{"budget": "wrong"}},
+		}}, 250},
+	} {
+		if monthly := getEnvMonthlyBudget(tc.env); monthly != tc.expected {
+			t.Errorf("%s: expected a budget of %v, got %v", tc.env.Name, tc.expected, monthly)
+		}
+	}
+}
+
+func TestCheckBudgets(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	var events []notificationEvent
+	notificationChannels = []notificationChannel{{Name: "all", notifier: testNotifier{&events}}}
+	experimentalEnabled = true
+	budgetDefaultMonthly = 100
+	budgetThresholds = []float64{50, 80, 100}
+	budgetEnforcement = BudgetEnforcementStop
+	defer func() {
+		notificationChannels = nil
+		experimentalEnabled = false
+		budgetDefaultMonthly = 0
+		budgetThresholds = nil
+		budgetEnforcement = BudgetEnforcementNone
+		budgetAlertsSent = map[string]budgetAlert{}
+		budgetStopsAttempted = map[string]string{}
+		envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+	}()
+
+	now := time.Now()
+	env, _ := getEnvironmentByID(envID)
+	usage := &envDailyUsage{Date: now.UTC().Format(usageDateFormat), EnvID: envID, Cost: 85}
+	envHistory = envHistoryData{Usage: map[string]*envDailyUsage{usageKey(usage.Date, envID): usage}}
+
+	budget, found := getEnvBudget(env, now)
+	if !found || budget.Spent != 85 || budget.Exceeded || budget.Forecast < budget.Spent {
+		t.Errorf("unexpected budget: %+v", budget)
+	}
+	applyEnvBudgets()
+	if env, _ = getEnvironmentByID(envID); env.Budget == nil || math.Abs(env.Budget.UsedPercent-85) > 0.0001 {
+		t.Errorf("budget is not reflected in env: %+v", env.Budget)
+	}
+
+	// only the highest threshold reached is alerted, and only once
+	checkBudgets(now)
+	checkBudgets(now)
+	if len(events) != 1 || events[0].Type != EventBudgetThreshold || events[0].Details["threshold"] != "80%" {
+		t.Fatalf("expected a single alert for 80%%, got: %+v", events)
+	}
+
+	// over the budget: the env is stopped and can not be started
+	usage.Cost = 120
+	checkBudgets(now)
+	updateEnvDetails()
+	if state, _ := getEnvState(envID); state != EnvStateStopped {
+		t.Errorf("expected env over budget to be stopped, got: %s", state)
+	}
+	if events[1].Details["threshold"] != "100%" {
+		t.Errorf("expected an alert for 100%%, got: %+v", events[1])
+	}
+	start := powerAction{EnvID: envID, Action: "start", Actor: "jdoe", Source: ActionSourceAPI}
+	if _, err := performPowerAction(start); getStatusCode(err) != http.StatusPaymentRequired {
+		t.Errorf("expected start to be refused, got: %v", err)
+	}
+
+	// the stop is only attempted once a month, even when the env is started again
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+	stopEvents := 0
+	checkBudgets(now)
+	updateEnvDetails()
+	for _, event := range events {
+		if event.Type == EventEnvStopped {
+			stopEvents++
+		}
+	}
+	if state, _ := getEnvState(envID); state != EnvStateRunning || stopEvents != 1 {
+		t.Errorf("expected the env not to be stopped again this month, got: %s (%d stop(s))", state, stopEvents)
+	}
+
+	budgetEnforcement = BudgetEnforcementNone
+	if err := checkBudget(start); err != nil {
+		t.Errorf("expected start to be allowed without enforcement, got: %v", err)
+	}
+}
@@ -1,8 +1,11 @@
 package backend
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"path"
 	"strings"
 )
 
@@ -12,3 +15,32 @@ func ComputeID(input ...string) string {
 	sum := fmt.Sprintf("%x", sha1.Sum([]byte(inputString)))
 	return sum[0:12]
 }
+
+// generateRandomID returns a random 12 character identifier (same length as ComputeID)
+func generateRandomID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("could not read random bytes: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// matchesAnyPattern returns true if the name matches one of the patterns (see path.Match)
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// stringInSlice returns true if the string is found in the list
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
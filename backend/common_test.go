@@ -25,3 +25,19 @@ func TestComputeId(t *testing.T) {
 		t.Error("testMultipleInputsExpectedID did not match")
 	}
 }
+
+func TestGenerateRandomID(t *testing.T) {
+	id := generateRandomID()
+	if len(id) != 12 {
+		t.Errorf("unexpected id length: %s", id)
+	}
+	if id == generateRandomID() {
+		t.Error("generated ids are not random")
+	}
+}
+
+func TestStringInSlice(t *testing.T) {
+	if !stringInSlice("b", []string{"a", "b"}) || stringInSlice("c", []string{"a", "b"}) || stringInSlice("a", nil) {
+		t.Error("stringInSlice returned an unexpected result")
+	}
+}
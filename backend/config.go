@@ -26,14 +26,72 @@ func ConfigInit(cfgFile string, printConfig bool) {
 	envNameIgnore = viper.GetStringSlice("aws.ignore_environments")
 	instanceTypeIgnore = viper.GetStringSlice("aws.ignore_instance_types")
 	maxInstancesToShutdown = viper.GetInt("aws.max_instances_to_shutdown")
+	maxInstancesToStartup = viper.GetInt("aws.max_instances_to_startup")
+	maxHourlyCostToStartup = viper.GetFloat64("aws.max_hourly_cost_to_startup")
+	confirmationWindow = viper.GetDuration("limits.confirmation_window")
+	limitTagPrefix = viper.GetString("limits.tag_prefix")
+	loadEnvLimitOverrides()
 	requiredTagKey = viper.GetString("aws.required_tag_key")
 	requiredTagValue = viper.GetString("aws.required_tag_value")
 	environmentTagKey = viper.GetString("aws.environment_tag_key")
+	loadEnvironmentGrouping()
+	roleTagKey = viper.GetString("aws.role_tag_key")
+	keepRunningTagKey = viper.GetString("aws.keep_running_tag_key")
+	keepRunningTagValue = viper.GetString("aws.keep_running_tag_value")
 	slackEnabled = viper.GetBool("slack.enabled")
 	slackWebHooks = viper.GetStringSlice("slack.webhook_urls")
+	slackSigningSecret = viper.GetString("slack.signing_secret")
+	slackUsers = viper.GetStringMapString("slack.users")
+	slackKeepRunningDuration = viper.GetDuration("slack.keep_running_duration")
+	notificationWorkers = viper.GetInt("notifications.workers")
+	notificationQueueSize = viper.GetInt("notifications.queue_size")
+	notificationMaxAttempts = viper.GetInt("notifications.max_attempts")
+	notificationRetryBackoff = viper.GetDuration("notifications.retry_backoff")
+	notificationMaxBackoff = viper.GetDuration("notifications.max_backoff")
+	notificationDeadLetterLog = viper.GetString("notifications.dead_letter_log")
+	notificationSpoolDir = viper.GetString("notifications.spool_dir")
+	loadMessageTemplates()
+	loadNotificationChannels()
 	mockEnabled = viper.GetBool("mock.enabled")
 	experimentalEnabled = viper.GetBool("experimental.enabled")
 	asgEnabled = viper.GetBool("aws.enable_asg_support")
+	exposedTagKeys = viper.GetStringSlice("aws.exposed_tag_keys")
+	leaseMaxTTL = viper.GetDuration("leases.max_ttl")
+	leaseCheckInterval = viper.GetDuration("leases.check_interval")
+	leaseReminders = parseLeaseReminders(viper.GetStringSlice("leases.reminders"))
+	reservationDefaultDuration = viper.GetDuration("reservations.default_duration")
+	reservationMaxDuration = viper.GetDuration("reservations.max_duration")
+	loadConfigFreezeWindows()
+	approvalEnvironments = viper.GetStringSlice("approvals.environments")
+	approvalTagKey = viper.GetString("approvals.tag_key")
+	approvalApprovers = viper.GetStringSlice("approvals.approvers")
+	approvalTimeout = viper.GetDuration("approvals.timeout")
+	pricingSource = viper.GetString("pricing.source")
+	pricingRefreshInterval = viper.GetDuration("pricing.refresh_interval")
+	loadPricingDiscounts()
+	historyRetention = viper.GetDuration("reports.history_retention")
+	historyFile = viper.GetString("reports.history_file")
+	loadHistory()
+	loadReportSchedules()
+	budgetDefaultMonthly = viper.GetFloat64("budgets.default_monthly")
+	budgetTagKey = viper.GetString("budgets.tag_key")
+	budgetThresholds = parseBudgetThresholds(viper.GetStringSlice("budgets.thresholds"))
+	budgetEnforcement = parseBudgetEnforcement(viper.GetString("budgets.enforcement"))
+	budgetCheckInterval = viper.GetDuration("budgets.check_interval")
+	loadEnvBudgetOverrides()
+	ownerTagKey = viper.GetString("metadata.owner_tag_key")
+	teamTagKey = viper.GetString("metadata.team_tag_key")
+	descriptionTagKey = viper.GetString("metadata.description_tag_key")
+	linkTagKey = viper.GetString("metadata.link_tag_key")
+	loadEnvMetadataConfig()
+	groupTagKey = viper.GetString("groups.tag_key")
+	groupOrderTimeout = viper.GetDuration("groups.order_timeout")
+	loadEnvGroups()
+	wakeProxyEnabled = viper.GetBool("wake_proxy.enabled")
+	wakeProxyHoldTimeout = viper.GetDuration("wake_proxy.hold_timeout")
+	wakeProxyStartTimeout = viper.GetDuration("wake_proxy.start_timeout")
+	wakeProxyCheckInterval = viper.GetDuration("wake_proxy.check_interval")
+	loadWakeRoutes()
 
 	return
 }
@@ -46,6 +104,39 @@ func initViper(cfgFile string) {
 	viper.SetDefault("server.bind_address", "127.0.0.1")
 	viper.SetDefault("server.bind_port", "8080")
 	viper.SetDefault("server.access_log", true)
+	viper.SetDefault("server.actor_header", "X-Forwarded-User")
+	viper.SetDefault("server.allow_actor_param", false)
+	viper.SetDefault("aws.keep_running_tag_key", "power-toggle-keep-running")
+	viper.SetDefault("aws.keep_running_tag_value", "true")
+	viper.SetDefault("aws.role_tag_key", "Role")
+	viper.SetDefault("leases.check_interval", "1m")
+	viper.SetDefault("limits.confirmation_window", "2m")
+	viper.SetDefault("limits.tag_prefix", "power-toggle-limit-")
+	viper.SetDefault("reservations.default_duration", "8h")
+	viper.SetDefault("approvals.tag_key", "power-toggle-require-approval")
+	viper.SetDefault("approvals.timeout", "1h")
+	viper.SetDefault("slack.keep_running_duration", "2h")
+	viper.SetDefault("notifications.workers", 2)
+	viper.SetDefault("notifications.queue_size", 1000)
+	viper.SetDefault("notifications.max_attempts", 5)
+	viper.SetDefault("notifications.retry_backoff", "2s")
+	viper.SetDefault("notifications.max_backoff", "5m")
+	viper.SetDefault("reports.history_retention", "2160h")
+	viper.SetDefault("budgets.tag_key", "power-toggle-monthly-budget")
+	viper.SetDefault("budgets.thresholds", []string{"50", "80", "100"})
+	viper.SetDefault("budgets.enforcement", BudgetEnforcementNone)
+	viper.SetDefault("budgets.check_interval", "5m")
+	viper.SetDefault("metadata.owner_tag_key", "Owner")
+	viper.SetDefault("metadata.team_tag_key", "Team")
+	viper.SetDefault("metadata.description_tag_key", "Description")
+	viper.SetDefault("metadata.link_tag_key", "power-toggle-link")
+	viper.SetDefault("groups.tag_key", "power-toggle-group")
+	viper.SetDefault("groups.order_timeout", "10m")
+	viper.SetDefault("wake_proxy.bind_address", "127.0.0.1")
+	viper.SetDefault("wake_proxy.bind_port", "8081")
+	viper.SetDefault("wake_proxy.hold_timeout", "30s")
+	viper.SetDefault("wake_proxy.start_timeout", "10m")
+	viper.SetDefault("wake_proxy.check_interval", "2s")
 
 	// Configuring and pulling overrides from environmental variables
 	viper.SetEnvPrefix("POWER_TOGGLE")
@@ -90,9 +181,56 @@ func printConfigSummary() {
 		"aws.required_tag_key",
 		"aws.required_tag_value",
 		"aws.environment_tag_key",
+		"aws.environment_key_template",
+		"aws.environment_name_regex",
+		"aws.role_tag_key",
+		"aws.keep_running_tag_key",
+		"aws.keep_running_tag_value",
 		"aws.max_instances_to_shutdown",
+		"aws.max_instances_to_startup",
+		"aws.max_hourly_cost_to_startup",
 		"aws.enable_asg_support",
+		"limits.confirmation_window",
+		"limits.tag_prefix",
+		"server.actor_header",
+		"server.allow_actor_param",
+		"leases.max_ttl",
+		"leases.check_interval",
+		"reservations.default_duration",
+		"reservations.max_duration",
+		"approvals.environments",
+		"approvals.tag_key",
+		"approvals.approvers",
+		"approvals.timeout",
 		"slack.enabled",
+		"slack.keep_running_duration",
+		"notifications.workers",
+		"notifications.queue_size",
+		"notifications.max_attempts",
+		"notifications.retry_backoff",
+		"notifications.max_backoff",
+		"notifications.dead_letter_log",
+		"notifications.spool_dir",
+		"pricing.source",
+		"pricing.refresh_interval",
+		"reports.history_retention",
+		"reports.history_file",
+		"budgets.default_monthly",
+		"budgets.tag_key",
+		"budgets.enforcement",
+		"budgets.check_interval",
+		"metadata.owner_tag_key",
+		"metadata.team_tag_key",
+		"metadata.description_tag_key",
+		"metadata.link_tag_key",
+		"groups.tag_key",
+		"groups.order_timeout",
+		"wake_proxy.enabled",
+		"wake_proxy.bind_address",
+		"wake_proxy.bind_port",
+		"wake_proxy.hold_timeout",
+		"wake_proxy.start_timeout",
+		"wake_proxy.check_interval",
 		"mock.enabled",
 		"mock.delay",
 		"mock.errors",
@@ -105,6 +243,9 @@ func printConfigSummary() {
 		"aws.regions",
 		"aws.ignore_instance_types",
 		"aws.ignore_environments",
+		"aws.exposed_tag_keys",
+		"leases.reminders",
+		"budgets.thresholds",
 	} {
 		log.Debugf("%s: %v\n", c, viper.GetStringSlice(c))
 	}
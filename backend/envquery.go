@@ -0,0 +1,224 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prefix of the query parameters which filter environments by a tag of their instances (ie. tag.owner=alice)
+const envQueryTagPrefix = "tag."
+
+var (
+	// sortable fields of an environment (by json name), built once at startup
+	envSortFields = getEnvSortFields()
+)
+
+// envQuery filters, sorts and pages a list of environments.
+// empty values match everything
+type envQuery struct {
+	States  []string
+	Regions []string
+	// glob patterns of environment names
+	Names []string
+	// glob patterns of owners and teams
+	Owners []string
+	Teams  []string
+	// glob patterns of tag values (by tag key), matched by any instance of the environment.
+	// only tags allowed by aws.exposed_tag_keys can be filtered on
+	Tags      map[string]string
+	SortField string
+	SortDesc  bool
+	// fields to keep in the response
+	Fields []string
+	Limit  int
+	Offset int
+}
+
+// splitQueryValues returns the comma separated values of all occurrences of a query parameter
+func splitQueryValues(values []string) (split []string) {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				split = append(split, v)
+			}
+		}
+	}
+	return
+}
+
+// getEnvSortFields returns the index of the sortable (scalar) fields of an environment by their json name
+func getEnvSortFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(environment{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		switch t.Field(i).Type.Kind() {
+		case reflect.String, reflect.Int, reflect.Int64, reflect.Float32, reflect.Float64, reflect.Bool:
+			if name != "" && name != "-" {
+				fields[name] = i
+			}
+		}
+	}
+	return fields
+}
+
+// parseEnvQuery reads the filters, sorting and paging of an environment list from the request
+func parseEnvQuery(req *http.Request) (query envQuery, err error) {
+	params := req.URL.Query()
+	query.States = splitQueryValues(params["state"])
+	query.Regions = splitQueryValues(params["region"])
+	// name~=qa-* is the same as name=qa-*
+	query.Names = splitQueryValues(append(params["name"], params["name~"]...))
+	query.Owners = splitQueryValues(params["owner"])
+	query.Teams = splitQueryValues(params["team"])
+	query.Fields = splitQueryValues(params["fields"])
+
+	query.Tags = map[string]string{}
+	for key, values := range params {
+		if strings.HasPrefix(key, envQueryTagPrefix) && len(key) > len(envQueryTagPrefix) {
+			query.Tags[strings.TrimPrefix(key, envQueryTagPrefix)] = values[0]
+		}
+	}
+
+	if sortBy := params.Get("sort"); sortBy != "" {
+		parts := strings.SplitN(sortBy, ":", 2)
+		query.SortField = parts[0]
+		if _, found := envSortFields[query.SortField]; !found {
+			return query, fmt.Errorf("invalid sort field: %s", query.SortField)
+		}
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "asc":
+			case "desc":
+				query.SortDesc = true
+			default:
+				return query, fmt.Errorf("invalid sort direction (expected asc or desc): %s", parts[1])
+			}
+		}
+	}
+
+	for name, value := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		if v := params.Get(name); v != "" {
+			if *value, err = strconv.Atoi(v); err != nil || *value < 0 {
+				return query, fmt.Errorf("invalid %s: %s", name, v)
+			}
+		}
+	}
+	return
+}
+
+// matches returns true if the environment passes all filters of the query
+func (q envQuery) matches(env environment) bool {
+	if len(q.States) > 0 && !stringInSlice(env.State, q.States) {
+		return false
+	}
+	if len(q.Regions) > 0 && !stringInSlice(env.Region, q.Regions) {
+		return false
+	}
+	if len(q.Names) > 0 && !matchesAnyPattern(env.Name, q.Names) {
+		return false
+	}
+	if len(q.Owners) > 0 && !matchesAnyPattern(env.Owner, q.Owners) {
+		return false
+	}
+	if len(q.Teams) > 0 && !matchesAnyPattern(env.Team, q.Teams) {
+		return false
+	}
+	for key, pattern := range q.Tags {
+		found := false
+		for _, instance := range env.Instances {
+			if value, ok := instance.ExposedTags[key]; ok && (pattern == "" || matchesAnyPattern(value, []string{pattern})) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// lessEnvField compares the values of a sortable field. numeric strings (ie. bills) are compared as numbers
+func lessEnvField(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.String:
+		fa, errA := strconv.ParseFloat(a.String(), 64)
+		fb, errB := strconv.ParseFloat(b.String(), 64)
+		if errA == nil && errB == nil {
+			return fa < fb
+		}
+		return a.String() < b.String()
+	case reflect.Int, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	}
+	return false
+}
+
+// apply returns the environments which match the query, sorted and paged.
+// total is the amount of matching environments before paging
+func (q envQuery) apply(envs []environment) (result []environment, total int) {
+	result = []environment{}
+	for _, env := range envs {
+		if q.matches(env) {
+			result = append(result, env)
+		}
+	}
+
+	if q.SortField != "" {
+		index := envSortFields[q.SortField]
+		sort.SliceStable(result, func(i, j int) bool {
+			a := reflect.ValueOf(result[i]).Field(index)
+			b := reflect.ValueOf(result[j]).Field(index)
+			if q.SortDesc {
+				return lessEnvField(b, a)
+			}
+			return lessEnvField(a, b)
+		})
+	}
+
+	total = len(result)
+	if q.Offset >= len(result) {
+		return []environment{}, total
+	}
+	result = result[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(result) {
+		result = result[:q.Limit]
+	}
+	return
+}
+
+// projectFields keeps only the given fields of a marshaled environment.
+// when the environments are listed under listKey (ie. envList), each of them is projected
+func projectFields(marshaled interface{}, fields []string, listKey string) interface{} {
+	if len(fields) == 0 {
+		return marshaled
+	}
+	m, ok := marshaled.(map[string]interface{})
+	if !ok {
+		return marshaled
+	}
+	if listKey != "" {
+		if list, ok := m[listKey].([]interface{}); ok {
+			for i := range list {
+				list[i] = projectFields(list[i], fields, "")
+			}
+		}
+		return m
+	}
+	projected := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, found := m[field]; found {
+			projected[field] = value
+		}
+	}
+	return projected
+}
@@ -0,0 +1,115 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseEnvQuery(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"": true,
+		"?state=running,mixed&region=ca-central-1": true,
+		"?name~=qa-*&tag.owner=alice":              true,
+		"?sort=total_vcpu:desc&limit=10&offset=5":  true,
+		"?sort=instances":                          false,
+		"?sort=name:up":                            false,
+		"?limit=-1":                                false,
+		"?offset=wrong":                            false,
+	} {
+		req, _ := http.NewRequest("GET", "/"+query, nil)
+		if _, err := parseEnvQuery(req); (err == nil) != valid {
+			t.Errorf("%s: expected valid=%v, got error: %v", query, valid, err)
+		}
+	}
+}
+
+func TestEnvQueryApply(t *testing.T) {
+	envs := []environment{
+		{Name: "qa-1", Region: "ca-central-1", State: EnvStateRunning, TotalVCPU: 4, BillsAccrued: "9.00", Team: "qa",
+			Instances: []virtualMachine{{ExposedTags: map[string]string{"owner": "alice"}}}},
+		{Name: "qa-2", Region: "us-east-1", State: EnvStateStopped, TotalVCPU: 8, BillsAccrued: "10.00", Team: "qa"},
+		{Name: "prod", Region: "ca-central-1", State: EnvStateRunning, TotalVCPU: 2, BillsAccrued: "1.00", Team: "ops", Owner: "bob@example.com",
+			Instances: []virtualMachine{{ExposedTags: map[string]string{"owner": "bob"}}}},
+	}
+	names := func(envs []environment) (names []string) {
+		for _, env := range envs {
+			names = append(names, env.Name)
+		}
+		return
+	}
+
+	for query, expected := range map[string][]string{
+		"":                            {"qa-1", "qa-2", "prod"},
+		"?state=running":              {"qa-1", "prod"},
+		"?region=us-east-1":           {"qa-2"},
+		"?name~=qa-*":                 {"qa-1", "qa-2"},
+		"?tag.owner=b*":               {"prod"},
+		"?tag.owner=":                 {"qa-1", "prod"},
+		"?team=qa":                    {"qa-1", "qa-2"},
+		"?owner=bob@*":                {"prod"},
+		"?sort=total_vcpu:desc":       {"qa-2", "qa-1", "prod"},
+		"?sort=name":                  {"prod", "qa-1", "qa-2"},
+		"?sort=bills_accrued:desc":    {"qa-2", "qa-1", "prod"},
+		"?sort=name&limit=1&offset=1": {"qa-1"},
+		"?offset=5":                   nil,
+	} {
+		req, _ := http.NewRequest("GET", "/"+query, nil)
+		q, err := parseEnvQuery(req)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		result, _ := q.apply(envs)
+		if got := names(result); len(got) != len(expected) || (len(got) > 0 && !equalStrings(got, expected)) {
+			t.Errorf("%s: expected %v, got %v", query, expected, got)
+		}
+	}
+}
+
+// equalStrings returns true if both lists contain the same strings in the same order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEnvAllFieldsAndETag(t *testing.T) {
+	unitTestRunning = true
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	router := newRouter()
+
+	req, _ := http.NewRequest("GET", getEndpoint("env/summary?fields=id,name&sort=name&limit=2"), nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var response struct {
+		EnvList []map[string]interface{} `json:"envList"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(response.EnvList) != 2 || len(response.EnvList[0]) != 2 || response.EnvList[0]["name"] == nil {
+		t.Errorf("expected 2 environments with 2 fields, got: %v", response.EnvList)
+	}
+	if rr.Header().Get("X-Total-Count") != strconv.Itoa(len(cachedTable)) {
+		t.Errorf("expected the total count before paging (%d), got: %s", len(cachedTable), rr.Header().Get("X-Total-Count"))
+	}
+
+	// an unchanged response is not sent again
+	etag := rr.Header().Get("ETag")
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("expected 304 for etag %s, got %d", etag, rr.Code)
+	}
+}
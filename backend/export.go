@@ -0,0 +1,328 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/liip/sheriff"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// defines the formats of environment responses
+
+	// ExportFormatJSON is the default format
+	ExportFormatJSON = "json"
+	// ExportFormatCSV has one row per instance
+	ExportFormatCSV = "csv"
+	// ExportFormatYAML has the same structure as json
+	ExportFormatYAML = "yaml"
+	// ExportFormatXLSX is a spreadsheet with one row per instance
+	ExportFormatXLSX = "xlsx"
+)
+
+var (
+	// content type of each format
+	exportContentTypes = map[string]string{
+		ExportFormatJSON: "application/json",
+		ExportFormatCSV:  "text/csv",
+		ExportFormatYAML: "application/x-yaml",
+		ExportFormatXLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	}
+	// formats by the media types accepted in the Accept header
+	exportAcceptTypes = map[string]string{
+		"application/json":   ExportFormatJSON,
+		"text/csv":           ExportFormatCSV,
+		"application/x-yaml": ExportFormatYAML,
+		"application/yaml":   ExportFormatYAML,
+		"text/yaml":          ExportFormatYAML,
+		exportContentTypes[ExportFormatXLSX]: ExportFormatXLSX,
+	}
+	// these columns come first in the instance rows, other columns are sorted by name
+	inventoryLeadingColumns = []string{"env_id", "env_name", "name", "instance_type", "region", "state", "vcpu", "memory_gb", "pricing"}
+)
+
+// exportOptions describes how an environment response is rendered
+type exportOptions struct {
+	group string
+	// fields of the environments (or columns of csv and xlsx) to keep, all when empty
+	fields []string
+	// json key of the environment list (empty when the response is a single environment)
+	listKey string
+	// name of csv and xlsx downloads (without extension)
+	filename string
+}
+
+// getExportFormat determines the response format from the format parameter or the Accept header.
+// json is used when neither of them asks for a supported format
+func getExportFormat(req *http.Request) (format string, err error) {
+	if format = req.URL.Query().Get("format"); format != "" {
+		if _, found := exportContentTypes[format]; !found {
+			err = fmt.Errorf("invalid format: %s", format)
+		}
+		return
+	}
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, parseErr := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if parseErr != nil {
+			continue
+		}
+		if format, found := exportAcceptTypes[mediaType]; found {
+			return format, nil
+		}
+	}
+	return ExportFormatJSON, nil
+}
+
+// getInventoryRows returns one row per instance of the environments.
+// the columns are the instance fields of the given sheriff group(s), prefixed with the environment.
+// when fields are given, only those columns are kept
+func getInventoryRows(envs []environment, fields []string, groups ...string) (header []string, rows [][]interface{}, err error) {
+	var records []map[string]interface{}
+	columns := map[string]bool{}
+	for _, env := range envs {
+		for _, instance := range env.Instances {
+			marshaled, marshalErr := sheriff.Marshal(&sheriff.Options{Groups: groups}, instance)
+			if marshalErr != nil {
+				return nil, nil, marshalErr
+			}
+			record, ok := marshaled.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("unexpected instance representation: %T", marshaled)
+			}
+			record["env_id"] = env.ID
+			record["env_name"] = env.Name
+			for column := range record {
+				if len(fields) == 0 || stringInSlice(column, fields) {
+					columns[column] = true
+				}
+			}
+			records = append(records, record)
+		}
+	}
+
+	for _, column := range inventoryLeadingColumns {
+		if columns[column] {
+			header = append(header, column)
+			delete(columns, column)
+		}
+	}
+	var others []string
+	for column := range columns {
+		others = append(others, column)
+	}
+	sort.Strings(others)
+	header = append(header, others...)
+
+	for _, record := range records {
+		row := make([]interface{}, len(header))
+		for i, column := range header {
+			row[i] = record[column]
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+// formatInventoryCell renders a value of an instance row as text.
+// nested values (ie. volumes) are rendered as json
+func formatInventoryCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case bool, int, int64:
+		return fmt.Sprintf("%v", v)
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// inventoryCSV renders the instances of the environments as csv
+func inventoryCSV(envs []environment, fields []string, groups ...string) ([]byte, error) {
+	header, rows, err := getInventoryRows(envs, fields, groups...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(header)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = formatInventoryCell(value)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// xlsxCellRef returns the reference of a cell (ie. B3) from its zero based column and one based row
+func xlsxCellRef(column, row int) string {
+	name := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		name = string(rune('A'+(column-1)%26)) + name
+	}
+	return fmt.Sprintf("%s%d", name, row)
+}
+
+// xlsxCell renders a single cell of a worksheet. numbers are kept as numbers, everything else is an inline string
+func xlsxCell(column, row int, value interface{}) string {
+	ref := xlsxCellRef(column, row)
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64, float32, int, int64:
+		return fmt.Sprintf(`<c r="%s"><v>%s</v></c>`, ref, formatInventoryCell(v))
+	}
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(formatInventoryCell(value)))
+	return fmt.Sprintf(`<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, escaped.String())
+}
+
+// the static parts of a workbook with a single worksheet
+var xlsxStaticFiles = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="instances" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// inventoryXLSX renders the instances of the environments as a spreadsheet
+func inventoryXLSX(envs []environment, fields []string, groups ...string) ([]byte, error) {
+	header, rows, err := getInventoryRows(envs, fields, groups...)
+	if err != nil {
+		return nil, err
+	}
+
+	var sheet strings.Builder
+	sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for i, row := range append([][]interface{}{stringsToRow(header)}, rows...) {
+		fmt.Fprintf(&sheet, `<row r="%d">`, i+1)
+		for j, value := range row {
+			sheet.WriteString(xlsxCell(j, i+1, value))
+		}
+		sheet.WriteString(`</row>`)
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	files := append(xlsxStaticFiles, struct {
+		name    string
+		content string
+	}{"xl/worksheets/sheet1.xml", sheet.String()})
+	for _, file := range files {
+		f, err := z.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = f.Write([]byte(file.content)); err != nil {
+			return nil, err
+		}
+	}
+	err = z.Close()
+	return buf.Bytes(), err
+}
+
+// stringsToRow converts a list of strings to a row of cells
+func stringsToRow(values []string) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	return row
+}
+
+// getExportResponse renders an environment response in the requested format.
+// data is the json (and yaml) response, envs are used for formats with one row per instance
+func getExportResponse(format string, data interface{}, envs []environment, options exportOptions) ([]byte, error) {
+	switch format {
+	case ExportFormatCSV:
+		return inventoryCSV(envs, options.fields, options.group)
+	case ExportFormatXLSX:
+		return inventoryXLSX(envs, options.fields, options.group)
+	}
+	if len(options.fields) == 0 && format == ExportFormatJSON {
+		return getMarshaledResponse(data, options.group)
+	}
+	marshaled, err := sheriff.Marshal(&sheriff.Options{Groups: []string{options.group}}, data)
+	if err != nil {
+		return nil, err
+	}
+	marshaled = projectFields(marshaled, options.fields, options.listKey)
+	if format == ExportFormatYAML {
+		return yaml.Marshal(marshaled)
+	}
+	return json.Marshal(marshaled)
+}
+
+// getETag returns the entity tag of a response
+func getETag(response []byte) string {
+	sum := sha256.Sum256(response)
+	return fmt.Sprintf("\"%x\"", sum[:16])
+}
+
+// etagMatches returns true if the If-None-Match header of the request contains the entity tag
+func etagMatches(req *http.Request, etag string) bool {
+	for _, candidate := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeExportResponse writes an environment response in the requested format.
+// unchanged responses (see If-None-Match) are answered with 304 Not Modified
+func writeExportResponse(w http.ResponseWriter, req *http.Request, format string, data interface{}, envs []environment, options exportOptions) {
+	response, err := getExportResponse(format, data, envs, options)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+		return
+	}
+	etag := getETag(response)
+	w.Header().Set("ETag", etag)
+	if etagMatches(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	if format == ExportFormatCSV || format == ExportFormatXLSX {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", options.filename, format))
+	}
+	w.Write(response)
+}
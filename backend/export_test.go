@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestGetExportFormat(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		accept   string
+		expected string
+	}{
+		{"", "", ExportFormatJSON},
+		{"?format=csv", "application/json", ExportFormatCSV},
+		{"?format=pdf", "", ""},
+		{"", "text/html, text/csv;q=0.9", ExportFormatCSV},
+		{"", "application/yaml", ExportFormatYAML},
+		{"", exportContentTypes[ExportFormatXLSX], ExportFormatXLSX},
+		{"", "text/html, */*", ExportFormatJSON},
+	} {
+		req, _ := http.NewRequest("GET", "/"+tc.query, nil)
+		req.Header.Set("Accept", tc.accept)
+		format, err := getExportFormat(req)
+		if tc.expected == "" && err == nil {
+			t.Errorf("%s: expected an error", tc.query)
+		}
+		if tc.expected != "" && (err != nil || format != tc.expected) {
+			t.Errorf("%s (%s): got %s (err: %v) but expected %s", tc.query, tc.accept, format, err, tc.expected)
+		}
+	}
+}
+
+func TestInventoryCSV(t *testing.T) {
+	envs := []environment{{
+		ID:   "env1",
+		Name: "test",
+		Instances: []virtualMachine{
+			{Name: "web", InstanceType: "t3.micro", State: "running", VCPU: 2, MemoryGB: 1, PricingHourly: 0.0104, Protected: true},
+			{Name: "db, primary", InstanceType: "m5.large", State: "stopped", Volumes: []ebsVolume{{VolumeID: "vol-1", VolumeType: "gp2", SizeGB: 8}}},
+		},
+	}}
+
+	// the group chooses the columns
+	for group, expectedColumn := range map[string]string{"summary": "", "details": "protected"} {
+		data, err := inventoryCSV(envs, nil, group)
+		if err != nil {
+			t.Fatalf("inventoryCSV returned an error: %v", err)
+		}
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil || len(records) != 3 {
+			t.Fatalf("%s: expected a header and 2 rows, got: %v (err: %v)", group, records, err)
+		}
+		header := strings.Join(records[0], ",")
+		if !strings.HasPrefix(header, "env_id,env_name,name,instance_type,region,state,vcpu,memory_gb,pricing,") {
+			t.Errorf("%s: unexpected header: %s", group, header)
+		}
+		if expectedColumn != "" && !strings.Contains(header, expectedColumn) {
+			t.Errorf("%s: expected column %s in header: %s", group, expectedColumn, header)
+		}
+		if group == "summary" && strings.Contains(header, "protected") {
+			t.Errorf("summary should not contain detail columns: %s", header)
+		}
+		if records[1][0] != "env1" || records[1][2] != "web" || records[1][8] != "0.0104" || records[2][2] != "db, primary" {
+			t.Errorf("%s: unexpected rows: %v", group, records[1:])
+		}
+	}
+}
+
+func TestInventoryXLSX(t *testing.T) {
+	envs := []environment{{ID: "env1", Name: "a&b", Instances: []virtualMachine{{Name: "web", VCPU: 2}}}}
+	data, err := inventoryXLSX(envs, nil, "summary")
+	if err != nil {
+		t.Fatalf("inventoryXLSX returned an error: %v", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("xlsx is not a valid zip file: %v", err)
+	}
+	var sheet string
+	for _, f := range z.File {
+		if f.Name != "xl/worksheets/sheet1.xml" {
+			continue
+		}
+		r, _ := f.Open()
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		sheet = string(content)
+	}
+	for _, expected := range []string{
+		`<c r="A1" t="inlineStr"><is><t>env_id</t></is></c>`,
+		`<c r="B2" t="inlineStr"><is><t>a&amp;b</t></is></c>`,
+		`<c r="G2"><v>2</v></c>`,
+	} {
+		if !strings.Contains(sheet, expected) {
+			t.Errorf("expected %s in worksheet: %s", expected, sheet)
+		}
+	}
+	if ref := xlsxCellRef(27, 3); ref != "AB3" {
+		t.Errorf("expected AB3, got %s", ref)
+	}
+}
+
+func TestExportYAML(t *testing.T) {
+	env := environment{ID: "env1", Name: "test", Instances: []virtualMachine{{Name: "web"}}}
+	data, err := getExportResponse(ExportFormatYAML, env, []environment{env}, exportOptions{group: "summary"})
+	if err != nil {
+		t.Fatalf("getExportResponse returned an error: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err = yaml.Unmarshal(data, &decoded); err != nil || decoded["id"] != "env1" {
+		t.Errorf("unexpected yaml: %s (err: %v)", data, err)
+	}
+	if _, found := decoded["instances"]; found {
+		t.Error("summary should not contain instances")
+	}
+}
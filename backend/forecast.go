@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	// hours covered by the forecast periods (a month is 30 days, like the monthly report)
+	forecastDayHours   = 24
+	forecastWeekHours  = 7 * 24
+	forecastMonthHours = 30 * 24
+	// upper limit of the hours parameter
+	forecastMaxHours = 366 * 24
+)
+
+// costProjection is the expected cost of an environment over the next periods
+type costProjection struct {
+	// cost per hour until the environment is stopped
+	HourlyCost float64 `json:"hourly_cost"`
+	NextDay    float64 `json:"next_day"`
+	NextWeek   float64 `json:"next_week"`
+	NextMonth  float64 `json:"next_month"`
+	// only set when a number of hours was requested
+	NextHours *float64 `json:"next_hours,omitempty"`
+}
+
+// envForecast is the expected cost of an environment in its current state, and after it has been started
+type envForecast struct {
+	EnvID   string `json:"env_id"`
+	EnvName string `json:"env_name"`
+	State   string `json:"state"`
+	Hours   int    `json:"hours,omitempty"`
+	// cost per hour once the environment is stopped (volumes, elastic IPs and protected instances)
+	StoppedHourlyCost float64 `json:"stopped_hourly_cost"`
+	// time at which the environment will be stopped by its lease (if any)
+	StopsAt *time.Time     `json:"stops_at,omitempty"`
+	Current costProjection `json:"current"`
+	// ASGs are started with the desired capacity they last had while running (1 if it is unknown)
+	Started costProjection `json:"if_started"`
+	// time at which the started environment would be stopped by the requested (or current) lease
+	StartedStopsAt *time.Time `json:"if_started_stops_at,omitempty"`
+	// amount of instances and ASGs without pricing
+	UnpricedInstances int `json:"unpriced_instances"`
+}
+
+// parseForecastHours validates the hours parameter (0 when it is not set)
+func parseForecastHours(hours string) (parsed int, err error) {
+	if hours == "" {
+		return
+	}
+	parsed, err = strconv.Atoi(hours)
+	if err != nil || parsed <= 0 || parsed > forecastMaxHours {
+		err = fmt.Errorf("invalid hours (expected 1-%d): %s", forecastMaxHours, hours)
+	}
+	return
+}
+
+// getASGHourlyCost returns the cost of an ASG: its desired capacity times the price of its instance type.
+// a stopped ASG is started with the capacity it last had while running (see getASGStartCapacity)
+func getASGHourlyCost(instance virtualMachine, started bool) float64 {
+	capacity := instance.DesiredCapacity
+	if instance.State != "running" {
+		capacity = 0
+	}
+	if started && capacity == 0 {
+		capacity = getASGStartCapacity(instance)
+	}
+	return float64(capacity) * instance.asgInstancePricingHourly
+}
+
+// getEnvHourlyCost returns what an environment currently costs per hour
+func getEnvHourlyCost(env environment) (hourly float64) {
+	for _, instance := range env.Instances {
+		if instance.IsASG {
+			hourly += getASGHourlyCost(instance, false)
+			continue
+		}
+		hourly += getHourlyCost(instance.State == "running", instance.PricingHourly, instance.StoragePricingHourly, instance.IdlePricingHourly)
+	}
+	return
+}
+
+// getEnvStartedHourlyCost returns what an environment would cost per hour once started
+func getEnvStartedHourlyCost(env environment) (hourly float64) {
+	for _, instance := range env.Instances {
+		if instance.IsASG {
+			hourly += getASGHourlyCost(instance, true)
+			continue
+		}
+		hourly += getHourlyCost(true, instance.PricingHourly, instance.StoragePricingHourly, instance.IdlePricingHourly)
+	}
+	return
+}
+
+// getEnvStoppedHourlyCost returns what an environment would cost per hour once stopped.
+// protected instances keep running
+func getEnvStoppedHourlyCost(env environment) (hourly float64) {
+	for _, instance := range env.Instances {
+		running := instance.Protected && instance.State == "running"
+		if instance.IsASG {
+			if running {
+				hourly += getASGHourlyCost(instance, false)
+			}
+			continue
+		}
+		hourly += getHourlyCost(running, instance.PricingHourly, instance.StoragePricingHourly, instance.IdlePricingHourly)
+	}
+	return
+}
+
+// projectCost returns the cost of the next hours. hourly applies until stopAt (if set), stoppedHourly afterwards
+func projectCost(hourly, stoppedHourly float64, stopAt, now time.Time, hours float64) float64 {
+	before := hours
+	if !stopAt.IsZero() {
+		before = math.Max(0, math.Min(hours, stopAt.Sub(now).Hours()))
+	}
+	return hourly*before + stoppedHourly*(hours-before)
+}
+
+// newCostProjection projects the cost over all forecast periods (and the requested hours, if any)
+func newCostProjection(hourly, stoppedHourly float64, stopAt, now time.Time, hours int) costProjection {
+	projection := costProjection{
+		HourlyCost: hourly,
+		NextDay:    projectCost(hourly, stoppedHourly, stopAt, now, forecastDayHours),
+		NextWeek:   projectCost(hourly, stoppedHourly, stopAt, now, forecastWeekHours),
+		NextMonth:  projectCost(hourly, stoppedHourly, stopAt, now, forecastMonthHours),
+	}
+	if hours > 0 {
+		cost := projectCost(hourly, stoppedHourly, stopAt, now, float64(hours))
+		projection.NextHours = &cost
+	}
+	return projection
+}
+
+// getEnvForecast returns the expected cost of an environment.
+// the current lease stops a running environment, startedStopAt is the lease expiry in case it gets started
+func getEnvForecast(env environment, now, startedStopAt time.Time, hours int) (forecast envForecast) {
+	forecast = envForecast{
+		EnvID:             env.ID,
+		EnvName:           env.Name,
+		State:             env.State,
+		Hours:             hours,
+		StoppedHourlyCost: getEnvStoppedHourlyCost(env),
+	}
+	var stopAt time.Time
+	if env.LeaseExpiresAt != nil && env.State != EnvStateStopped {
+		stopAt = *env.LeaseExpiresAt
+		forecast.StopsAt = env.LeaseExpiresAt
+	}
+	if startedStopAt.IsZero() {
+		startedStopAt = stopAt
+	}
+	if !startedStopAt.IsZero() {
+		forecast.StartedStopsAt = &startedStopAt
+	}
+	forecast.Current = newCostProjection(getEnvHourlyCost(env), forecast.StoppedHourlyCost, stopAt, now, hours)
+	forecast.Started = newCostProjection(getEnvStartedHourlyCost(env), forecast.StoppedHourlyCost, startedStopAt, now, hours)
+
+	for _, instance := range env.Instances {
+		if (instance.IsASG && instance.asgInstancePricingHourly == 0) || (!instance.IsASG && instance.PricingHourly == 0) {
+			forecast.UnpricedInstances++
+		}
+	}
+	return
+}
+
+// getEnvMonthEndForecast returns the expected cost of an environment for the current month (UTC):
+// the month-to-date cost plus the projected cost in its current state until the end of the month
+func getEnvMonthEndForecast(env environment, now time.Time) (spent, forecast float64) {
+	now = now.UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, 0)
+
+	var stopAt time.Time
+	if env.LeaseExpiresAt != nil && env.State != EnvStateStopped {
+		stopAt = *env.LeaseExpiresAt
+	}
+	spent = getEnvCostSince(env.ID, monthStart)
+	forecast = spent + projectCost(getEnvHourlyCost(env), getEnvStoppedHourlyCost(env), stopAt, now, monthEnd.Sub(now).Hours())
+	return
+}
+
+// getTotalMonthEndForecast returns the expected cost of all environments for the current month
+func getTotalMonthEndForecast(now time.Time) (total float64) {
+	for _, env := range cachedTable {
+		_, forecast := getEnvMonthEndForecast(env, now)
+		total += forecast
+	}
+	return
+}
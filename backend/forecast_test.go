@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+)
+
+func TestParseForecastHours(t *testing.T) {
+	for hours, expected := range map[string]int{
+		"":      0,
+		"12":    12,
+		"0":     -1,
+		"-1":    -1,
+		"wrong": -1,
+		"99999": -1,
+	} {
+		parsed, err := parseForecastHours(hours)
+		if expected < 0 && err == nil {
+			t.Errorf("%s: expected an error", hours)
+		}
+		if expected >= 0 && (err != nil || parsed != expected) {
+			t.Errorf("%s: got %v (err: %v) but expected %v", hours, parsed, err, expected)
+		}
+	}
+}
+
+func TestGetASGHourlyCost(t *testing.T) {
+	for name, tc := range map[string]struct {
+		instance virtualMachine
+		started  bool
+		expected float64
+	}{
+		"running":                    {virtualMachine{State: "running", DesiredCapacity: 3, asgInstancePricingHourly: 0.1}, false, 0.3},
+		"stopped":                    {virtualMachine{State: "stopped", toggledOffCapacity: 3, asgInstancePricingHourly: 0.1}, false, 0},
+		"started with last capacity": {virtualMachine{State: "stopped", toggledOffCapacity: 3, asgInstancePricingHourly: 0.1}, true, 0.3},
+		"started without capacity":   {virtualMachine{State: "stopped", asgInstancePricingHourly: 0.1}, true, 0.1},
+		"started while running":      {virtualMachine{State: "running", DesiredCapacity: 2, toggledOffCapacity: 3, asgInstancePricingHourly: 0.1}, true, 0.2},
+	} {
+		if cost := getASGHourlyCost(tc.instance, tc.started); math.Abs(cost-tc.expected) > 0.0001 {
+			t.Errorf("%s: expected %v, got %v", name, tc.expected, cost)
+		}
+	}
+}
+
+func TestGetASGInstanceType(t *testing.T) {
+	defer func() { asgInstanceTypes = map[string]string{} }()
+	asg := autoscaling.AutoScalingGroup{
+		AutoScalingGroupName: aws.String("asg1"),
+		MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+			LaunchTemplate: &autoscaling.LaunchTemplate{
+				Overrides: []autoscaling.LaunchTemplateOverrides{{InstanceType: aws.String("m5.large")}, {InstanceType: aws.String("c5.large")}},
+			},
+		},
+	}
+	if instanceType, err := getASGInstanceType(asg, "us-east-1"); err != nil || instanceType != "m5.large" {
+		t.Errorf("expected the first override, got %s (err: %v)", instanceType, err)
+	}
+	// the instance type is cached
+	asgInstanceTypes["us-east-1/asg2"] = "t3.micro"
+	if instanceType, err := getASGInstanceType(autoscaling.AutoScalingGroup{AutoScalingGroupName: aws.String("asg2")}, "us-east-1"); err != nil || instanceType != "t3.micro" {
+		t.Errorf("expected the cached instance type, got %s (err: %v)", instanceType, err)
+	}
+}
+
+func TestGetEnvForecast(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	env := environment{
+		ID:    "env1",
+		Name:  "test",
+		State: EnvStateMixed,
+		Instances: []virtualMachine{
+			{State: "running", PricingHourly: 1, StoragePricingHourly: 0.1},
+			{State: "stopped", PricingHourly: 2, StoragePricingHourly: 0.1, IdlePricingHourly: 0.05},
+			// protected instances keep running when the environment is stopped
+			{State: "running", PricingHourly: 0.5, Protected: true},
+			// stopped ASG with a known instance price, started with a desired capacity of 1 (it was not seen running)
+			{IsASG: true, State: "stopped", asgInstancePricingHourly: 0.25},
+			{IsASG: true, State: "running", DesiredCapacity: 2, asgInstancePricingHourly: 0.2},
+			// unknown instance type
+			{State: "stopped"},
+		},
+	}
+
+	forecast := getEnvForecast(env, now, now.Add(2*time.Hour), 10)
+	for name, tc := range map[string][2]float64{
+		"current hourly": {forecast.Current.HourlyCost, 1.1 + 0.15 + 0.5 + 0.4},
+		"started hourly": {forecast.Started.HourlyCost, 1.1 + 2.1 + 0.5 + 0.25 + 0.4},
+		"stopped hourly": {forecast.StoppedHourlyCost, 0.1 + 0.15 + 0.5},
+		"current day":    {forecast.Current.NextDay, 24 * 2.15},
+		// the started environment is stopped by the lease after 2 hours
+		"started hours": {*forecast.Started.NextHours, 2*4.35 + 8*0.75},
+		"started week":  {forecast.Started.NextWeek, 2*4.35 + 166*0.75},
+	} {
+		if math.Abs(tc[0]-tc[1]) > 0.0001 {
+			t.Errorf("%s: expected %v, got %v", name, tc[1], tc[0])
+		}
+	}
+	if forecast.UnpricedInstances != 1 || forecast.StopsAt != nil || forecast.StartedStopsAt == nil {
+		t.Errorf("unexpected forecast: %+v", forecast)
+	}
+
+	// a lease stops the running environment
+	expiresAt := now.Add(time.Hour)
+	env.LeaseExpiresAt = &expiresAt
+	forecast = getEnvForecast(env, now, time.Time{}, 0)
+	if math.Abs(forecast.Current.NextDay-(2.15+23*0.75)) > 0.0001 || forecast.Current.NextHours != nil {
+		t.Errorf("unexpected forecast with lease: %+v", forecast.Current)
+	}
+	if forecast.StartedStopsAt == nil || !forecast.StartedStopsAt.Equal(expiresAt) {
+		t.Errorf("expected the current lease to apply after a start, got: %v", forecast.StartedStopsAt)
+	}
+}
+
+func TestGetEnvMonthEndForecast(t *testing.T) {
+	defer func() { envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}} }()
+	now := time.Date(2020, 3, 31, 12, 0, 0, 0, time.UTC)
+	envHistory = envHistoryData{Usage: map[string]*envDailyUsage{
+		usageKey("2020-03-01", "env1"): {Date: "2020-03-01", EnvID: "env1", Cost: 10},
+		usageKey("2020-02-29", "env1"): {Date: "2020-02-29", EnvID: "env1", Cost: 100},
+		usageKey("2020-03-01", "env2"): {Date: "2020-03-01", EnvID: "env2", Cost: 100},
+	}}
+	env := environment{ID: "env1", Instances: []virtualMachine{{State: "running", PricingHourly: 1}}}
+	spent, forecast := getEnvMonthEndForecast(env, now)
+	if spent != 10 || math.Abs(forecast-22) > 0.0001 {
+		t.Errorf("expected 10 spent and a forecast of 22, got: %v %v", spent, forecast)
+	}
+}
@@ -0,0 +1,289 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defines where a freeze window was created
+
+	// FreezeSourceConfig is used for freeze windows defined in the config file
+	FreezeSourceConfig = "config"
+	// FreezeSourceAPI is used for freeze windows created at runtime through the API
+	FreezeSourceAPI = "api"
+)
+
+var (
+	// all known freeze windows (from config and runtime)
+	freezeWindows []freezeWindow
+	// lock to prevent concurrent access of the above list
+	freezeWindowsLock sync.RWMutex
+
+	// used to match recurring freeze days
+	weekdayNames = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+)
+
+// freezeWindow blocks power actions of matching environments while it is active.
+// A window can be an absolute date range, a recurring rule or both (recurring within the date range)
+type freezeWindow struct {
+	ID     string `json:"id" mapstructure:"id"`
+	Reason string `json:"reason" mapstructure:"reason"`
+	// environment name patterns (ie. perf-*), all environments when empty
+	Environments []string `json:"environments,omitempty" mapstructure:"environments"`
+	// blocked actions (start, stop), all actions when empty
+	Actions []string `json:"actions,omitempty" mapstructure:"actions"`
+	// absolute date range as RFC3339 timestamps, both are optional
+	Start string `json:"start,omitempty" mapstructure:"start"`
+	End   string `json:"end,omitempty" mapstructure:"end"`
+	// optional recurring rule
+	Recurring *freezeRecurrence `json:"recurring,omitempty" mapstructure:"recurring"`
+	// where this freeze window was created
+	Source string `json:"source" mapstructure:"-"`
+
+	// parsed values of the above, set by validate
+	start, end time.Time
+}
+
+// freezeRecurrence is a daily time range (ie. 18:00-06:00) on specific weekdays
+type freezeRecurrence struct {
+	// weekdays (mon, tue, ...) on which the range begins, every day when empty
+	Days      []string `json:"days,omitempty" mapstructure:"days"`
+	StartTime string   `json:"start_time" mapstructure:"start_time"`
+	EndTime   string   `json:"end_time" mapstructure:"end_time"`
+	// IANA timezone name, defaults to UTC
+	Timezone string `json:"timezone,omitempty" mapstructure:"timezone"`
+}
+
+// freezeWindowStatus is used for api responses
+type freezeWindowStatus struct {
+	freezeWindow
+	Active bool `json:"active"`
+}
+
+// validate checks the freeze window definition and parses its values
+func (f *freezeWindow) validate() (err error) {
+	if f.Reason == "" {
+		return fmt.Errorf("freeze reason is required")
+	}
+	if f.Start == "" && f.End == "" && f.Recurring == nil {
+		return fmt.Errorf("freeze requires a start, end or recurring rule")
+	}
+	for _, action := range f.Actions {
+		if action != "start" && action != "stop" {
+			return fmt.Errorf("invalid freeze action: %s", action)
+		}
+	}
+	for _, pattern := range f.Environments {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid environment pattern: %s", pattern)
+		}
+	}
+	if f.Start != "" {
+		if f.start, err = time.Parse(time.RFC3339, f.Start); err != nil {
+			return fmt.Errorf("invalid freeze start (expected RFC3339): %s", f.Start)
+		}
+	}
+	if f.End != "" {
+		if f.end, err = time.Parse(time.RFC3339, f.End); err != nil {
+			return fmt.Errorf("invalid freeze end (expected RFC3339): %s", f.End)
+		}
+	}
+	if !f.start.IsZero() && !f.end.IsZero() && !f.end.After(f.start) {
+		return fmt.Errorf("freeze end must be after its start")
+	}
+	if f.Recurring != nil {
+		err = f.Recurring.validate()
+	}
+	return
+}
+
+// validate checks the recurring rule definition
+func (r *freezeRecurrence) validate() (err error) {
+	for _, day := range r.Days {
+		if _, found := weekdayNames[strings.ToLower(day)]; !found {
+			return fmt.Errorf("invalid freeze day: %s", day)
+		}
+	}
+	for _, t := range []string{r.StartTime, r.EndTime} {
+		if _, err = time.Parse("15:04", t); err != nil {
+			return fmt.Errorf("invalid freeze time (expected HH:MM): %s", t)
+		}
+	}
+	if _, err = time.LoadLocation(r.Timezone); err != nil {
+		return fmt.Errorf("invalid freeze timezone: %s", r.Timezone)
+	}
+	return
+}
+
+// isActive returns true when the freeze window is in effect at the given time
+func (f freezeWindow) isActive(now time.Time) bool {
+	if !f.start.IsZero() && now.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && !now.Before(f.end) {
+		return false
+	}
+	if f.Recurring != nil {
+		return f.Recurring.isActive(now)
+	}
+	return true
+}
+
+// isActive returns true when the time falls within the recurring rule.
+// when the end time is before the start time, the range spans midnight
+func (r freezeRecurrence) isActive(now time.Time) bool {
+	location, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return false
+	}
+	now = now.In(location)
+	start, _ := time.Parse("15:04", r.StartTime)
+	end, _ := time.Parse("15:04", r.EndTime)
+	minuteOfDay := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+
+	if startMinute < endMinute {
+		return r.matchesDay(now.Weekday()) && minuteOfDay >= startMinute && minuteOfDay < endMinute
+	}
+	// range spans midnight: either it started today or yesterday
+	if minuteOfDay >= startMinute {
+		return r.matchesDay(now.Weekday())
+	}
+	return minuteOfDay < endMinute && r.matchesDay((now.Weekday()+6)%7)
+}
+
+// matchesDay returns true if the rule applies on the given weekday
+func (r freezeRecurrence) matchesDay(weekday time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+	for _, day := range r.Days {
+		if weekdayNames[strings.ToLower(day)] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// appliesTo returns true if the freeze window covers the environment and action
+func (f freezeWindow) appliesTo(envName, action string) bool {
+	if len(f.Actions) > 0 && !stringInSlice(action, f.Actions) {
+		return false
+	}
+	return len(f.Environments) == 0 || matchesAnyPattern(envName, f.Environments)
+}
+
+// loadConfigFreezeWindows replaces the freeze windows defined in the config file.
+// freeze windows created at runtime are kept
+func loadConfigFreezeWindows() {
+	var configured []freezeWindow
+	if err := viper.UnmarshalKey("freezes", &configured); err != nil {
+		log.Errorf("could not parse freezes from config: %v", err)
+	}
+
+	freezeWindowsLock.Lock()
+	defer freezeWindowsLock.Unlock()
+
+	windows := []freezeWindow{}
+	for _, f := range freezeWindows {
+		if f.Source != FreezeSourceConfig {
+			windows = append(windows, f)
+		}
+	}
+	for i, f := range configured {
+		if err := f.validate(); err != nil {
+			log.Errorf("ignoring invalid freeze #%d from config: %v", i+1, err)
+			continue
+		}
+		if f.ID == "" {
+			f.ID = ComputeID(FreezeSourceConfig, fmt.Sprintf("%d", i), f.Reason)
+		}
+		f.Source = FreezeSourceConfig
+		windows = append(windows, f)
+	}
+	freezeWindows = windows
+}
+
+// addFreezeWindow validates and adds a freeze window created at runtime
+func addFreezeWindow(f freezeWindow) (freezeWindow, error) {
+	if err := f.validate(); err != nil {
+		return f, err
+	}
+	f.ID = generateRandomID()
+	f.Source = FreezeSourceAPI
+
+	freezeWindowsLock.Lock()
+	freezeWindows = append(freezeWindows, f)
+	freezeWindowsLock.Unlock()
+	log.Infof("freeze %s added: %s", f.ID, f.Reason)
+	return f, nil
+}
+
+// deleteFreezeWindow removes a freeze window by id
+func deleteFreezeWindow(id string) (found bool) {
+	freezeWindowsLock.Lock()
+	defer freezeWindowsLock.Unlock()
+
+	for i, f := range freezeWindows {
+		if f.ID == id {
+			freezeWindows = append(freezeWindows[:i], freezeWindows[i+1:]...)
+			log.Infof("freeze %s deleted: %s", f.ID, f.Reason)
+			return true
+		}
+	}
+	return false
+}
+
+// getFreezeWindows returns all freeze windows and whether they are currently active
+func getFreezeWindows(now time.Time) (windows []freezeWindowStatus) {
+	freezeWindowsLock.RLock()
+	defer freezeWindowsLock.RUnlock()
+
+	windows = []freezeWindowStatus{}
+	for _, f := range freezeWindows {
+		windows = append(windows, freezeWindowStatus{f, f.isActive(now)})
+	}
+	return
+}
+
+// getActiveFreeze returns the first active freeze window covering the environment and action
+func getActiveFreeze(envName, action string, now time.Time) (window freezeWindow, found bool) {
+	freezeWindowsLock.RLock()
+	defer freezeWindowsLock.RUnlock()
+
+	for _, f := range freezeWindows {
+		if f.appliesTo(envName, action) && f.isActive(now) {
+			return f, true
+		}
+	}
+	return
+}
+
+// checkFreeze is an actionGuard which refuses any power action during an active freeze.
+// A freeze can not be bypassed with force
+func checkFreeze(action powerAction) error {
+	env, found := getEnvironmentByID(action.EnvID)
+	if !found {
+		return nil
+	}
+	if f, active := getActiveFreeze(env.Name, action.Action, time.Now()); active {
+		return actionError{Status: http.StatusLocked, Message: fmt.Sprintf("change freeze is active for environment %s: %s", env.Name, f.Reason)}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestFreezeWindowValidate(t *testing.T) {
+	for i, testCase := range []struct {
+		freeze    freezeWindow
+		expectErr bool
+	}{
+		{freezeWindow{Reason: "ok", Start: "2020-12-18T17:00:00Z"}, false},
+		{freezeWindow{Reason: "ok", Start: "2020-12-18T17:00:00Z", End: "2020-12-21T06:00:00Z"}, false},
+		{freezeWindow{Reason: "ok", Recurring: &freezeRecurrence{Days: []string{"Sat"}, StartTime: "22:00", EndTime: "04:00"}}, false},
+		{freezeWindow{Start: "2020-12-18T17:00:00Z"}, true},
+		{freezeWindow{Reason: "no range"}, true},
+		{freezeWindow{Reason: "bad start", Start: "2020-12-18"}, true},
+		{freezeWindow{Reason: "end before start", Start: "2020-12-21T06:00:00Z", End: "2020-12-18T17:00:00Z"}, true},
+		{freezeWindow{Reason: "bad action", Start: "2020-12-18T17:00:00Z", Actions: []string{"reboot"}}, true},
+		{freezeWindow{Reason: "bad day", Recurring: &freezeRecurrence{Days: []string{"someday"}, StartTime: "22:00", EndTime: "04:00"}}, true},
+		{freezeWindow{Reason: "bad time", Recurring: &freezeRecurrence{StartTime: "25:00", EndTime: "04:00"}}, true},
+		{freezeWindow{Reason: "bad tz", Recurring: &freezeRecurrence{StartTime: "22:00", EndTime: "04:00", Timezone: "Mars/Base"}}, true},
+	} {
+		if err := testCase.freeze.validate(); (err != nil) != testCase.expectErr {
+			t.Errorf("case %d: expected error %v but got: %v", i, testCase.expectErr, err)
+		}
+	}
+}
+
+func TestFreezeWindowIsActive(t *testing.T) {
+	absolute := freezeWindow{Reason: "absolute", Start: "2020-12-18T17:00:00Z", End: "2020-12-21T06:00:00Z"}
+	// saturday 22:00 until sunday 04:00
+	overnight := freezeWindow{Reason: "overnight", Recurring: &freezeRecurrence{Days: []string{"sat"}, StartTime: "22:00", EndTime: "04:00"}}
+	// weekdays from 09:00 until 17:00
+	daytime := freezeWindow{Reason: "daytime", Recurring: &freezeRecurrence{Days: []string{"mon", "tue", "wed", "thu", "fri"}, StartTime: "09:00", EndTime: "17:00"}}
+	for _, f := range []*freezeWindow{&absolute, &overnight, &daytime} {
+		if err := f.validate(); err != nil {
+			t.Fatalf("unexpected validation error: %v", err)
+		}
+	}
+
+	for i, testCase := range []struct {
+		freeze   freezeWindow
+		now      string
+		expected bool
+	}{
+		{absolute, "2020-12-18T16:59:00Z", false},
+		{absolute, "2020-12-18T17:00:00Z", true},
+		{absolute, "2020-12-21T05:59:00Z", true},
+		{absolute, "2020-12-21T06:00:00Z", false},
+		// 2020-12-19 is a saturday
+		{overnight, "2020-12-19T21:59:00Z", false},
+		{overnight, "2020-12-19T22:00:00Z", true},
+		{overnight, "2020-12-20T03:59:00Z", true},
+		{overnight, "2020-12-20T04:00:00Z", false},
+		{overnight, "2020-12-20T23:00:00Z", false},
+		{daytime, "2020-12-18T12:00:00Z", true},
+		{daytime, "2020-12-18T17:00:00Z", false},
+		{daytime, "2020-12-19T12:00:00Z", false},
+	} {
+		now, _ := time.Parse(time.RFC3339, testCase.now)
+		if testCase.freeze.isActive(now) != testCase.expected {
+			t.Errorf("case %d (%s at %s): expected %v", i, testCase.freeze.Reason, testCase.now, testCase.expected)
+		}
+	}
+}
+
+func TestCheckFreeze(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+
+	f, err := addFreezeWindow(freezeWindow{
+		Reason:       "testing",
+		Environments: []string{"mockenv*"},
+		Actions:      []string{"start"},
+		Start:        time.Now().Add(-time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("addFreezeWindow returned an error: %v", err)
+	}
+	defer deleteFreezeWindow(f.ID)
+
+	if _, err := performPowerAction(powerAction{EnvID: envID, Action: "start", Force: true}); getStatusCode(err) != http.StatusLocked {
+		t.Errorf("expected start to be refused during freeze, got: %v", err)
+	}
+	if err := checkPowerAction(powerAction{EnvID: envID, Action: "stop"}); err != nil {
+		t.Errorf("stop should not be covered by freeze: %v", err)
+	}
+
+	if !deleteFreezeWindow(f.ID) {
+		t.Error("freeze window could not be deleted")
+	}
+	if err := checkPowerAction(powerAction{EnvID: envID, Action: "start"}); err != nil {
+		t.Errorf("start should be allowed after freeze deletion: %v", err)
+	}
+}
+
+func TestFreezeAdminHandlers(t *testing.T) {
+	viper.Set("server.admin_token", "secret")
+	defer viper.Set("server.admin_token", "")
+
+	body := `{"reason":"testing","environments":["mockenv7"],"start":"2020-12-18T17:00:00Z","end":"2020-12-21T06:00:00Z"}`
+	for token, expected := range map[string]int{
+		"":       http.StatusUnauthorized,
+		"wrong":  http.StatusUnauthorized,
+		"secret": http.StatusOK,
+	} {
+		req, _ := http.NewRequest("POST", getEndpoint("freezes"), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		if rr.Code != expected {
+			t.Errorf("token '%s': got %v want %v", token, rr.Code, expected)
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		var created freezeWindowStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil || created.ID == "" || created.Active {
+			t.Fatalf("unexpected response: %s", rr.Body.String())
+		}
+		req, _ = http.NewRequest("DELETE", getEndpoint("freezes/"+created.ID), nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr = httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("delete freeze: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}
+}
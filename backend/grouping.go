@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// name of the regex group which extracts the environment from the Name tag (the first group is used otherwise)
+const environmentRegexGroup = "env"
+
+var (
+	// values are set by ConfigInit
+	environmentKeyTemplate     *template.Template
+	environmentNameRegex       *regexp.Regexp
+	environmentAccountPrefixes map[string]string
+)
+
+// loadEnvironmentGrouping parses the grouping rules from the config file.
+// invalid rules would move instances to other environments (with other IDs), so they are fatal
+func loadEnvironmentGrouping() {
+	environmentKeyTemplate, environmentNameRegex = nil, nil
+	if text := viper.GetString("aws.environment_key_template"); text != "" {
+		t, err := template.New("environment").Option("missingkey=error").Parse(text)
+		if err != nil {
+			log.Fatalf("invalid aws.environment_key_template: %v", err)
+		}
+		environmentKeyTemplate = t
+	}
+	if expr := viper.GetString("aws.environment_name_regex"); expr != "" {
+		r, err := regexp.Compile(expr)
+		if err != nil {
+			log.Fatalf("invalid aws.environment_name_regex: %v", err)
+		}
+		environmentNameRegex = r
+	}
+	environmentAccountPrefixes = viper.GetStringMapString("aws.account_prefixes")
+}
+
+// getARNAccountID returns the account ID of an ARN (arn:partition:service:region:account-id:resource)
+func getARNAccountID(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[4]
+}
+
+// getEnvironmentKey determines the environment of an instance (or ASG), an empty key means it has none.
+// the rules are tried in order: the key template, the environment tag, then the regex on the Name tag.
+// the prefix of the account is added to the key
+func getEnvironmentKey(instance virtualMachine) (key string) {
+	if environmentKeyTemplate != nil {
+		// a missing tag fails the template, so the next rule is used
+		var buf bytes.Buffer
+		if err := environmentKeyTemplate.Execute(&buf, instance); err == nil {
+			key = strings.TrimSpace(buf.String())
+		}
+	}
+	if key == "" {
+		key = instance.Tags[environmentTagKey]
+	}
+	if key == "" && environmentNameRegex != nil {
+		if match := environmentNameRegex.FindStringSubmatch(instance.Name); match != nil {
+			key = match[0]
+			if len(match) > 1 {
+				key = match[1]
+			}
+			for i, name := range environmentNameRegex.SubexpNames() {
+				if name == environmentRegexGroup {
+					key = match[i]
+				}
+			}
+		}
+	}
+	if key != "" {
+		key = environmentAccountPrefixes[instance.AccountID] + key
+	}
+	return
+}
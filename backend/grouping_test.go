@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGetEnvironmentKey(t *testing.T) {
+	defaultTagKey := environmentTagKey
+	environmentTagKey = "Environment"
+	viper.Set("aws.environment_key_template", "{{.Tags.Project}}-{{.Tags.Stage}}")
+	viper.Set("aws.environment_name_regex", "^(?P<env>[a-z]+)-web[0-9]+$")
+	viper.Set("aws.account_prefixes", map[string]string{"123456789012": "prod/"})
+	defer func() {
+		viper.Set("aws.environment_key_template", "")
+		viper.Set("aws.environment_name_regex", "")
+		viper.Set("aws.account_prefixes", nil)
+		loadEnvironmentGrouping()
+		environmentTagKey = defaultTagKey
+	}()
+	loadEnvironmentGrouping()
+
+	for _, tc := range []struct {
+		instance virtualMachine
+		expected string
+	}{
+		{virtualMachine{Tags: map[string]string{"Project": "shop", "Stage": "qa", "Environment": "other"}}, "shop-qa"},
+		// a missing tag fails the template, the environment tag is used instead
+		{virtualMachine{Tags: map[string]string{"Project": "shop", "Environment": "other"}}, "other"},
+		{virtualMachine{Name: "bench-web01", Tags: map[string]string{}}, "bench"},
+		{virtualMachine{Name: "bench-db01", Tags: map[string]string{}}, ""},
+		{virtualMachine{AccountID: "123456789012", Tags: map[string]string{"Environment": "kube"}}, "prod/kube"},
+	} {
+		if key := getEnvironmentKey(tc.instance); key != tc.expected {
+			t.Errorf("%+v: expected key %q, got %q", tc.instance, tc.expected, key)
+		}
+	}
+
+	if account := getARNAccountID("arn:aws:autoscaling:ca-central-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/asg"); account != "123456789012" {
+		t.Errorf("unexpected account ID: %s", account)
+	}
+}
@@ -0,0 +1,332 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defines the outcome of a power action for a member of a group
+
+	// GroupMemberOK is used when the action was sent to the member
+	GroupMemberOK = "ok"
+	// GroupMemberFailed is used when the action was refused or failed
+	GroupMemberFailed = "failed"
+	// GroupMemberSkipped is used for members after a failure in an ordered group
+	GroupMemberSkipped = "skipped"
+	// GroupMemberUnchanged is used for members which were already in the requested state
+	GroupMemberUnchanged = "unchanged"
+
+	// defines the states of a power action of an ordered group, which runs in the background
+
+	// GroupActionRunning is used while the environments of the group are toggled
+	GroupActionRunning = "running"
+	// GroupActionDone is used when the action was sent to all environments of the group
+	GroupActionDone = "done"
+	// GroupActionFailed is used when the action failed for an environment of the group
+	GroupActionFailed = "failed"
+
+	// finished group actions are kept this long for the api response
+	groupActionRetention = 24 * time.Hour
+)
+
+var (
+	// values are set by ConfigInit
+	groupTagKey        string
+	groupOrderTimeout  time.Duration
+	configuredGroups   []envGroup
+	groupOrderInterval = 5 * time.Second
+
+	// group actions by id
+	groupActions = map[string]*groupActionJob{}
+	// lock to prevent concurrent access of the above map
+	groupActionsLock sync.Mutex
+)
+
+// envGroup is a named set of environments which are toggled together
+type envGroup struct {
+	Name string `mapstructure:"name"`
+	// environment names, in the order in which they are started (and stopped in reverse)
+	Environments []string `mapstructure:"environments"`
+	// when ordered, each environment must reach its state before the next one is toggled
+	Ordered bool `mapstructure:"ordered"`
+}
+
+// groupMember is the state of an environment of a group, used for api responses
+type groupMember struct {
+	EnvID            string `json:"env_id"`
+	EnvName          string `json:"env_name"`
+	State            string `json:"state"`
+	RunningInstances int    `json:"running_instances"`
+	TotalInstances   int    `json:"total_instances"`
+}
+
+// groupSummary is the aggregated state of the environments of a group
+type groupSummary struct {
+	Name             string        `json:"name"`
+	Ordered          bool          `json:"ordered"`
+	State            string        `json:"state"`
+	Environments     []groupMember `json:"environments"`
+	RunningInstances int           `json:"running_instances"`
+	StoppedInstances int           `json:"stopped_instances"`
+	TotalInstances   int           `json:"total_instances"`
+	TotalVCPU        int           `json:"total_vcpu"`
+	TotalMemoryGB    float32       `json:"total_memory_gb"`
+	// configured environments which are not in the cache
+	MissingEnvironments []string `json:"missing_environments,omitempty"`
+}
+
+// groupMemberResult is the outcome of a power action for an environment of a group
+type groupMemberResult struct {
+	EnvID   string `json:"env_id"`
+	EnvName string `json:"env_name"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// groupActionResult is the outcome of a power action for a group
+type groupActionResult struct {
+	Name    string              `json:"name"`
+	Action  string              `json:"action"`
+	State   string              `json:"state"`
+	Results []groupMemberResult `json:"results"`
+}
+
+// groupActionJob is a power action of an ordered group, which runs in the background
+type groupActionJob struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Action     string     `json:"action"`
+	Actor      string     `json:"actor,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// outcome for all environments, once the action has finished
+	Result *groupActionResult `json:"result,omitempty"`
+}
+
+// loadEnvGroups parses the groups from the config file
+func loadEnvGroups() {
+	configuredGroups = nil
+	if err := viper.UnmarshalKey("groups.definitions", &configuredGroups); err != nil {
+		log.Errorf("could not parse groups.definitions from config: %v", err)
+	}
+}
+
+// getEnvGroup returns a group by name.
+// environments tagged with the group name (comma separated) are added after the configured environments, sorted by name
+func getEnvGroup(name string) (group envGroup, found bool) {
+	for _, g := range configuredGroups {
+		if g.Name == name {
+			group, found = g, true
+			break
+		}
+	}
+	group.Name = name
+
+	var tagged []string
+	if groupTagKey != "" {
+		for _, env := range cachedTable {
+			if stringInSlice(env.Name, group.Environments) || stringInSlice(env.Name, tagged) {
+				continue
+			}
+			for _, instance := range env.Instances {
+				if stringInSlice(name, splitQueryValues([]string{instance.Tags[groupTagKey]})) {
+					tagged = append(tagged, env.Name)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(tagged)
+	group.Environments = append(append([]string{}, group.Environments...), tagged...)
+	return group, found || len(tagged) > 0
+}
+
+// getGroupState aggregates the states of the environments of a group
+func getGroupState(states []string) string {
+	counts := map[string]int{}
+	for _, state := range states {
+		counts[state]++
+	}
+	switch {
+	case counts[EnvStateChanging] > 0:
+		return EnvStateChanging
+	case counts[EnvStateRunning] == len(states):
+		return EnvStateRunning
+	case counts[EnvStateStopped] == len(states):
+		return EnvStateStopped
+	}
+	return EnvStateMixed
+}
+
+// getGroupSummary returns the aggregated state of the environments of a group
+func getGroupSummary(group envGroup) (summary groupSummary) {
+	summary = groupSummary{Name: group.Name, Ordered: group.Ordered, Environments: []groupMember{}}
+	var states []string
+	for _, name := range group.Environments {
+		env, found := getEnvironmentByName(name)
+		if !found {
+			summary.MissingEnvironments = append(summary.MissingEnvironments, name)
+			continue
+		}
+		summary.Environments = append(summary.Environments, groupMember{
+			EnvID:            env.ID,
+			EnvName:          env.Name,
+			State:            env.State,
+			RunningInstances: env.RunningInstances,
+			TotalInstances:   env.TotalInstances,
+		})
+		summary.RunningInstances += env.RunningInstances
+		summary.StoppedInstances += env.StoppedInstances
+		summary.TotalInstances += env.TotalInstances
+		summary.TotalVCPU += env.TotalVCPU
+		summary.TotalMemoryGB += env.TotalMemoryGB
+		states = append(states, env.State)
+	}
+	summary.State = getGroupState(states)
+	return
+}
+
+// envReachedState returns true if the environment is running, or stopped except for its protected instances
+func envReachedState(env environment, state string) bool {
+	if state == EnvStateRunning {
+		return env.State == EnvStateRunning
+	}
+	for _, instance := range env.Instances {
+		if !instance.Protected && instance.State != "stopped" {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForEnvState refreshes the cache until the environment reaches the state, or the timeout expires
+func waitForEnvState(envID, state string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := refreshTable(); err != nil {
+			log.Warningf("failed to refresh while waiting for env [%s]: %v", envID, err)
+		}
+		if env, found := getEnvironmentByID(envID); !found || envReachedState(env, state) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("env [%s] did not reach state %s within %v", envID, state, timeout)
+		}
+		time.Sleep(groupOrderInterval)
+	}
+}
+
+// performGroupAction starts or stops the environments of a group.
+// ordered groups are started in their order and stopped in reverse, after a failure the remaining environments are skipped.
+// err is the first failure, the result has the outcome for all environments
+func performGroupAction(group envGroup, template powerAction) (result groupActionResult, err error) {
+	result = groupActionResult{Name: group.Name, Action: template.Action, Results: []groupMemberResult{}}
+	names := group.Environments
+	if group.Ordered && template.Action == "stop" {
+		names = make([]string, len(group.Environments))
+		for i, name := range group.Environments {
+			names[len(names)-1-i] = name
+		}
+	}
+	targetState := EnvStateRunning
+	if template.Action == "stop" {
+		targetState = EnvStateStopped
+	}
+
+	for _, name := range names {
+		env, found := getEnvironmentByName(name)
+		if !found {
+			continue
+		}
+		memberResult := groupMemberResult{EnvID: env.ID, EnvName: env.Name, Status: GroupMemberOK}
+		if err != nil && group.Ordered {
+			memberResult.Status = GroupMemberSkipped
+			result.Results = append(result.Results, memberResult)
+			continue
+		}
+		if envReachedState(env, targetState) {
+			memberResult.Status = GroupMemberUnchanged
+			result.Results = append(result.Results, memberResult)
+			continue
+		}
+
+		action := template
+		action.EnvID = env.ID
+		_, actionErr := performPowerAction(action)
+		if actionErr == nil && group.Ordered {
+			actionErr = waitForEnvState(env.ID, targetState, groupOrderTimeout)
+		}
+		if actionErr != nil {
+			memberResult.Status = GroupMemberFailed
+			memberResult.Error = actionErr.Error()
+			if err == nil {
+				err = actionErr
+			}
+		}
+		result.Results = append(result.Results, memberResult)
+	}
+	result.State = getGroupSummary(group).State
+	return
+}
+
+// startGroupAction performs the power action of a group in the background (see performGroupAction).
+// only one action of a group runs at a time, the running action is returned with an error otherwise
+func startGroupAction(group envGroup, template powerAction) (job groupActionJob, err error) {
+	groupActionsLock.Lock()
+	defer groupActionsLock.Unlock()
+
+	now := time.Now()
+	for id, existing := range groupActions {
+		if existing.Status == GroupActionRunning && existing.Name == group.Name {
+			return *existing, actionError{Status: http.StatusConflict, Message: fmt.Sprintf("an action of group %s is already running: %s", group.Name, existing.ID)}
+		}
+		if existing.FinishedAt != nil && now.Sub(*existing.FinishedAt) > groupActionRetention {
+			delete(groupActions, id)
+		}
+	}
+
+	started := &groupActionJob{
+		ID:        generateRandomID(),
+		Name:      group.Name,
+		Action:    template.Action,
+		Actor:     template.Actor,
+		Status:    GroupActionRunning,
+		StartedAt: now,
+	}
+	groupActions[started.ID] = started
+	log.Infof("group action %s started: %s of group %s requested by %s", started.ID, template.Action, group.Name, template.Actor)
+
+	go func() {
+		result, actionErr := performGroupAction(group, template)
+		groupActionsLock.Lock()
+		defer groupActionsLock.Unlock()
+		finishedAt := time.Now()
+		started.FinishedAt = &finishedAt
+		started.Result = &result
+		started.Status = GroupActionDone
+		if actionErr != nil {
+			started.Status = GroupActionFailed
+			started.Error = actionErr.Error()
+		}
+		log.Infof("group action %s finished: %s", started.ID, started.Status)
+	}()
+	return *started, nil
+}
+
+// getGroupAction returns a group action by id
+func getGroupAction(id string) (job groupActionJob, found bool) {
+	groupActionsLock.Lock()
+	defer groupActionsLock.Unlock()
+	if existing, exists := groupActions[id]; exists {
+		return *existing, true
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetGroupState(t *testing.T) {
+	for expected, states := range map[string][]string{
+		EnvStateRunning:  {EnvStateRunning, EnvStateRunning},
+		EnvStateStopped:  {EnvStateStopped},
+		EnvStateMixed:    {EnvStateRunning, EnvStateStopped},
+		EnvStateChanging: {EnvStateRunning, EnvStateChanging, EnvStateStopped},
+	} {
+		if state := getGroupState(states); state != expected {
+			t.Errorf("%v: expected %s, got %s", states, expected, state)
+		}
+	}
+}
+
+func TestPerformGroupAction(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	groupTagKey = "power-toggle-group"
+	configuredGroups = []envGroup{{Name: "integration", Environments: []string{"mockenv7", "missing"}, Ordered: true}}
+	groupOrderInterval = 0
+	defer func() {
+		groupTagKey = ""
+		configuredGroups = nil
+	}()
+	// mockenv6 joins the group with a tag
+	for e := range cachedTable {
+		if cachedTable[e].Name == "mockenv6" {
+			cachedTable[e].Instances[0].Tags = map[string]string{"power-toggle-group": "other, integration"}
+		}
+	}
+
+	group, found := getEnvGroup("integration")
+	if !found || !equalStrings(group.Environments, []string{"mockenv7", "missing", "mockenv6"}) {
+		t.Fatalf("unexpected group: %+v", group)
+	}
+	if _, found = getEnvGroup("unknown"); found {
+		t.Error("expected an unknown group not to be found")
+	}
+	summary := getGroupSummary(group)
+	if summary.State != EnvStateStopped || len(summary.Environments) != 2 || summary.TotalInstances != 16 ||
+		!equalStrings(summary.MissingEnvironments, []string{"missing"}) {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+
+	result, err := performGroupAction(group, powerAction{Action: "start", Actor: "jdoe", Source: ActionSourceAPI, Force: true})
+	if err != nil {
+		t.Fatalf("group start returned an error: %v", err)
+	}
+	if result.State != EnvStateRunning || len(result.Results) != 2 || result.Results[0].EnvName != "mockenv7" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	// a started group is unchanged, a stopped group is stopped in reverse order
+	if result, _ = performGroupAction(group, powerAction{Action: "start", Force: true}); result.Results[0].Status != GroupMemberUnchanged {
+		t.Errorf("expected an unchanged member, got: %+v", result.Results[0])
+	}
+	result, err = performGroupAction(group, powerAction{Action: "stop", Force: true})
+	if err != nil || result.State != EnvStateStopped || result.Results[0].EnvName != "mockenv6" {
+		t.Errorf("unexpected stop result: %+v %v", result, err)
+	}
+
+	// members after a refused member of an ordered group are skipped
+	f, err := addFreezeWindow(freezeWindow{
+		Reason:       "testing",
+		Environments: []string{"mockenv7"},
+		Actions:      []string{"start"},
+		Start:        time.Now().Add(-time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("addFreezeWindow returned an error: %v", err)
+	}
+	defer deleteFreezeWindow(f.ID)
+	result, err = performGroupAction(group, powerAction{Action: "start", Force: true})
+	if getStatusCode(err) != http.StatusLocked || result.Results[0].Status != GroupMemberFailed || result.Results[1].Status != GroupMemberSkipped {
+		t.Errorf("unexpected result with a frozen member: %+v %v", result, err)
+	}
+}
+
+func TestStartGroupAction(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	groupOrderInterval = 0
+	defer func() { groupActions = map[string]*groupActionJob{} }()
+	group := envGroup{Name: "integration", Environments: []string{"mockenv7", "mockenv6"}, Ordered: true}
+
+	job, err := startGroupAction(group, powerAction{Action: "start", Actor: "jdoe", Force: true})
+	if err != nil || job.Status != GroupActionRunning || job.Actor != "jdoe" {
+		t.Fatalf("unexpected group action: %+v %v", job, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status == GroupActionRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = getGroupAction(job.ID)
+	}
+	if job.Status != GroupActionDone || job.FinishedAt == nil || job.Result == nil || job.Result.State != EnvStateRunning {
+		t.Errorf("unexpected finished group action: %+v", job)
+	}
+	if _, found := getGroupAction("unknown"); found {
+		t.Error("expected an unknown group action not to be found")
+	}
+
+	// only one action of a group runs at a time
+	groupActions["running"] = &groupActionJob{ID: "running", Name: group.Name, Status: GroupActionRunning}
+	if job, err = startGroupAction(group, powerAction{Action: "stop"}); getStatusCode(err) != http.StatusConflict || job.ID != "running" {
+		t.Errorf("expected the running group action with a conflict, got: %+v %v", job, err)
+	}
+}
@@ -1,9 +1,13 @@
 package backend
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
@@ -19,6 +23,17 @@ func handlerVersion(w http.ResponseWriter, req *http.Request) {
 func handlerEnvAll(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	format, err := getExportFormat(req)
+	var query envQuery
+	if err == nil {
+		query, err = parseEnvQuery(req)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+		return
+	}
+
 	// refresh the data
 	if err := refreshTable(); err != nil {
 		log.Errorf("refresh error: %v", err)
@@ -31,31 +46,45 @@ func handlerEnvAll(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	group := vars["group"]
 
+	// filter, sort and page the environments
+	envs, total := query.apply(cachedTable)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
 	envAllResponse := struct {
 		EnvList           envList `json:"envList" groups:"summary,details"`
 		TotalBillsAccrued string  `json:"totalBillsAccrued,omitempty" groups:"summary,details"`
 		TotalBillsSaved   string  `json:"totalBillsSaved,omitempty" groups:"summary,details"`
+		// month-to-date cost plus the projected cost until the end of the month
+		TotalForecastMonthEnd string `json:"totalForecastMonthEnd,omitempty" groups:"summary,details"`
 	}{
-		EnvList: cachedTable,
+		EnvList: envs,
 	}
 	if experimentalEnabled {
 		envAllResponse.TotalBillsAccrued = fmt.Sprintf("%.02f", totalBillsAccrued)
 		envAllResponse.TotalBillsSaved = fmt.Sprintf("%.02f", totalBillsSaved)
+		envAllResponse.TotalForecastMonthEnd = fmt.Sprintf("%.02f", getTotalMonthEndForecast(time.Now()))
 	}
 
 	// prepare result and return it
-	if response, err := getMarshaledResponse(envAllResponse, group); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
-	} else {
-		w.Write(response)
-	}
+	writeExportResponse(w, req, format, envAllResponse, envs, exportOptions{
+		group:    group,
+		fields:   query.Fields,
+		listKey:  "envList",
+		filename: "environments-" + group,
+	})
 }
 
 // handler for single environment
 func handlerEnvSingle(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
+	format, err := getExportFormat(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+		return
+	}
+
 	// refresh the data
 	if err := refreshTable(); err != nil {
 		log.Errorf("refresh error: %v", err)
@@ -76,15 +105,13 @@ func handlerEnvSingle(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "{\"error\":\"environment not found\"}\n")
 		return
 	}
-	response, err := getMarshaledResponse(envData, group)
 
 	// return filtered result
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
-	} else {
-		w.Write(response)
-	}
+	writeExportResponse(w, req, format, envData, []environment{envData}, exportOptions{
+		group:    group,
+		fields:   splitQueryValues(req.URL.Query()["fields"]),
+		filename: "env-" + envID + "-" + group,
+	})
 }
 
 // handler for power toggling an environment
@@ -101,12 +128,40 @@ func handlerEnvPowerToggle(w http.ResponseWriter, req *http.Request) {
 	envID := vars["env-id"]
 	state := vars["state"]
 
+	// optionally only toggle the instances with these roles
+	roles := splitQueryValues(req.URL.Query()["role"])
+	if env, found := getEnvironmentByID(envID); found && len(roles) > 0 {
+		if err := validateRoles(env, roles); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+			return
+		}
+	}
+
 	switch state {
 	case "start":
-		response, err := startupEnv(envID)
+		// an optional lease will stop the environment when it expires
+		leaseExpiresAt, leaseRequested, err := parseLeaseExpiry(req, time.Now())
+		// a lease stops the whole environment, including the roles which were not started
+		if err == nil && leaseRequested && len(roles) > 0 {
+			err = fmt.Errorf("a lease (ttl or until) can not be used together with role")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+			return
+		}
+		action := getRequestPowerAction(req, envID, state)
+		action.Roles = roles
+		response, err := performPowerAction(action)
+		if err == nil && leaseRequested {
+			setEnvLease(envID, action.Actor, leaseExpiresAt)
+		}
 		writeJSONResponse(w, err, response)
 	case "stop":
-		response, err := shutdownEnv(envID)
+		action := getRequestPowerAction(req, envID, state)
+		action.Roles = roles
+		response, err := performPowerAction(action)
 		writeJSONResponse(w, err, response)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
@@ -114,6 +169,330 @@ func handlerEnvPowerToggle(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handler for the aggregated state of a group of environments
+func handlerGroupSummary(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	group, found := getEnvGroup(mux.Vars(req)["group-name"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"group not found\"}\n")
+		return
+	}
+	response, _ := json.Marshal(getGroupSummary(group))
+	w.Write(response)
+}
+
+// handler for the status of a power action of an ordered group, which runs in the background
+func handlerGroupAction(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(req)
+	job, found := getGroupAction(vars["action-id"])
+	if !found || job.Name != vars["group-name"] {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"group action not found\"}\n")
+		return
+	}
+	response, _ := json.Marshal(job)
+	w.Write(response)
+}
+
+// handler for starting or stopping all environments of a group. ordered groups are toggled in the background (202).
+// otherwise the response has the outcome for each environment, the status code is the one of the first failure (if any)
+func handlerGroupPowerToggle(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	vars := mux.Vars(req)
+	group, found := getEnvGroup(vars["group-name"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"group not found\"}\n")
+		return
+	}
+
+	// re-calculate env bills before toggling
+	if experimentalEnabled {
+		calculateEnvBills()
+	}
+	// ordered groups wait for each environment, so they are toggled in the background
+	if group.Ordered {
+		job, err := startGroupAction(group, getRequestPowerAction(req, "", vars["state"]))
+		status := http.StatusAccepted
+		if err != nil {
+			status = getStatusCode(err)
+		}
+		// the running action of the group is returned on a conflict
+		w.Header().Set("Location", getEndpoint(fmt.Sprintf("group/%s/action/%s", group.Name, job.ID)))
+		response, _ := json.Marshal(job)
+		w.WriteHeader(status)
+		w.Write(response)
+		return
+	}
+	result, err := performGroupAction(group, getRequestPowerAction(req, "", vars["state"]))
+	status := http.StatusOK
+	if err != nil {
+		status = getStatusCode(err)
+	}
+	response, _ := json.Marshal(result)
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// handler for extending or cancelling the lease of an environment
+func handlerEnvLease(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// get vars from request to determine environment
+	vars := mux.Vars(req)
+	envID := vars["env-id"]
+	action := vars["action"]
+
+	lease, found := getEnvLease(envID)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"lease not found\"}\n")
+		return
+	}
+
+	// only the owner may change a lease (unless forced), the caller is taken from the trusted header
+	actor := getTrustedActor(req)
+	if actor == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "{\"error\":\"caller is unknown, the %s header is required\"}\n", viper.GetString("server.actor_header"))
+		return
+	}
+	if lease.Owner != actor && !isForced(req) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "{\"error\":%q}\n", fmt.Sprintf("lease is owned by %s", lease.Owner))
+		return
+	}
+
+	switch action {
+	case "extend":
+		// a ttl extends the current expiry, until replaces it
+		expiresAt, leaseRequested, err := parseLeaseExpiry(req, lease.ExpiresAt)
+		if err == nil && !leaseRequested {
+			err = fmt.Errorf("ttl or until is required")
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+			return
+		}
+		lease, _ = extendEnvLease(envID, expiresAt)
+	case "cancel":
+		deleteEnvLease(envID)
+	}
+
+	response, err := json.Marshal(lease)
+	writeJSONResponse(w, err, response)
+}
+
+// handler for the cost forecast of an environment
+func handlerEnvForecast(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// get vars from request to determine environment
+	vars := mux.Vars(req)
+	envID := vars["env-id"]
+
+	env, found := getEnvironmentByID(envID)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"environment not found\"}\n")
+		return
+	}
+
+	// the same lease parameters as for starting the environment
+	now := time.Now()
+	hours, err := parseForecastHours(req.FormValue("hours"))
+	var startedStopAt time.Time
+	if err == nil {
+		startedStopAt, _, err = parseLeaseExpiry(req, now)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+		return
+	}
+
+	response, err := json.Marshal(getEnvForecast(env, now, startedStopAt, hours))
+	writeJSONResponse(w, err, response)
+}
+
+// handler for reserving or releasing an environment
+func handlerEnvReservation(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// get vars from request to determine environment
+	vars := mux.Vars(req)
+	envID := vars["env-id"]
+	action := vars["action"]
+
+	if _, found := getEnvironmentByID(envID); !found {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"environment not found\"}\n")
+		return
+	}
+
+	// the owner of a reservation can only be taken from the trusted header, or it could be spoofed
+	actor := getTrustedActor(req)
+	if actor == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "{\"error\":\"caller is unknown, the %s header is required\"}\n", viper.GetString("server.actor_header"))
+		return
+	}
+
+	var reservation envReservation
+	var err error
+	switch action {
+	case "reserve":
+		duration, parseErr := parseReservationDuration(req)
+		if parseErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "{\"error\":\"%v\"}\n", parseErr)
+			return
+		}
+		reservation, err = reserveEnv(envID, actor, req.FormValue("reason"), duration, isForced(req))
+	case "release":
+		reservation, err = releaseEnv(envID, actor, isForced(req))
+	}
+
+	var response []byte
+	if err == nil {
+		response, err = json.Marshal(reservation)
+	}
+	writeJSONResponse(w, err, response)
+}
+
+// handler for listing freeze windows
+func handlerFreezeList(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response, err := json.Marshal(getFreezeWindows(time.Now()))
+	writeJSONResponse(w, err, response)
+}
+
+// handler for creating a freeze window at runtime
+func handlerFreezeCreate(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var f freezeWindow
+	if err := json.NewDecoder(req.Body).Decode(&f); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"invalid request body\"}\n")
+		return
+	}
+	f, err := addFreezeWindow(f)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+		return
+	}
+	response, err := json.Marshal(freezeWindowStatus{f, f.isActive(time.Now())})
+	writeJSONResponse(w, err, response)
+}
+
+// handler for deleting a freeze window
+func handlerFreezeDelete(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !deleteFreezeWindow(mux.Vars(req)["freeze-id"]) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "{\"error\":\"freeze not found\"}\n")
+		return
+	}
+	fmt.Fprint(w, "{\"status\":\"OK\"}\n")
+}
+
+// handler for listing approvals
+func handlerApprovalList(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response, err := json.Marshal(getApprovals())
+	writeJSONResponse(w, err, response)
+}
+
+// handler for approving or rejecting a pending approval
+func handlerApprovalDecision(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// the four-eyes rule relies on the identity of the approver, so only the trusted header is accepted
+	approver := getTrustedActor(req)
+	if approver == "" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "{\"error\":\"approver is unknown, the %s header is required\"}\n", viper.GetString("server.actor_header"))
+		return
+	}
+	vars := mux.Vars(req)
+	approval, err := decideApproval(vars["approval-id"], approver, vars["decision"] == "approve")
+
+	var response []byte
+	if err == nil {
+		response, err = json.Marshal(approval)
+	}
+	writeJSONResponse(w, err, response)
+}
+
+// handler for notification delivery statistics
+func handlerNotificationStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response, err := json.Marshal(getDeliveryStats())
+	writeJSONResponse(w, err, response)
+}
+
+// handler for the status of the pricing catalog
+func handlerPricing(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response, err := json.Marshal(getPricingStatus())
+	writeJSONResponse(w, err, response)
+}
+
+// handler for reloading the pricing catalog from its source.
+// new prices are used for the next poll
+func handlerPricingRefresh(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status, err := refreshPricingCatalog()
+	if err != nil {
+		err = actionError{Status: http.StatusBadGateway, Message: err.Error()}
+	}
+	response, _ := json.Marshal(status)
+	writeJSONResponse(w, err, response)
+}
+
+// handler for cost reports. the format is selected with the format query parameter (json, csv or html)
+func handlerReport(w http.ResponseWriter, req *http.Request) {
+	report, err := generateReport(mux.Vars(req)["period"], time.Now())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeJSONResponse(w, err, nil)
+		return
+	}
+
+	var response []byte
+	switch format := req.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		response, err = json.Marshal(report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=report-%s-%s.csv", report.Period, report.From.Format(usageDateFormat)))
+		response, err = reportCSV(report)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		response, err = reportHTML(report)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"invalid format: %s\"}\n", format)
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeJSONResponse(w, err, nil)
+		return
+	}
+	w.Write(response)
+}
+
 // handler for power toggling an instance
 func handlerInstancePowerToggle(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -124,7 +503,9 @@ func handlerInstancePowerToggle(w http.ResponseWriter, req *http.Request) {
 	state := vars["state"]
 
 	if state == "start" || state == "stop" {
-		response, err := toggleInstance(id, state)
+		action := getRequestPowerAction(req, getInstanceEnvID(id), state)
+		action.InstanceID = id
+		response, err := performPowerAction(action)
 		writeJSONResponse(w, err, response)
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
@@ -148,31 +529,145 @@ func handlerRefresh(w http.ResponseWriter, req *http.Request) {
 func handlerConfig(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	configuredOption := map[string]interface{}{
-		"aws_polling_interval":          viper.GetInt("aws.polling_interval"),
-		"aws_regions":                   awsRegions,
-		"aws_required_tag_key":          requiredTagKey,
-		"aws_required_tag_value":        requiredTagValue,
-		"aws_environment_tag_key":       environmentTagKey,
-		"aws_max_instances_to_shutdown": maxInstancesToShutdown,
-		"aws_ignore_instance_types":     instanceTypeIgnore,
-		"aws_ignore_environments":       envNameIgnore,
-		"slack_enabled":                 slackEnabled,
-		"mock_enabled":                  mockEnabled,
-		"mock_delay":                    viper.GetBool("mock.delay"),
-		"mock_errors":                   viper.GetBool("mock.errors"),
+		"aws_polling_interval":           viper.GetInt("aws.polling_interval"),
+		"aws_regions":                    awsRegions,
+		"aws_required_tag_key":           requiredTagKey,
+		"aws_required_tag_value":         requiredTagValue,
+		"aws_environment_tag_key":        environmentTagKey,
+		"aws_environment_key_template":   viper.GetString("aws.environment_key_template"),
+		"aws_environment_name_regex":     viper.GetString("aws.environment_name_regex"),
+		"aws_account_prefixes":           environmentAccountPrefixes,
+		"aws_role_tag_key":               roleTagKey,
+		"aws_keep_running_tag_key":       keepRunningTagKey,
+		"aws_keep_running_tag_value":     keepRunningTagValue,
+		"aws_max_instances_to_shutdown":  maxInstancesToShutdown,
+		"aws_max_instances_to_startup":   maxInstancesToStartup,
+		"aws_max_hourly_cost_to_startup": maxHourlyCostToStartup,
+		"limits_confirmation_window":     confirmationWindow.String(),
+		"aws_ignore_instance_types":      instanceTypeIgnore,
+		"aws_ignore_environments":        envNameIgnore,
+		"aws_exposed_tag_keys":           exposedTagKeys,
+		"lease_max_ttl":                  leaseMaxTTL.String(),
+		"lease_reminders":                viper.GetStringSlice("leases.reminders"),
+		"reservation_default_duration":   reservationDefaultDuration.String(),
+		"reservation_max_duration":       reservationMaxDuration.String(),
+		"freezes":                        len(getFreezeWindows(time.Now())),
+		"approval_environments":          approvalEnvironments,
+		"approval_tag_key":               approvalTagKey,
+		"approval_approvers":             approvalApprovers,
+		"approval_timeout":               approvalTimeout.String(),
+		"slack_enabled":                  slackEnabled,
+		"slack_commands_enabled":         slackSigningSecret != "",
+		"notification_channels":          len(notificationChannels),
+		"pricing_source":                 getPricingStatus().Source,
+		"pricing_discounts":              len(pricingDiscounts),
+		"report_schedules":               len(reportSchedules),
+		"report_history_retention":       historyRetention.String(),
+		"budget_default_monthly":         budgetDefaultMonthly,
+		"budget_tag_key":                 budgetTagKey,
+		"budget_thresholds":              budgetThresholds,
+		"budget_enforcement":             budgetEnforcement,
+		"metadata_owner_tag_key":         ownerTagKey,
+		"metadata_team_tag_key":          teamTagKey,
+		"metadata_description_tag_key":   descriptionTagKey,
+		"metadata_link_tag_key":          linkTagKey,
+		"metadata_environments":          len(envMetadataConfig),
+		"group_tag_key":                  groupTagKey,
+		"group_order_timeout":            groupOrderTimeout.String(),
+		"groups":                         len(configuredGroups),
+		"wake_proxy_enabled":             wakeProxyEnabled,
+		"wake_proxy_routes":              len(wakeProxyRoutes),
+		"wake_proxy_hold_timeout":        wakeProxyHoldTimeout.String(),
+		"mock_enabled":                   mockEnabled,
+		"mock_delay":                     viper.GetBool("mock.delay"),
+		"mock_errors":                    viper.GetBool("mock.errors"),
 	}
 	jsonResponse, _ := json.MarshalIndent(configuredOption, "", "  ")
 	fmt.Fprint(w, string(jsonResponse))
 }
 
+// requireAdmin wraps a handler so that it can only be called with the configured admin token.
+// admin endpoints are disabled when no token is configured
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		token := viper.GetString("server.admin_token")
+		if token == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "{\"error\":\"admin endpoints are disabled\"}\n")
+			return
+		}
+		provided := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{\"error\":\"invalid admin token\"}\n")
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// getTrustedActor returns the identity of the caller from the configured header,
+// which is set by an authenticating proxy. It is empty when the header is missing
+func getTrustedActor(req *http.Request) string {
+	if header := viper.GetString("server.actor_header"); header != "" {
+		return req.Header.Get(header)
+	}
+	return ""
+}
+
+// getRequestActor returns the identity of the caller. Without the trusted header,
+// the actor request parameter is used when server.allow_actor_param is enabled
+func getRequestActor(req *http.Request) string {
+	if actor := getTrustedActor(req); actor != "" {
+		return actor
+	}
+	if viper.GetBool("server.allow_actor_param") {
+		return req.FormValue("actor")
+	}
+	return ""
+}
+
+// getRequestPowerAction returns a power action with the details of the request
+func getRequestPowerAction(req *http.Request, envID, state string) powerAction {
+	return powerAction{
+		EnvID:        envID,
+		Action:       state,
+		Actor:        getRequestActor(req),
+		Source:       ActionSourceAPI,
+		ActorTrusted: getTrustedActor(req) != "",
+		Force:        isForced(req),
+		Confirm:      req.FormValue("confirm"),
+	}
+}
+
+// isForced returns true when the request has the force parameter set
+func isForced(req *http.Request) bool {
+	force, _ := strconv.ParseBool(req.FormValue("force"))
+	return force
+}
+
 // wrapper for json responses with error support
 func writeJSONResponse(w http.ResponseWriter, err error, response []byte) {
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
 		w.Write(response)
 	} else {
-		w.WriteHeader(http.StatusInternalServerError)
-		if len(response) > 0 {
+		w.WriteHeader(getStatusCode(err))
+		if aErr, ok := err.(actionError); ok && len(aErr.Details) > 0 {
+			// a refusal can also be a success (ie. an action waiting for approval)
+			key := "error"
+			if aErr.Status < http.StatusBadRequest {
+				key = "message"
+			}
+			body := map[string]interface{}{key: aErr.Message}
+			for k, v := range aErr.Details {
+				body[k] = v
+			}
+			jsonResponse, _ := json.Marshal(body)
+			w.Write(jsonResponse)
+		} else if len(response) > 0 {
 			w.Write(response)
 		} else {
 			fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/spf13/viper"
 )
 
 func TestHttpHandlers(t *testing.T) {
@@ -15,6 +17,9 @@ func TestHttpHandlers(t *testing.T) {
 	// discard logs
 	loggingInit("INFO")
 
+	// callers are identified by this header
+	viper.Set("server.actor_header", "X-Forwarded-User")
+
 	// prepare data
 	if err := resetMockData(); err != nil {
 		t.Fatalf("mockRefreshTable failed: %v", err)
@@ -38,35 +43,129 @@ func TestHttpHandlers(t *testing.T) {
 		{"GET", getEndpoint("env/4f9f1afb29f1/summary"), http.StatusOK},
 		{"GET", getEndpoint("env/4f9f1afb29f1/details"), http.StatusOK},
 		{"GET", getEndpoint("env/invalid/summary"), http.StatusNotFound},
+		{"POST", getEndpoint("env/4f9f1afb29f1/start?role=app"), http.StatusBadRequest},
+		{"GET", getEndpoint("group/unknown/summary"), http.StatusNotFound},
+		{"POST", getEndpoint("group/unknown/start"), http.StatusNotFound},
+		{"GET", getEndpoint("group/unknown/action/unknown"), http.StatusNotFound},
+		{"GET", getEndpoint("env/summary?format=csv"), http.StatusOK},
+		{"GET", getEndpoint("env/details?format=xlsx"), http.StatusOK},
+		{"GET", getEndpoint("env/4f9f1afb29f1/details?format=yaml"), http.StatusOK},
+		{"GET", getEndpoint("env/summary?format=pdf"), http.StatusBadRequest},
+		{"GET", getEndpoint("env/details?state=running&sort=total_vcpu:desc&limit=5"), http.StatusOK},
+		{"GET", getEndpoint("env/details?sort=invalid"), http.StatusBadRequest},
+		{"GET", getEndpoint("env/4f9f1afb29f1/forecast?hours=12&ttl=2h"), http.StatusOK},
+		{"GET", getEndpoint("env/4f9f1afb29f1/forecast?hours=0"), http.StatusBadRequest},
+		{"GET", getEndpoint("env/4f9f1afb29f1/forecast?ttl=wrong"), http.StatusBadRequest},
+		{"GET", getEndpoint("env/invalid/forecast"), http.StatusNotFound},
 		{"GET", getEndpoint("env/invalid/details"), http.StatusNotFound},
 		{"POST", getEndpoint("env/4f9f1afb29f1/start"), http.StatusOK},
 		{"POST", getEndpoint("env/4f9f1afb29f1/stop"), http.StatusOK},
+		{"POST", getEndpoint("env/4f9f1afb29f1/start?ttl=invalid"), http.StatusBadRequest},
 		{"POST", getEndpoint("env/invalid/start"), http.StatusInternalServerError},
 		{"POST", getEndpoint("env/invalid/stop"), http.StatusInternalServerError},
+		{"GET", getEndpoint("freezes"), http.StatusOK},
+		{"POST", getEndpoint("freezes"), http.StatusForbidden},
+		{"DELETE", getEndpoint("freezes/invalid"), http.StatusForbidden},
+		{"GET", getEndpoint("approvals"), http.StatusOK},
+		{"GET", getEndpoint("notifications/stats"), http.StatusOK},
+		{"GET", getEndpoint("pricing"), http.StatusOK},
+		{"POST", getEndpoint("pricing/refresh"), http.StatusForbidden},
+		{"GET", getEndpoint("reports/daily"), http.StatusOK},
+		{"GET", getEndpoint("reports/weekly?format=csv"), http.StatusOK},
+		{"GET", getEndpoint("reports/monthly?format=html"), http.StatusOK},
+		{"GET", getEndpoint("reports/daily?format=pdf"), http.StatusBadRequest},
+		{"GET", getEndpoint("reports/yearly"), http.StatusNotFound},
 		{"POST", getEndpoint("instance/906d663b6ecd/start"), http.StatusOK},
 		{"POST", getEndpoint("instance/906d663b6ecd/stop"), http.StatusOK},
 		{"POST", getEndpoint("instance/invalid/start"), http.StatusInternalServerError},
 		{"POST", getEndpoint("instance/invalid/stop"), http.StatusInternalServerError},
 	} {
+		checkHandlerStatus(t, testReq.method, testReq.endpoint, "", testReq.status)
+	}
+
+	// requests which depend on the caller, identified by the trusted header (see server.actor_header)
+	for _, testReq := range []struct {
+		actor string
+		req
+	}{
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/reserve?duration=invalid"), http.StatusBadRequest}},
+		{"", req{"POST", getEndpoint("env/4f9f1afb29f1/reserve?owner=tester&duration=1h"), http.StatusForbidden}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/reserve?duration=1h"), http.StatusOK}},
+		{"other", req{"POST", getEndpoint("env/4f9f1afb29f1/reserve?duration=1h"), http.StatusConflict}},
+		{"other", req{"POST", getEndpoint("env/4f9f1afb29f1/stop"), http.StatusConflict}},
+		{"", req{"POST", getEndpoint("env/4f9f1afb29f1/stop?actor=tester"), http.StatusConflict}},
+		{"", req{"POST", getEndpoint("env/4f9f1afb29f1/release?actor=tester"), http.StatusForbidden}},
+		{"other", req{"POST", getEndpoint("env/4f9f1afb29f1/release"), http.StatusConflict}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/release"), http.StatusOK}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/release"), http.StatusNotFound}},
+		{"tester", req{"POST", getEndpoint("env/invalid/reserve"), http.StatusNotFound}},
+		// only the owner of a lease may change it, unless forced
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/start?ttl=2h"), http.StatusOK}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/extend"), http.StatusBadRequest}},
+		{"", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/extend?ttl=30m&actor=tester"), http.StatusForbidden}},
+		{"other", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/extend?ttl=30m"), http.StatusConflict}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/extend?ttl=30m"), http.StatusOK}},
+		{"other", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/cancel"), http.StatusConflict}},
+		{"other", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/cancel?force=true"), http.StatusOK}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/lease/cancel"), http.StatusNotFound}},
+		{"tester", req{"POST", getEndpoint("env/4f9f1afb29f1/stop"), http.StatusOK}},
+		// the actor parameter is not trusted
+		{"", req{"POST", getEndpoint("approvals/invalid/approve?actor=tester"), http.StatusForbidden}},
+		{"tester", req{"POST", getEndpoint("approvals/invalid/approve"), http.StatusNotFound}},
+		{"tester", req{"POST", getEndpoint("approvals/invalid/reject"), http.StatusNotFound}},
+	} {
+		checkHandlerStatus(t, testReq.method, testReq.endpoint, testReq.actor, testReq.status)
+	}
+}
+
+// checkHandlerStatus sends a request (by the actor, when set) to the router and checks its status code
+func checkHandlerStatus(t *testing.T, method, endpoint, actor string, status int) {
+	t.Helper()
+
+	// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
+	// pass 'nil' as the third parameter.
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actor != "" {
+		req.Header.Set(viper.GetString("server.actor_header"), actor)
+	}
 
-		// Create a request to pass to our handler. We don't have any query parameters for now, so we'll
-		// pass 'nil' as the third parameter.
-		req, err := http.NewRequest(testReq.method, testReq.endpoint, nil)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
-		rr := httptest.NewRecorder()
-
-		// since we use gorilla mux for our handers, we need to pass the request over to that
-		mux := newRouter()
-		mux.ServeHTTP(rr, req)
-
-		// Check the status code is what we expect.
-		if status := rr.Code; status != testReq.status {
-			t.Errorf("handler returned wrong status code for endpoint: %s: got %v want %v",
-				testReq.endpoint, status, testReq.status)
-		}
+	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
+	rr := httptest.NewRecorder()
+
+	// since we use gorilla mux for our handers, we need to pass the request over to that
+	mux := newRouter()
+	mux.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if rr.Code != status {
+		t.Errorf("handler returned wrong status code for endpoint: %s: got %v want %v",
+			endpoint, rr.Code, status)
+	}
+}
+
+func TestGetRequestActor(t *testing.T) {
+	viper.Set("server.actor_header", "X-Forwarded-User")
+	defer viper.Set("server.allow_actor_param", false)
+
+	req := httptest.NewRequest("POST", getEndpoint("env/4f9f1afb29f1/stop?actor=param"), nil)
+	if actor := getRequestActor(req); actor != "" {
+		t.Errorf("the actor parameter was used without opt-in: %s", actor)
+	}
+	viper.Set("server.allow_actor_param", true)
+	if actor := getRequestActor(req); actor != "param" {
+		t.Errorf("the actor parameter was not used with opt-in: %s", actor)
+	}
+	if action := getRequestPowerAction(req, "4f9f1afb29f1", "stop"); action.ActorTrusted {
+		t.Error("the actor parameter must not be trusted")
+	}
+	req.Header.Set("X-Forwarded-User", "header")
+	if actor := getRequestActor(req); actor != "header" || getTrustedActor(req) != "header" {
+		t.Errorf("the header did not take precedence: %s", actor)
+	}
+	if action := getRequestPowerAction(req, "4f9f1afb29f1", "stop"); !action.ActorTrusted {
+		t.Error("the header must be trusted")
 	}
 }
@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// format of the usage bucket dates
+const usageDateFormat = "2006-01-02"
+
+var (
+	// values are set by ConfigInit
+	historyRetention time.Duration
+	historyFile      string
+
+	// recorded history of all environments
+	envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+	// last known state of all environments (by env ID), used to detect transitions
+	lastEnvStates = map[string]string{}
+	// lock to prevent concurrent access of the above history and states
+	envHistoryLock sync.Mutex
+)
+
+// stateTransition is a change of the state of an environment, detected during a poll
+type stateTransition struct {
+	EnvID   string    `json:"env_id"`
+	EnvName string    `json:"env_name"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Time    time.Time `json:"time"`
+}
+
+// envDailyUsage is the usage of an environment during a single day (UTC)
+type envDailyUsage struct {
+	Date    string `json:"date"`
+	EnvID   string `json:"env_id"`
+	EnvName string `json:"env_name"`
+	Region  string `json:"region"`
+	// hours during which at least one instance was running
+	RunningHours float64 `json:"running_hours"`
+	// sum of the running hours of all instances
+	InstanceHours float64 `json:"instance_hours"`
+	Cost          float64 `json:"cost"`
+	Saved         float64 `json:"saved"`
+}
+
+// envHistoryData holds the recorded transitions and usage
+type envHistoryData struct {
+	Transitions []stateTransition `json:"transitions"`
+	// by date and env ID (see usageKey)
+	Usage map[string]*envDailyUsage `json:"usage"`
+}
+
+// usageKey returns the key of a usage bucket
+func usageKey(date, envID string) string {
+	return date + "/" + envID
+}
+
+// recordEnvUsage adds the usage since the last poll to the bucket of the current day.
+// it is called while calculating the bills of an environment
+func recordEnvUsage(env environment, billed billingResult, now time.Time) {
+	envHistoryLock.Lock()
+	defer envHistoryLock.Unlock()
+
+	date := now.UTC().Format(usageDateFormat)
+	key := usageKey(date, env.ID)
+	usage, found := envHistory.Usage[key]
+	if !found {
+		usage = &envDailyUsage{Date: date, EnvID: env.ID}
+		envHistory.Usage[key] = usage
+	}
+	usage.EnvName = env.Name
+	usage.Region = env.Region
+	usage.Cost += billed.accrued
+	usage.Saved += billed.saved
+	usage.RunningHours += billed.runningHours
+	usage.InstanceHours += billed.instanceHours
+}
+
+// recordStateTransitions compares the state of all cached environments with their last known state.
+// environments seen for the first time do not create a transition
+func recordStateTransitions(now time.Time) {
+	envHistoryLock.Lock()
+	defer envHistoryLock.Unlock()
+
+	for _, env := range cachedTable {
+		previous, found := lastEnvStates[env.ID]
+		lastEnvStates[env.ID] = env.State
+		if !found || previous == env.State {
+			continue
+		}
+		log.Debugf("env %s [%s] changed state from %s to %s", env.Name, env.ID, previous, env.State)
+		envHistory.Transitions = append(envHistory.Transitions, stateTransition{
+			EnvID:   env.ID,
+			EnvName: env.Name,
+			From:    previous,
+			To:      env.State,
+			Time:    now,
+		})
+	}
+}
+
+// pruneHistory removes history older than the retention. envHistoryLock must be held
+func pruneHistory(now time.Time) {
+	if historyRetention <= 0 {
+		return
+	}
+	cutoff := now.Add(-historyRetention)
+	transitions := envHistory.Transitions[:0]
+	for _, t := range envHistory.Transitions {
+		if !t.Time.Before(cutoff) {
+			transitions = append(transitions, t)
+		}
+	}
+	envHistory.Transitions = transitions
+	cutoffDate := cutoff.UTC().Format(usageDateFormat)
+	for key, usage := range envHistory.Usage {
+		if usage.Date < cutoffDate {
+			delete(envHistory.Usage, key)
+		}
+	}
+}
+
+// getHistory returns a copy of the history between from (inclusive) and to (exclusive)
+func getHistory(from, to time.Time) (transitions []stateTransition, usage []envDailyUsage) {
+	envHistoryLock.Lock()
+	defer envHistoryLock.Unlock()
+
+	for _, t := range envHistory.Transitions {
+		if !t.Time.Before(from) && t.Time.Before(to) {
+			transitions = append(transitions, t)
+		}
+	}
+	fromDate := from.UTC().Format(usageDateFormat)
+	toDate := to.UTC().Format(usageDateFormat)
+	for _, u := range envHistory.Usage {
+		if u.Date >= fromDate && u.Date < toDate {
+			usage = append(usage, *u)
+		}
+	}
+	return
+}
+
+// getEnvCostSince returns the cost recorded for an environment since the day of from (UTC)
+func getEnvCostSince(envID string, from time.Time) (cost float64) {
+	envHistoryLock.Lock()
+	defer envHistoryLock.Unlock()
+
+	fromDate := from.UTC().Format(usageDateFormat)
+	for _, u := range envHistory.Usage {
+		if u.EnvID == envID && u.Date >= fromDate {
+			cost += u.Cost
+		}
+	}
+	return
+}
+
+// saveHistory prunes the history and writes it to the history file (if configured)
+func saveHistory(now time.Time) {
+	envHistoryLock.Lock()
+	defer envHistoryLock.Unlock()
+
+	pruneHistory(now)
+	if historyFile == "" {
+		return
+	}
+	data, err := json.Marshal(envHistory)
+	if err != nil {
+		log.Errorf("could not encode history: %v", err)
+		return
+	}
+	// write to a temporary file first, so the history is never left half written
+	if err = ioutil.WriteFile(historyFile+".tmp", data, 0600); err == nil {
+		err = os.Rename(historyFile+".tmp", historyFile)
+	}
+	if err != nil {
+		log.Errorf("could not save history: %v", err)
+	}
+}
+
+// loadHistory reads the history file (if configured)
+func loadHistory() {
+	if historyFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(historyFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var loaded envHistoryData
+	if err == nil {
+		err = json.Unmarshal(data, &loaded)
+	}
+	if err != nil {
+		log.Errorf("could not load history from %s: %v", historyFile, err)
+		return
+	}
+	if loaded.Usage == nil {
+		loaded.Usage = map[string]*envDailyUsage{}
+	}
+
+	envHistoryLock.Lock()
+	envHistory = loaded
+	envHistoryLock.Unlock()
+	log.Infof("loaded history: %d transition(s), %d usage record(s)", len(loaded.Transitions), len(loaded.Usage))
+}
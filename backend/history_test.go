@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnvHistory(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+	lastEnvStates = map[string]string{}
+	defer func() {
+		envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+		lastEnvStates = map[string]string{}
+	}()
+
+	// environments seen for the first time do not create a transition
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	recordStateTransitions(now)
+	if len(envHistory.Transitions) != 0 {
+		t.Fatalf("expected no transitions, got: %v", envHistory.Transitions)
+	}
+
+	envID := "4f9f1afb29f1"
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+	transitions, _ := getHistory(now.Add(-time.Hour), time.Now().Add(time.Hour))
+	if len(transitions) != 1 || transitions[0].EnvID != envID || transitions[0].To != EnvStateRunning {
+		t.Fatalf("expected a single transition of %s to running, got: %v", envID, transitions)
+	}
+
+	// usage is bucketed by day
+	env, _ := getEnvironmentByID(envID)
+	instances := float64(len(env.Instances))
+	recordEnvUsage(env, billingResult{accrued: 1.5, runningHours: 2, instanceHours: 2 * instances}, now)
+	recordEnvUsage(env, billingResult{accrued: 0.75, runningHours: 1, instanceHours: instances}, now.Add(time.Hour))
+	recordEnvUsage(env, billingResult{accrued: 0.75, runningHours: 1, instanceHours: instances}, now.AddDate(0, 0, 1))
+	_, usage := getHistory(now.Truncate(24*time.Hour), now.Truncate(24*time.Hour).AddDate(0, 0, 1))
+	if len(usage) != 1 {
+		t.Fatalf("expected a single usage record, got: %v", usage)
+	}
+	if usage[0].RunningHours != 3 || usage[0].Cost != 2.25 || usage[0].InstanceHours != 3*instances {
+		t.Errorf("unexpected usage: %+v", usage[0])
+	}
+
+	// history is persisted and pruned after the retention
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyFile = filepath.Join(dir, "history.json")
+	historyRetention = 24 * time.Hour
+	defer func() { historyFile = ""; historyRetention = 0 }()
+
+	saveHistory(now.AddDate(0, 0, 1))
+	envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+	loadHistory()
+	if len(envHistory.Usage) != 2 {
+		t.Errorf("expected 2 usage records after pruning, got: %d", len(envHistory.Usage))
+	}
+}
+
+func TestEnvHistoryWithoutBilling(t *testing.T) {
+	enabled := experimentalEnabled
+	experimentalEnabled = false
+	billingTimeline = map[string]*billingEntry{}
+	envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+	defer func() {
+		experimentalEnabled = enabled
+		billingTimeline = map[string]*billingEntry{}
+		envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}}
+	}()
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	for e := range cachedTable {
+		if cachedTable[e].ID == envID {
+			for i := range cachedTable[e].Instances {
+				cachedTable[e].Instances[i].State = "running"
+				cachedTable[e].Instances[i].PricingHourly = 0.5
+			}
+		}
+	}
+	updateEnvDetails()
+	calculateEnvBills()
+
+	// an hour later, the running time is recorded without any cost
+	for _, entry := range billingTimeline {
+		entry.billedUntil = entry.billedUntil.Add(-time.Hour)
+	}
+	calculateEnvBills()
+	_, usage := getHistory(time.Now().Add(-24*time.Hour), time.Now().Add(24*time.Hour))
+	var recorded *envDailyUsage
+	for i := range usage {
+		if usage[i].EnvID == envID {
+			recorded = &usage[i]
+		}
+	}
+	if recorded == nil || recorded.RunningHours < 0.99 || recorded.Cost != 0 {
+		t.Errorf("unexpected usage without billing: %+v", recorded)
+	}
+}
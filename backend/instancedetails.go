@@ -1,34 +1,121 @@
 package backend
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// aws bills storage per GB-month, which is 730 hours
+const hoursPerMonth = 730
 
 type awsInstanceTypeDetails struct {
 	InstanceType          string            `json:"instance_type"`
 	VCPU                  int               `json:"vCPU"`
 	MemoryGB              float32           `json:"memory"`
 	PricingHourlyByRegion map[string]string `json:"pricing"`
+	// pricing by region, operating system and purchase option (see the Platform and Purchase constants).
+	// linux on-demand pricing is taken from PricingHourlyByRegion when missing here
+	PricingByRegionOS map[string]map[string]map[string]string `json:"pricing_by_os,omitempty"`
+}
+
+type awsVolumeTypePricing struct {
+	VolumeType               string            `json:"volume_type"`
+	PricingGBMonthlyByRegion map[string]string `json:"pricing"`
 }
 
-var instanceTypeDetailsCache []awsInstanceTypeDetails
+var (
+	// instance type details by instance type
+	instanceTypeDetailsCache map[string]awsInstanceTypeDetails
+	// lock to prevent concurrent access of the above map (it can be refreshed at runtime)
+	instanceTypeDetailsLock sync.RWMutex
+	// instance type details of the embedded catalog, used as fallback
+	embeddedInstanceTypeDetails map[string]awsInstanceTypeDetails
+
+	volumeTypePricingCache []awsVolumeTypePricing
+)
 
+// loadAwsInstanceDetailsJSON loads the embedded catalog
 func loadAwsInstanceDetailsJSON() error {
-	return json.Unmarshal([]byte(awsInstanceTypeDetailsJSON), &instanceTypeDetailsCache)
+	if err := json.Unmarshal([]byte(awsVolumeTypePricingJSON), &volumeTypePricingCache); err != nil {
+		return err
+	}
+	details, err := parseInstanceTypeDetails([]byte(awsInstanceTypeDetailsJSON))
+	if err != nil {
+		return err
+	}
+	embeddedInstanceTypeDetails = details
+	instanceTypeDetailsLock.Lock()
+	instanceTypeDetailsCache = details
+	instanceTypeDetailsLock.Unlock()
+	return nil
 }
 
-func getInstanceTypeDetails(instanceType string) (typeDetails awsInstanceTypeDetails, found bool) {
-	for _, details := range instanceTypeDetailsCache {
-		if details.InstanceType == instanceType {
-			typeDetails = details
-			found = true
-			break
+// parseInstanceTypeDetails parses a catalog and indexes it by instance type
+func parseInstanceTypeDetails(data []byte) (map[string]awsInstanceTypeDetails, error) {
+	var list []awsInstanceTypeDetails
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("catalog does not contain any instance types")
+	}
+	details := make(map[string]awsInstanceTypeDetails, len(list))
+	for _, d := range list {
+		details[d.InstanceType] = d
+	}
+	return details, nil
+}
+
+// getVolumePricingHourly returns the hourly price of an EBS volume
+func getVolumePricingHourly(volumeType, region string, sizeGB int64) (pricing float64, found bool) {
+	for _, details := range volumeTypePricingCache {
+		if details.VolumeType != volumeType {
+			continue
+		}
+		pricingStr, ok := details.PricingGBMonthlyByRegion[region]
+		if !ok {
+			return
+		}
+		perGBMonth, err := strconv.ParseFloat(pricingStr, 64)
+		if err != nil {
+			log.Errorf("failed to parse pricing info to float: %s", pricingStr)
+			return
 		}
+		return perGBMonth * float64(sizeGB) / hoursPerMonth, true
 	}
 	return
 }
 
+func getInstanceTypeDetails(instanceType string) (typeDetails awsInstanceTypeDetails, found bool) {
+	instanceTypeDetailsLock.RLock()
+	defer instanceTypeDetailsLock.RUnlock()
+	typeDetails, found = instanceTypeDetailsCache[instanceType]
+	return
+}
+
+// getPricing returns the hourly price of the instance type for an operating system and purchase option
+func (d awsInstanceTypeDetails) getPricing(region, platform, purchaseOption string) (pricing float64, found bool) {
+	pricingStr, ok := d.PricingByRegionOS[region][platform][purchaseOption]
+	if !ok && platform == PlatformLinux && purchaseOption == PurchaseOnDemand {
+		pricingStr, ok = d.PricingHourlyByRegion[region]
+	}
+	if !ok {
+		return
+	}
+	pricing, err := strconv.ParseFloat(pricingStr, 64)
+	if err != nil {
+		log.Errorf("failed to parse pricing info to float: %s", pricingStr)
+		return
+	}
+	return pricing, true
+}
+
 // generated with command:
 // curl -s https://raw.githubusercontent.com/powdahound/ec2instances.info/master/www/instances.json | jq '.[] | {instance_type, vCPU, memory, pricing:.pricing | map_values(.linux|.ondemand) }' | jq -s .
 // the JSON has been simplified from the original version. pricing is for linux.ondemand ONLY
+// this catalog is used as fallback. a catalog generated from the AWS Pricing API (see cmd/pricing-catalog) can be loaded with pricing.source
 const awsInstanceTypeDetailsJSON = `
 [
   {
@@ -6012,3 +6099,160 @@ const awsInstanceTypeDetailsJSON = `
   }
 ]
 `
+
+// pricing of an elastic IP which is not associated with a running instance (all regions)
+const awsElasticIPIdlePricingHourly = 0.005
+
+// EBS volume pricing per GB-month, taken from https://aws.amazon.com/ebs/pricing/
+// provisioned IOPS and throughput are not included
+const awsVolumeTypePricingJSON = `
+[
+  {
+    "volume_type": "gp2",
+    "pricing": {
+      "ap-northeast-1": "0.12",
+      "ap-northeast-2": "0.114",
+      "ap-south-1": "0.114",
+      "ap-southeast-1": "0.12",
+      "ap-southeast-2": "0.12",
+      "ca-central-1": "0.11",
+      "eu-central-1": "0.119",
+      "eu-north-1": "0.1045",
+      "eu-west-1": "0.11",
+      "eu-west-2": "0.116",
+      "eu-west-3": "0.116",
+      "sa-east-1": "0.19",
+      "us-east-1": "0.1",
+      "us-east-2": "0.1",
+      "us-west-1": "0.12",
+      "us-west-2": "0.1"
+    }
+  },
+  {
+    "volume_type": "gp3",
+    "pricing": {
+      "ap-northeast-1": "0.096",
+      "ap-northeast-2": "0.0912",
+      "ap-south-1": "0.0912",
+      "ap-southeast-1": "0.096",
+      "ap-southeast-2": "0.096",
+      "ca-central-1": "0.088",
+      "eu-central-1": "0.0952",
+      "eu-north-1": "0.0836",
+      "eu-west-1": "0.088",
+      "eu-west-2": "0.0928",
+      "eu-west-3": "0.0928",
+      "sa-east-1": "0.152",
+      "us-east-1": "0.08",
+      "us-east-2": "0.08",
+      "us-west-1": "0.096",
+      "us-west-2": "0.08"
+    }
+  },
+  {
+    "volume_type": "io1",
+    "pricing": {
+      "ap-northeast-1": "0.142",
+      "ap-northeast-2": "0.1278",
+      "ap-south-1": "0.131",
+      "ap-southeast-1": "0.138",
+      "ap-southeast-2": "0.138",
+      "ca-central-1": "0.138",
+      "eu-central-1": "0.149",
+      "eu-north-1": "0.131",
+      "eu-west-1": "0.138",
+      "eu-west-2": "0.145",
+      "eu-west-3": "0.145",
+      "sa-east-1": "0.238",
+      "us-east-1": "0.125",
+      "us-east-2": "0.125",
+      "us-west-1": "0.138",
+      "us-west-2": "0.125"
+    }
+  },
+  {
+    "volume_type": "io2",
+    "pricing": {
+      "ap-northeast-1": "0.142",
+      "ap-northeast-2": "0.1278",
+      "ap-south-1": "0.131",
+      "ap-southeast-1": "0.138",
+      "ap-southeast-2": "0.138",
+      "ca-central-1": "0.138",
+      "eu-central-1": "0.149",
+      "eu-north-1": "0.131",
+      "eu-west-1": "0.138",
+      "eu-west-2": "0.145",
+      "eu-west-3": "0.145",
+      "sa-east-1": "0.238",
+      "us-east-1": "0.125",
+      "us-east-2": "0.125",
+      "us-west-1": "0.138",
+      "us-west-2": "0.125"
+    }
+  },
+  {
+    "volume_type": "st1",
+    "pricing": {
+      "ap-northeast-1": "0.054",
+      "ap-northeast-2": "0.051",
+      "ap-south-1": "0.051",
+      "ap-southeast-1": "0.054",
+      "ap-southeast-2": "0.054",
+      "ca-central-1": "0.05",
+      "eu-central-1": "0.054",
+      "eu-north-1": "0.0475",
+      "eu-west-1": "0.05",
+      "eu-west-2": "0.053",
+      "eu-west-3": "0.053",
+      "sa-east-1": "0.086",
+      "us-east-1": "0.045",
+      "us-east-2": "0.045",
+      "us-west-1": "0.054",
+      "us-west-2": "0.045"
+    }
+  },
+  {
+    "volume_type": "sc1",
+    "pricing": {
+      "ap-northeast-1": "0.018",
+      "ap-northeast-2": "0.0174",
+      "ap-south-1": "0.0174",
+      "ap-southeast-1": "0.018",
+      "ap-southeast-2": "0.018",
+      "ca-central-1": "0.0168",
+      "eu-central-1": "0.018",
+      "eu-north-1": "0.0159",
+      "eu-west-1": "0.0168",
+      "eu-west-2": "0.0174",
+      "eu-west-3": "0.0174",
+      "sa-east-1": "0.0288",
+      "us-east-1": "0.015",
+      "us-east-2": "0.015",
+      "us-west-1": "0.018",
+      "us-west-2": "0.015"
+    }
+  },
+  {
+    "volume_type": "standard",
+    "pricing": {
+      "ap-northeast-1": "0.08",
+      "ap-northeast-2": "0.08",
+      "ap-south-1": "0.08",
+      "ap-southeast-1": "0.08",
+      "ap-southeast-2": "0.08",
+      "ca-central-1": "0.055",
+      "eu-central-1": "0.059",
+      "eu-north-1": "0.05",
+      "eu-west-1": "0.055",
+      "eu-west-2": "0.058",
+      "eu-west-3": "0.058",
+      "sa-east-1": "0.12",
+      "us-east-1": "0.05",
+      "us-east-2": "0.05",
+      "us-west-1": "0.08",
+      "us-west-2": "0.05"
+    }
+  }
+]
+`
@@ -1,6 +1,7 @@
 package backend
 
 import (
+	"math"
 	"testing"
 )
 
@@ -28,4 +29,12 @@ func TestAwsInstanceDetails(t *testing.T) {
 			t.Errorf("for type: %s got %v, expected %v", iType, got, expected)
 		}
 	}
+
+	// test that we can get volume pricing
+	if pricing, found := getVolumePricingHourly("gp2", "us-east-1", 730); !found || math.Abs(pricing-0.1) > 0.0001 {
+		t.Errorf("unexpected gp2 pricing: %v %v", pricing, found)
+	}
+	if _, found := getVolumePricingHourly("gp2", "invalid-region", 100); found {
+		t.Error("expected no pricing for an invalid region")
+	}
 }
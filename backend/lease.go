@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// values are set by ConfigInit
+	leaseMaxTTL        time.Duration
+	leaseCheckInterval time.Duration
+	leaseReminders     []time.Duration
+
+	// active leases by env ID
+	envLeases = map[string]*envLease{}
+	// lock to prevent concurrent access of the above map
+	envLeasesLock sync.Mutex
+)
+
+// envLease is an automatic expiry for a started environment.
+// When it expires, the environment will be stopped by the lease watcher
+type envLease struct {
+	EnvID     string    `json:"env_id"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// reminders which have already been sent for this lease (by lead time)
+	remindersSent map[time.Duration]bool
+}
+
+// parseLeaseExpiry determines the lease expiry time from the request parameters.
+// ttl is a duration relative to base (ie. 90m, 2h) and until is an absolute RFC3339 timestamp.
+// found will be false if the request did not ask for a lease
+func parseLeaseExpiry(req *http.Request, base time.Time) (expiresAt time.Time, found bool, err error) {
+	ttl := req.FormValue("ttl")
+	until := req.FormValue("until")
+	found = ttl != "" || until != ""
+
+	switch {
+	case ttl != "" && until != "":
+		err = fmt.Errorf("ttl and until can not be used together")
+		return
+	case ttl != "":
+		duration, parseErr := time.ParseDuration(ttl)
+		if parseErr != nil || duration <= 0 {
+			err = fmt.Errorf("invalid ttl: %s", ttl)
+			return
+		}
+		expiresAt = base.Add(duration)
+	case until != "":
+		if expiresAt, err = time.Parse(time.RFC3339, until); err != nil {
+			err = fmt.Errorf("invalid until (expected RFC3339): %s", until)
+			return
+		}
+	default:
+		return
+	}
+
+	now := time.Now()
+	if !expiresAt.After(now) {
+		err = fmt.Errorf("lease expiry is in the past: %s", expiresAt.Format(time.RFC3339))
+	} else if leaseMaxTTL > 0 && expiresAt.Sub(now) > leaseMaxTTL {
+		err = fmt.Errorf("lease exceeds the maximum allowed ttl of %v", leaseMaxTTL)
+	}
+	return
+}
+
+// setEnvLease creates (or replaces) the lease for an environment
+func setEnvLease(envID, owner string, expiresAt time.Time) envLease {
+	envLeasesLock.Lock()
+	defer envLeasesLock.Unlock()
+
+	lease := &envLease{
+		EnvID:         envID,
+		Owner:         owner,
+		ExpiresAt:     expiresAt,
+		remindersSent: map[time.Duration]bool{},
+	}
+	envLeases[envID] = lease
+	log.Infof("lease for env [%s] set to expire at %s (owner: %s)", envID, expiresAt.Format(time.RFC3339), owner)
+	return *lease
+}
+
+// extendEnvLease moves the expiry of an existing lease.
+// reminders are re-armed since the expiry has changed
+func extendEnvLease(envID string, expiresAt time.Time) (lease envLease, found bool) {
+	envLeasesLock.Lock()
+	defer envLeasesLock.Unlock()
+
+	existing, found := envLeases[envID]
+	if !found {
+		return
+	}
+	existing.ExpiresAt = expiresAt
+	existing.remindersSent = map[time.Duration]bool{}
+	log.Infof("lease for env [%s] extended to %s", envID, expiresAt.Format(time.RFC3339))
+	return *existing, found
+}
+
+// deleteEnvLease removes the lease of an environment, if any
+func deleteEnvLease(envID string) (found bool) {
+	envLeasesLock.Lock()
+	defer envLeasesLock.Unlock()
+
+	if _, found = envLeases[envID]; found {
+		delete(envLeases, envID)
+		log.Infof("lease for env [%s] has been removed", envID)
+	}
+	return
+}
+
+// getEnvLease returns a copy of the lease for an environment
+func getEnvLease(envID string) (lease envLease, found bool) {
+	envLeasesLock.Lock()
+	defer envLeasesLock.Unlock()
+
+	if existing, ok := envLeases[envID]; ok {
+		lease, found = *existing, true
+	}
+	return
+}
+
+// checkLeases sends due reminders and stops environments with an expired lease
+func checkLeases(now time.Time) {
+	var expired []envLease
+	var reminders []envLease
+	var reminderLeads []time.Duration
+
+	envLeasesLock.Lock()
+	for _, lease := range envLeases {
+		if !now.Before(lease.ExpiresAt) {
+			expired = append(expired, *lease)
+			continue
+		}
+		// only send the closest due reminder, longer lead times are then considered sent
+		for _, lead := range leaseReminders {
+			if lease.remindersSent[lead] || now.Before(lease.ExpiresAt.Add(-lead)) {
+				continue
+			}
+			for _, l := range leaseReminders {
+				if l >= lead {
+					lease.remindersSent[l] = true
+				}
+			}
+			reminders = append(reminders, *lease)
+			reminderLeads = append(reminderLeads, lead)
+			break
+		}
+	}
+	envLeasesLock.Unlock()
+
+	for i, lease := range reminders {
+		env, found := getEnvironmentByID(lease.EnvID)
+		if !found {
+			continue
+		}
+		event := newEnvEvent(EventLeaseReminder, env)
+		event.Details = map[string]string{
+			"lease_owner": lease.Owner,
+			"remaining":   lease.ExpiresAt.Sub(now).Round(time.Minute).String(),
+			"expires_at":  lease.ExpiresAt.Format(time.RFC3339),
+		}
+		sendNotification(event)
+		log.Debugf("sent lease reminder for env [%s] (%v before expiry)", lease.EnvID, reminderLeads[i])
+	}
+
+	for _, lease := range expired {
+		expireEnvLease(lease)
+	}
+}
+
+// expireEnvLease stops the environment of an expired lease.
+// the lease is kept when the stop fails, so that it is retried on the next check. when the stop is refused
+// (ie. it requires approval or exceeds the safety limits), retrying would not help: the lease is removed and
+// the refusal is notified instead
+func expireEnvLease(lease envLease) {
+	env, found := getEnvironmentByID(lease.EnvID)
+	if !found || envReachedState(env, EnvStateStopped) {
+		log.Infof("lease for env [%s] expired but env is already stopped or gone", lease.EnvID)
+		deleteEnvLease(lease.EnvID)
+		return
+	}
+
+	log.Infof("lease for env %s [%s] expired at %s, stopping it", env.Name, lease.EnvID, lease.ExpiresAt.Format(time.RFC3339))
+	action := powerAction{
+		EnvID:  lease.EnvID,
+		Action: "stop",
+		Actor:  lease.Owner,
+		Source: ActionSourceLease,
+	}
+	// a successful stop is notified as lease_expired by performPowerAction
+	_, err := performPowerAction(action)
+	if err == nil {
+		return
+	}
+	if _, refused := err.(actionError); !refused {
+		log.Errorf("failed to stop env %s [%s] after lease expiry: %v", env.Name, lease.EnvID, err)
+		return
+	}
+	log.Warningf("stop of env %s [%s] after lease expiry was refused, removing the lease: %v", env.Name, lease.EnvID, err)
+	deleteEnvLease(lease.EnvID)
+	event := newEnvEvent(EventLeaseExpiryRefused, env)
+	event.Action = action.Action
+	event.Actor = action.Actor
+	event.Source = action.Source
+	event.Error = err.Error()
+	event.Details = map[string]string{"lease_owner": lease.Owner}
+	sendNotification(event)
+}
+
+// applyEnvLeases adds lease information to the cached environments
+func applyEnvLeases() {
+	for i := range cachedTable {
+		cachedTable[i].LeaseOwner = ""
+		cachedTable[i].LeaseExpiresAt = nil
+		if lease, found := getEnvLease(cachedTable[i].ID); found {
+			expiresAt := lease.ExpiresAt
+			cachedTable[i].LeaseOwner = lease.Owner
+			cachedTable[i].LeaseExpiresAt = &expiresAt
+		}
+	}
+}
+
+// parseLeaseReminders converts the configured reminder lead times to durations.
+// they are sorted from the shortest to the longest lead time
+func parseLeaseReminders(reminders []string) (leads []time.Duration) {
+	for _, r := range reminders {
+		lead, err := time.ParseDuration(r)
+		if err != nil || lead <= 0 {
+			log.Warningf("ignoring invalid lease reminder: %s", r)
+			continue
+		}
+		leads = append(leads, lead)
+	}
+	sort.Slice(leads, func(i, j int) bool { return leads[i] < leads[j] })
+	return
+}
+
+// StartLeaseWatcher is an infinite loop which periodically enforces environment leases
+func StartLeaseWatcher() {
+	interval := leaseCheckInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	log.Infof("start lease watcher with interval %v", interval)
+
+	t := time.Tick(interval)
+	for {
+		select {
+		case now := <-t:
+			checkLeases(now)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseLeaseExpiry(t *testing.T) {
+	leaseMaxTTL = 24 * time.Hour
+	base := time.Now()
+
+	for query, expectErr := range map[string]bool{
+		"?ttl=2h": false,
+		"?until=" + base.Add(time.Hour).UTC().Format(time.RFC3339): false,
+		"?ttl=invalid":                       true,
+		"?ttl=-1h":                           true,
+		"?ttl=48h":                           true,
+		"?until=2000-01-01T00:00:00Z":        true,
+		"?ttl=1h&until=2000-01-01T00:00:00Z": true,
+	} {
+		req, _ := http.NewRequest("POST", "/"+query, nil)
+		_, found, err := parseLeaseExpiry(req, base)
+		if !found {
+			t.Errorf("%s: lease was not detected", query)
+		}
+		if (err != nil) != expectErr {
+			t.Errorf("%s: expected error %v but got: %v", query, expectErr, err)
+		}
+	}
+
+	// no lease requested
+	req, _ := http.NewRequest("POST", "/", nil)
+	if _, found, err := parseLeaseExpiry(req, base); found || err != nil {
+		t.Errorf("unexpected lease found (%v) or error: %v", found, err)
+	}
+}
+
+func TestCheckLeases(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	leaseReminders = parseLeaseReminders([]string{"5m", "30m", "invalid"})
+	if len(leaseReminders) != 2 || leaseReminders[0] != 5*time.Minute {
+		t.Fatalf("unexpected lease reminders: %v", leaseReminders)
+	}
+
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+	expiresAt := time.Now().Add(time.Hour)
+	setEnvLease(envID, "tester", expiresAt)
+
+	// lease should be shown in the environment
+	updateEnvDetails()
+	env, _ := getEnvironmentByID(envID)
+	if env.LeaseOwner != "tester" || env.LeaseExpiresAt == nil || !env.LeaseExpiresAt.Equal(expiresAt) {
+		t.Errorf("lease is not reflected in env: %v %v", env.LeaseOwner, env.LeaseExpiresAt)
+	}
+
+	// only the closest reminder should be considered sent
+	checkLeases(expiresAt.Add(-10 * time.Minute))
+	lease, _ := getEnvLease(envID)
+	if !lease.remindersSent[30*time.Minute] || lease.remindersSent[5*time.Minute] {
+		t.Errorf("unexpected reminders sent: %v", lease.remindersSent)
+	}
+
+	// extending the lease should re-arm the reminders
+	expiresAt = expiresAt.Add(time.Hour)
+	if lease, found := extendEnvLease(envID, expiresAt); !found || len(lease.remindersSent) != 0 {
+		t.Errorf("lease was not extended properly: %v", lease)
+	}
+
+	// after expiry, the env should be stopped and the lease removed
+	var events []notificationEvent
+	notificationChannels = []notificationChannel{{Name: "all", notifier: testNotifier{&events}}}
+	defer func() { notificationChannels = nil }()
+	checkLeases(expiresAt)
+	updateEnvDetails()
+	if state, _ := getEnvState(envID); state != EnvStateStopped {
+		t.Errorf("env was not stopped after lease expiry: %s", state)
+	}
+	if _, found := getEnvLease(envID); found {
+		t.Error("lease was not removed after expiry")
+	}
+	// the stop is only notified once
+	if len(events) != 1 || events[0].Type != EventLeaseExpired || events[0].Details["lease_owner"] != "tester" {
+		t.Errorf("expected a single lease_expired event, got: %+v", events)
+	}
+}
+
+func TestExpireEnvLeaseRefused(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	var events []notificationEvent
+	notificationChannels = []notificationChannel{{Name: "all", notifier: testNotifier{&events}}}
+	approvalEnvironments = []string{"mockenv7"}
+	defer func() {
+		notificationChannels = nil
+		approvalEnvironments = nil
+	}()
+
+	// a stop which requires approval is refused: retrying would not help, so the lease is removed
+	expiresAt := time.Now()
+	setEnvLease(envID, "tester", expiresAt)
+	checkLeases(expiresAt)
+	updateEnvDetails()
+	if state, _ := getEnvState(envID); state != EnvStateRunning {
+		t.Errorf("expected the env to keep running, got: %s", state)
+	}
+	if _, found := getEnvLease(envID); found {
+		t.Error("lease was not removed after a refused stop")
+	}
+	if len(events) != 1 || events[0].Type != EventLeaseExpiryRefused || events[0].Error == "" {
+		t.Errorf("expected a lease_expiry_refused event, got: %+v", events)
+	}
+}
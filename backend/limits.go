@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// tag key suffixes used to override safety limits of an environment (see limits.tag_prefix)
+	limitTagMaxShutdown = "max-instances-to-shutdown"
+	limitTagMaxStartup  = "max-instances-to-startup"
+	limitTagMaxCost     = "max-hourly-cost-to-startup"
+)
+
+var (
+	// values are set by ConfigInit
+	maxInstancesToStartup  int
+	maxHourlyCostToStartup float64
+	confirmationWindow     time.Duration
+	limitTagPrefix         string
+	envLimitOverrides      []envLimitOverride
+
+	// confirmation tokens waiting to be sent back, by token
+	pendingConfirmations = map[string]actionConfirmation{}
+	// lock to prevent concurrent access of the above map
+	pendingConfirmationsLock sync.Mutex
+)
+
+// envLimits are the safety limits which apply to a power action.
+// a value of 0 means unlimited
+type envLimits struct {
+	MaxInstancesToShutdown int     `mapstructure:"max_instances_to_shutdown"`
+	MaxInstancesToStartup  int     `mapstructure:"max_instances_to_startup"`
+	MaxHourlyCostToStartup float64 `mapstructure:"max_hourly_cost_to_startup"`
+}
+
+// envLimitOverride sets the safety limits for environments matching a name pattern
+type envLimitOverride struct {
+	Environments []string `mapstructure:"environments"`
+	envLimits    `mapstructure:",squash"`
+}
+
+// actionConfirmation allows a power action over the limits to proceed once
+type actionConfirmation struct {
+	Token      string
+	EnvID      string
+	InstanceID string
+	Roles      string
+	Action     string
+	ExpiresAt  time.Time
+}
+
+// loadEnvLimitOverrides parses the per environment limits from the config file
+func loadEnvLimitOverrides() {
+	envLimitOverrides = nil
+	if err := viper.UnmarshalKey("limits.environments", &envLimitOverrides); err != nil {
+		log.Errorf("could not parse limits.environments from config: %v", err)
+	}
+}
+
+// getEnvLimits determines the safety limits of an environment.
+// tags on its members take precedence over the config file, which takes precedence over global limits.
+// when members have conflicting tag values, the lowest value is used
+func getEnvLimits(env environment) (limits envLimits) {
+	limits = envLimits{
+		MaxInstancesToShutdown: maxInstancesToShutdown,
+		MaxInstancesToStartup:  maxInstancesToStartup,
+		MaxHourlyCostToStartup: maxHourlyCostToStartup,
+	}
+
+	// first matching override from the config file
+	for _, override := range envLimitOverrides {
+		if matchesAnyPattern(env.Name, override.Environments) {
+			if override.MaxInstancesToShutdown > 0 {
+				limits.MaxInstancesToShutdown = override.MaxInstancesToShutdown
+			}
+			if override.MaxInstancesToStartup > 0 {
+				limits.MaxInstancesToStartup = override.MaxInstancesToStartup
+			}
+			if override.MaxHourlyCostToStartup > 0 {
+				limits.MaxHourlyCostToStartup = override.MaxHourlyCostToStartup
+			}
+			break
+		}
+	}
+
+	// tag overrides
+	if limitTagPrefix == "" {
+		return
+	}
+	tagged := envLimits{}
+	for _, instance := range env.Instances {
+		if v, err := strconv.Atoi(instance.Tags[limitTagPrefix+limitTagMaxShutdown]); err == nil && v > 0 {
+			if tagged.MaxInstancesToShutdown == 0 || v < tagged.MaxInstancesToShutdown {
+				tagged.MaxInstancesToShutdown = v
+			}
+		}
+		if v, err := strconv.Atoi(instance.Tags[limitTagPrefix+limitTagMaxStartup]); err == nil && v > 0 {
+			if tagged.MaxInstancesToStartup == 0 || v < tagged.MaxInstancesToStartup {
+				tagged.MaxInstancesToStartup = v
+			}
+		}
+		if v, err := strconv.ParseFloat(instance.Tags[limitTagPrefix+limitTagMaxCost], 64); err == nil && v > 0 {
+			if tagged.MaxHourlyCostToStartup == 0 || v < tagged.MaxHourlyCostToStartup {
+				tagged.MaxHourlyCostToStartup = v
+			}
+		}
+	}
+	if tagged.MaxInstancesToShutdown > 0 {
+		limits.MaxInstancesToShutdown = tagged.MaxInstancesToShutdown
+	}
+	if tagged.MaxInstancesToStartup > 0 {
+		limits.MaxInstancesToStartup = tagged.MaxInstancesToStartup
+	}
+	if tagged.MaxHourlyCostToStartup > 0 {
+		limits.MaxHourlyCostToStartup = tagged.MaxHourlyCostToStartup
+	}
+	return
+}
+
+// getActionImpact returns the amount of instances (including ASG members) and
+// their hourly cost which would be affected by a power action
+func getActionImpact(action powerAction) (instanceCount int, hourlyCost float64) {
+	env, found := getEnvironmentByID(action.EnvID)
+	if !found {
+		return
+	}
+	for _, instance := range env.Instances {
+		if (action.InstanceID != "" && instance.ID != action.InstanceID) || !hasRole(instance, action.Roles) {
+			continue
+		}
+		switch {
+		// protected instances are skipped when the whole environment is stopped
+		case action.Action == "stop" && instance.Protected && action.InstanceID == "":
+			continue
+		case action.Action == "stop" && instance.State == "running":
+			if instance.IsASG {
+				instanceCount += instance.ASGInstanceCount
+			} else {
+				instanceCount++
+			}
+		case action.Action == "start" && instance.State == "stopped":
+			if instance.IsASG {
+				instanceCount += int(getASGStartCapacity(instance))
+				hourlyCost += getASGHourlyCost(instance, true)
+			} else {
+				instanceCount++
+				hourlyCost += instance.PricingHourly
+			}
+		}
+	}
+	return
+}
+
+// getLimitViolation returns why a power action exceeds the safety limits of its environment,
+// it is empty when the action is within the limits
+func getLimitViolation(action powerAction) (env environment, reason string) {
+	env, found := getEnvironmentByID(action.EnvID)
+	if !found {
+		return
+	}
+	limits := getEnvLimits(env)
+	instanceCount, hourlyCost := getActionImpact(action)
+
+	switch {
+	case action.Action == "stop" && limits.MaxInstancesToShutdown > 0 && instanceCount > limits.MaxInstancesToShutdown:
+		reason = fmt.Sprintf("SAFETY: env %s [%s] has too many associated instances to shutdown %d (limit %d)", env.Name, env.ID, instanceCount, limits.MaxInstancesToShutdown)
+	case action.Action == "start" && limits.MaxInstancesToStartup > 0 && instanceCount > limits.MaxInstancesToStartup:
+		reason = fmt.Sprintf("SAFETY: env %s [%s] has too many associated instances to startup %d (limit %d)", env.Name, env.ID, instanceCount, limits.MaxInstancesToStartup)
+	case action.Action == "start" && limits.MaxHourlyCostToStartup > 0 && hourlyCost > limits.MaxHourlyCostToStartup:
+		reason = fmt.Sprintf("SAFETY: env %s [%s] startup would cost %.02f per hour (limit %.02f)", env.Name, env.ID, hourlyCost, limits.MaxHourlyCostToStartup)
+	}
+	return
+}
+
+// checkSafetyLimits is the hard backstop of the safety limits, enforced by shutdownEnv and startupEnv
+// for any caller. checkLimits adds the confirmation flow on top of it
+func checkSafetyLimits(envID, state string, roles []string) error {
+	if _, reason := getLimitViolation(powerAction{EnvID: envID, Action: state, Roles: roles}); reason != "" {
+		return errors.New(reason)
+	}
+	return nil
+}
+
+// checkLimits is an actionGuard which refuses power actions over the safety limits of an environment.
+// Actions requested through the API receive a confirmation token, which must be sent back
+// within the confirmation window to proceed
+func checkLimits(action powerAction) error {
+	env, reason := getLimitViolation(action)
+	if reason == "" {
+		return nil
+	}
+
+	// an approved action was already reviewed by a second user
+	if action.Approved {
+		log.Infof("%s of env %s [%s] over the safety limits was approved", action.Action, env.Name, env.ID)
+		return nil
+	}
+	if action.Confirm != "" && consumeConfirmation(action) {
+		log.Infof("%s of env %s [%s] over the safety limits was confirmed by '%s'", action.Action, env.Name, env.ID, action.Actor)
+		return nil
+	}
+
+	// automated actions can not be confirmed
+	if action.Source != ActionSourceAPI {
+		return actionError{Status: http.StatusConflict, Message: reason}
+	}
+	confirmation := createConfirmation(action)
+	return actionError{
+		Status:  http.StatusPreconditionRequired,
+		Message: reason,
+		Details: map[string]interface{}{
+			"confirmation_token":      confirmation.Token,
+			"confirmation_expires_at": confirmation.ExpiresAt.Format(time.RFC3339),
+		},
+	}
+}
+
+// createConfirmation issues a token for a power action over the limits
+func createConfirmation(action powerAction) actionConfirmation {
+	pendingConfirmationsLock.Lock()
+	defer pendingConfirmationsLock.Unlock()
+
+	// cleanup expired tokens
+	now := time.Now()
+	for token, c := range pendingConfirmations {
+		if !now.Before(c.ExpiresAt) {
+			delete(pendingConfirmations, token)
+		}
+	}
+
+	confirmation := actionConfirmation{
+		Token:      generateRandomID() + generateRandomID(),
+		EnvID:      action.EnvID,
+		InstanceID: action.InstanceID,
+		Roles:      strings.Join(action.Roles, ","),
+		Action:     action.Action,
+		ExpiresAt:  now.Add(confirmationWindow),
+	}
+	pendingConfirmations[confirmation.Token] = confirmation
+	return confirmation
+}
+
+// consumeConfirmation returns true if the action carries a valid confirmation token.
+// a token can only be used once
+func consumeConfirmation(action powerAction) bool {
+	pendingConfirmationsLock.Lock()
+	defer pendingConfirmationsLock.Unlock()
+
+	confirmation, found := pendingConfirmations[action.Confirm]
+	if !found {
+		return false
+	}
+	delete(pendingConfirmations, action.Confirm)
+	return time.Now().Before(confirmation.ExpiresAt) &&
+		confirmation.EnvID == action.EnvID &&
+		confirmation.InstanceID == action.InstanceID &&
+		confirmation.Roles == strings.Join(action.Roles, ",") &&
+		confirmation.Action == action.Action
+}
@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetEnvLimits(t *testing.T) {
+	maxInstancesToShutdown = 100
+	maxInstancesToStartup = 0
+	maxHourlyCostToStartup = 0
+	limitTagPrefix = "power-toggle-limit-"
+	envLimitOverrides = []envLimitOverride{
+		{Environments: []string{"perf-*"}, envLimits: envLimits{MaxInstancesToShutdown: 10, MaxHourlyCostToStartup: 5}},
+	}
+	defer func() { envLimitOverrides = nil }()
+
+	// global limits
+	if limits := getEnvLimits(environment{Name: "qa"}); limits.MaxInstancesToShutdown != 100 || limits.MaxHourlyCostToStartup != 0 {
+		t.Errorf("unexpected global limits: %+v", limits)
+	}
+
+	// config override
+	env := environment{Name: "perf-1"}
+	if limits := getEnvLimits(env); limits.MaxInstancesToShutdown != 10 || limits.MaxHourlyCostToStartup != 5 {
+		t.Errorf("unexpected config limits: %+v", limits)
+	}
+
+	// tag override, lowest value wins
+	env.Instances = []virtualMachine{
+		{Tags: map[string]string{"power-toggle-limit-max-instances-to-shutdown": "3"}},
+		{Tags: map[string]string{"power-toggle-limit-max-instances-to-shutdown": "2", "power-toggle-limit-max-instances-to-startup": "4"}},
+		{Tags: map[string]string{"power-toggle-limit-max-instances-to-shutdown": "invalid"}},
+	}
+	if limits := getEnvLimits(env); limits.MaxInstancesToShutdown != 2 || limits.MaxInstancesToStartup != 4 || limits.MaxHourlyCostToStartup != 5 {
+		t.Errorf("unexpected tag limits: %+v", limits)
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	// mockenv7 has 6 stopped instances
+	envID := "4f9f1afb29f1"
+	maxInstancesToShutdown = 5
+	maxInstancesToStartup = 5
+	confirmationWindow = time.Minute
+	defer func() {
+		maxInstancesToShutdown = 100
+		maxInstancesToStartup = 0
+	}()
+
+	start := powerAction{EnvID: envID, Action: "start", Source: ActionSourceAPI}
+	if count, _ := getActionImpact(start); count != 6 {
+		t.Fatalf("unexpected action impact: %d", count)
+	}
+
+	// over the limit, a confirmation token is returned
+	_, err := performPowerAction(start)
+	aErr, ok := err.(actionError)
+	if !ok || aErr.Status != http.StatusPreconditionRequired || aErr.Details["confirmation_token"] == "" {
+		t.Fatalf("expected a confirmation to be required, got: %v", err)
+	}
+	token := aErr.Details["confirmation_token"].(string)
+
+	// callers which bypass the guards are stopped by the backstop in startupEnv
+	if _, err := startupEnv(envID, false); err == nil {
+		t.Error("expected startupEnv to enforce the safety limits")
+	}
+	if env, _ := getEnvironmentByID(envID); env.State != EnvStateStopped {
+		t.Errorf("env was started over the safety limits: %s", env.State)
+	}
+
+	// a token can only be used for the same action
+	stop := powerAction{EnvID: envID, Action: "stop", Source: ActionSourceAPI, Confirm: token}
+	if err := checkLimits(stop); err != nil {
+		t.Errorf("stop should be within the limits while env is stopped: %v", err)
+	}
+	start.Confirm = token
+	if _, err := performPowerAction(start); err != nil {
+		t.Fatalf("confirmed action returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	// the token can not be reused
+	stop.Confirm = token
+	if err := checkLimits(stop); getStatusCode(err) != http.StatusPreconditionRequired {
+		t.Errorf("expected a confirmation to be required, got: %v", err)
+	}
+	if _, err := shutdownEnv(envID, false); err == nil {
+		t.Error("expected shutdownEnv to enforce the safety limits")
+	}
+
+	// automated actions can not be confirmed
+	stop.Source = ActionSourceLease
+	if err := checkLimits(stop); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected automated action to be refused, got: %v", err)
+	}
+
+	// expired tokens are refused
+	expired := createConfirmation(powerAction{EnvID: envID, Action: "stop"})
+	pendingConfirmations[expired.Token] = actionConfirmation{Token: expired.Token, EnvID: envID, Action: "stop", ExpiresAt: time.Now().Add(-time.Second)}
+	stop = powerAction{EnvID: envID, Action: "stop", Source: ActionSourceAPI, Confirm: expired.Token}
+	if err := checkLimits(stop); getStatusCode(err) != http.StatusPreconditionRequired {
+		t.Errorf("expected expired token to be refused, got: %v", err)
+	}
+}
+
+func TestLoadEnvLimitOverrides(t *testing.T) {
+	ConfigInit("../testdata/sampleconfig/power-toggle-config.yaml", false)
+	if len(envLimitOverrides) != 1 {
+		t.Fatalf("unexpected amount of limit overrides: %d", len(envLimitOverrides))
+	}
+	if override := envLimitOverrides[0]; override.MaxInstancesToShutdown != 200 || override.MaxHourlyCostToStartup != 25 || override.Environments[0] != "perf-*" {
+		t.Errorf("limit override was not parsed correctly: %+v", override)
+	}
+	envLimitOverrides = nil
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// values are set by ConfigInit
+	ownerTagKey       string
+	teamTagKey        string
+	descriptionTagKey string
+	linkTagKey        string
+	envMetadataConfig map[string]envMetadata
+)
+
+// envMetadata describes who an environment belongs to and what it is used for
+type envMetadata struct {
+	Owner       string   `mapstructure:"owner"`
+	Team        string   `mapstructure:"team"`
+	Description string   `mapstructure:"description"`
+	Links       []string `mapstructure:"links"`
+}
+
+// loadEnvMetadataConfig parses the environments map from the config file.
+// viper lowercases map keys, so environment names are matched case-insensitively
+func loadEnvMetadataConfig() {
+	envMetadataConfig = nil
+	if err := viper.UnmarshalKey("environments", &envMetadataConfig); err != nil {
+		log.Errorf("could not parse environments from config: %v", err)
+	}
+}
+
+// getMostCommonTagValue returns the value of a tag shared by the most members of an environment.
+// ties are resolved with the lowest value, so the result does not depend on the order of the members
+func getMostCommonTagValue(env environment, key string) (value string) {
+	if key == "" {
+		return
+	}
+	counts := map[string]int{}
+	for _, instance := range env.Instances {
+		if v := strings.TrimSpace(instance.Tags[key]); v != "" {
+			counts[v]++
+		}
+	}
+	for v, count := range counts {
+		if value == "" || count > counts[value] || (count == counts[value] && v < value) {
+			value = v
+		}
+	}
+	return
+}
+
+// getEnvMetadata determines the metadata of an environment.
+// tags on its members take precedence over the config file. links are merged from both (comma separated in tags)
+func getEnvMetadata(env environment) (metadata envMetadata) {
+	configured := envMetadataConfig[strings.ToLower(env.Name)]
+	metadata = envMetadata{
+		Owner:       getMostCommonTagValue(env, ownerTagKey),
+		Team:        getMostCommonTagValue(env, teamTagKey),
+		Description: getMostCommonTagValue(env, descriptionTagKey),
+	}
+	if metadata.Owner == "" {
+		metadata.Owner = configured.Owner
+	}
+	if metadata.Team == "" {
+		metadata.Team = configured.Team
+	}
+	if metadata.Description == "" {
+		metadata.Description = configured.Description
+	}
+
+	links := map[string]bool{}
+	for _, link := range configured.Links {
+		links[link] = true
+	}
+	if linkTagKey != "" {
+		for _, instance := range env.Instances {
+			for _, link := range splitQueryValues([]string{instance.Tags[linkTagKey]}) {
+				links[link] = true
+			}
+		}
+	}
+	for link := range links {
+		metadata.Links = append(metadata.Links, link)
+	}
+	sort.Strings(metadata.Links)
+	return
+}
+
+// applyEnvMetadata adds owner, team, description and links to the cached environments
+func applyEnvMetadata() {
+	for i := range cachedTable {
+		metadata := getEnvMetadata(cachedTable[i])
+		cachedTable[i].Owner = metadata.Owner
+		cachedTable[i].Team = metadata.Team
+		cachedTable[i].Description = metadata.Description
+		cachedTable[i].Links = metadata.Links
+	}
+}
@@ -0,0 +1,42 @@
+package backend
+
+import (
+	"testing"
+)
+
+func TestGetEnvMetadata(t *testing.T) {
+	ownerTagKey = "Owner"
+	teamTagKey = "Team"
+	descriptionTagKey = "Description"
+	linkTagKey = "power-toggle-link"
+	envMetadataConfig = map[string]envMetadata{
+		"qa": {Owner: "ops@example.com", Team: "ops", Description: "qa environment", Links: []string{"https://wiki.example.com/qa"}},
+	}
+	defer func() {
+		ownerTagKey, teamTagKey, descriptionTagKey, linkTagKey = "", "", "", ""
+		envMetadataConfig = nil
+	}()
+
+	env := environment{Name: "QA", Instances: []virtualMachine{
+		{Tags: map[string]string{"Owner": "bob", "Team": "dev", "power-toggle-link": "https://grafana.example.com/qa"}},
+		{Tags: map[string]string{"Owner": "alice", "Team": "qa"}},
+		{Tags: map[string]string{"Owner": "alice", "power-toggle-link": "https://ci.example.com, https://grafana.example.com/qa"}},
+	}}
+	metadata := getEnvMetadata(env)
+	// the most common tag value wins, ties are resolved with the lowest value
+	if metadata.Owner != "alice" || metadata.Team != "dev" {
+		t.Errorf("unexpected owner and team: %+v", metadata)
+	}
+	// the config file is used when no member is tagged
+	if metadata.Description != "qa environment" {
+		t.Errorf("expected the description of the config file, got: %s", metadata.Description)
+	}
+	expectedLinks := []string{"https://ci.example.com", "https://grafana.example.com/qa", "https://wiki.example.com/qa"}
+	if !equalStrings(metadata.Links, expectedLinks) {
+		t.Errorf("expected links %v, got %v", expectedLinks, metadata.Links)
+	}
+
+	if metadata = getEnvMetadata(environment{Name: "dev"}); metadata.Owner != "" || len(metadata.Links) != 0 {
+		t.Errorf("expected no metadata, got: %+v", metadata)
+	}
+}
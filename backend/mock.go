@@ -13,7 +13,7 @@ import (
 var unitTestRunning = false
 
 // mock of shutdownEnv
-func mockShutdownEnv(envID string) (response []byte, err error) {
+func mockShutdownEnv(envID string, roles ...string) (response []byte, err error) {
 	// introduce delays and possible error
 	err = mockDelayWithPossibleError()
 	if err != nil {
@@ -21,16 +21,16 @@ func mockShutdownEnv(envID string) (response []byte, err error) {
 		log.Errorf("mock error envID: %s: %s", envID, err)
 		return
 	}
-	instanceIds := getInstanceIDs(envID, "running")
-	if len(instanceIds) > maxInstancesToShutdown {
-		err = fmt.Errorf("SAFETY: env [%s] has too many associated instances to shutdown %d", envID, len(instanceIds))
-		log.Debugf("SAFETY: instances: %v", instanceIds)
-	} else if len(instanceIds) > 0 {
-		// set all instances to stopped
+	// safety limits are enforced by shutdownEnv before calling this mock
+	instanceIds := getInstanceIDs(envID, "running", true, roles...)
+	if len(instanceIds) > 0 {
+		// set all instances (with the roles) to stopped, except protected ones
 		for e, env := range cachedTable {
 			if env.ID == envID {
 				for i := range cachedTable[e].Instances {
-					cachedTable[e].Instances[i].State = "stopped"
+					if !cachedTable[e].Instances[i].Protected && hasRole(cachedTable[e].Instances[i], roles) {
+						cachedTable[e].Instances[i].State = "stopped"
+					}
 				}
 				break
 			}
@@ -49,7 +49,7 @@ func mockShutdownEnv(envID string) (response []byte, err error) {
 }
 
 // mock of startupEnv
-func mockStartupEnv(envID string) (response []byte, err error) {
+func mockStartupEnv(envID string, roles ...string) (response []byte, err error) {
 	// introduce delays and possible error
 	err = mockDelayWithPossibleError()
 	if err != nil {
@@ -57,13 +57,15 @@ func mockStartupEnv(envID string) (response []byte, err error) {
 		log.Errorf("mock error envID: %s: %s", envID, err)
 		return
 	}
-	instanceIds := getInstanceIDs(envID, "stopped")
+	instanceIds := getInstanceIDs(envID, "stopped", false, roles...)
 	if len(instanceIds) > 0 {
-		// set all instances to running
+		// set all instances (with the roles) to running
 		for e, env := range cachedTable {
 			if env.ID == envID {
 				for i := range cachedTable[e].Instances {
-					cachedTable[e].Instances[i].State = "running"
+					if hasRole(cachedTable[e].Instances[i], roles) {
+						cachedTable[e].Instances[i].State = "running"
+					}
 				}
 				break
 			}
@@ -2,7 +2,6 @@ package backend
 
 import (
 	"encoding/json"
-	"strconv"
 )
 
 // mock of refreshTable
@@ -23,7 +22,6 @@ func mockRefreshTable() (err error) {
 	}
 
 	if experimentalEnabled {
-		calculateEnvBills()
 		cachedTableTemp := cachedTable
 		cachedTable = cachedTable[:0]
 		for _, env := range cachedTableTemp {
@@ -32,14 +30,8 @@ func mockRefreshTable() (err error) {
 				if details, found := getInstanceTypeDetails(instanceObj.InstanceType); found {
 					instanceObj.MemoryGB = details.MemoryGB
 					instanceObj.VCPU = details.VCPU
-					if pricingstr, ok := details.PricingHourlyByRegion[instanceObj.Region]; ok {
-						pricing, err := strconv.ParseFloat(pricingstr, 64)
-						if err != nil {
-							log.Errorf("failed to parse pricing info to float: %s", pricingstr)
-						}
-						instanceObj.PricingHourly = pricing
-					}
 				}
+				applyInstancePricing(&instanceObj)
 				if validateEnvName(instanceObj.Environment) {
 					addInstance(&instanceObj)
 				}
@@ -48,6 +40,8 @@ func mockRefreshTable() (err error) {
 	}
 
 	updateEnvDetails()
+	// calculate usage (and billing information when enabled) with the new states
+	calculateEnvBills()
 	log.Debugf("MOCK: valid environment(s) in cache: %d", len(cachedTable))
 	return
 }
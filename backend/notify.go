@@ -0,0 +1,523 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defines notification event types
+
+	// EventEnvStarted is sent when an environment was started
+	EventEnvStarted = "env_started"
+	// EventEnvStopped is sent when an environment was stopped
+	EventEnvStopped = "env_stopped"
+	// EventEnvStartFailed is sent when starting an environment returned an error
+	EventEnvStartFailed = "env_start_failed"
+	// EventEnvStopFailed is sent when stopping an environment returned an error
+	EventEnvStopFailed = "env_stop_failed"
+	// EventInstanceStarted is sent when a single instance was started
+	EventInstanceStarted = "instance_started"
+	// EventInstanceStopped is sent when a single instance was stopped
+	EventInstanceStopped = "instance_stopped"
+	// EventInstanceStartFailed is sent when starting a single instance returned an error
+	EventInstanceStartFailed = "instance_start_failed"
+	// EventInstanceStopFailed is sent when stopping a single instance returned an error
+	EventInstanceStopFailed = "instance_stop_failed"
+	// EventLeaseReminder is sent before a lease expires
+	EventLeaseReminder = "lease_reminder"
+	// EventLeaseExpired is sent when an environment was stopped because its lease expired
+	EventLeaseExpired = "lease_expired"
+	// EventLeaseExpiryRefused is sent when the stop of an expired lease was refused, the lease is removed
+	EventLeaseExpiryRefused = "lease_expiry_refused"
+	// EventApprovalRequired is sent when a stop is waiting for approval
+	EventApprovalRequired = "approval_required"
+	// EventApprovalDecided is sent when an approval was approved or rejected
+	EventApprovalDecided = "approval_decided"
+	// EventApprovalExpired is sent when no decision was made before the approval timeout
+	EventApprovalExpired = "approval_expired"
+
+	// defines notification channel types
+	channelTypeSlack   = "slack"
+	channelTypeTeams   = "teams"
+	channelTypeWebhook = "webhook"
+	channelTypeEmail   = "email"
+
+	// header which holds the HMAC-SHA256 signature of generic webhook requests
+	webhookSignatureHeader = "X-Power-Toggle-Signature"
+	// header which holds the event type of generic webhook requests
+	webhookEventHeader = "X-Power-Toggle-Event"
+)
+
+var (
+	// values are set by ConfigInit
+	notificationChannels []notificationChannel
+
+	// http client used by notifiers other than slack
+	notificationClient = createHTTPClient()
+	// can be replaced in tests to avoid sending real emails
+	smtpSendMail = smtp.SendMail
+)
+
+// notificationEvent is a structured description of something that happened.
+// every notifier renders it in its own format
+type notificationEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action,omitempty"`
+	EnvID      string    `json:"env_id,omitempty"`
+	EnvName    string    `json:"env_name,omitempty"`
+	Region     string    `json:"region,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	Team       string    `json:"team,omitempty"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	// amount of affected instances and their resources
+	InstanceCount int     `json:"instance_count,omitempty"`
+	VCPU          int     `json:"vcpu,omitempty"`
+	MemoryGB      float32 `json:"memory_gb,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	// event specific values (ie. lease_owner, approval_id)
+	Details map[string]string `json:"details,omitempty"`
+
+	// state of the environment, used by message templates
+	env environment
+}
+
+// notifier delivers events to a single destination
+type notifier interface {
+	notify(event notificationEvent) error
+}
+
+// notificationChannel is a notifier which only receives matching events
+type notificationChannel struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+	// environment name patterns, all environments when empty
+	Environments []string `mapstructure:"environments"`
+	// team patterns, all teams when empty
+	Teams []string `mapstructure:"teams"`
+	// event types, all events when empty
+	Events []string `mapstructure:"events"`
+	// message templates by event type, these take precedence over notifications.templates
+	Templates map[string]string `mapstructure:"templates"`
+
+	// slack, teams and webhook settings
+	URL    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+
+	// email settings
+	SMTPHost string   `mapstructure:"smtp_host"`
+	SMTPPort int      `mapstructure:"smtp_port"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+	// also send the email to the owner of the environment (when it is an email address)
+	NotifyOwner bool `mapstructure:"notify_owner"`
+
+	notifier notifier
+}
+
+// matches returns true if the channel should receive the event
+func (c notificationChannel) matches(event notificationEvent) bool {
+	if len(c.Events) > 0 && !stringInSlice(event.Type, c.Events) {
+		return false
+	}
+	if len(c.Teams) > 0 && !matchesAnyPattern(event.Team, c.Teams) {
+		return false
+	}
+	return len(c.Environments) == 0 || matchesAnyPattern(event.EnvName, c.Environments)
+}
+
+// createNotifier returns the notifier for the configured channel type
+func (c notificationChannel) createNotifier() (notifier, error) {
+	switch c.Type {
+	case channelTypeSlack, channelTypeTeams, channelTypeWebhook:
+		if c.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+	}
+	// like the global templates, an invalid template is ignored so its events fall back to the default message
+	templates, err := parseMessageTemplates(c.Templates)
+	if err != nil {
+		log.Errorf("could not parse templates of notification channel %s: %v", c.Name, err)
+	}
+	switch c.Type {
+	case channelTypeSlack:
+		return slackNotifier{webhookURL: c.URL, templates: templates}, nil
+	case channelTypeTeams:
+		return teamsNotifier{webhookURL: c.URL, templates: templates}, nil
+	case channelTypeWebhook:
+		return webhookNotifier{url: c.URL, secret: c.Secret}, nil
+	case channelTypeEmail:
+		if c.SMTPHost == "" || c.From == "" || (len(c.To) == 0 && !c.NotifyOwner) {
+			return nil, fmt.Errorf("smtp_host, from and to (or notify_owner) are required")
+		}
+		port := c.SMTPPort
+		if port == 0 {
+			port = 25
+		}
+		return emailNotifier{
+			addr:        fmt.Sprintf("%s:%d", c.SMTPHost, port),
+			host:        c.SMTPHost,
+			username:    c.Username,
+			password:    c.Password,
+			from:        c.From,
+			to:          c.To,
+			notifyOwner: c.NotifyOwner,
+			templates:   templates,
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid channel type: %s", c.Type)
+}
+
+// loadNotificationChannels parses the notification channels from the config file.
+// the legacy slack webhook urls are added as channels which receive all events
+func loadNotificationChannels() {
+	var configured []notificationChannel
+	if err := viper.UnmarshalKey("notifications.channels", &configured); err != nil {
+		log.Errorf("could not parse notifications.channels from config: %v", err)
+	}
+	if slackEnabled {
+		for i, hookURL := range slackWebHooks {
+			configured = append(configured, notificationChannel{Name: fmt.Sprintf("slack-%d", i+1), Type: channelTypeSlack, URL: hookURL})
+		}
+	}
+
+	notificationChannels = nil
+	for i, c := range configured {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s-%d", c.Type, i+1)
+		}
+		n, err := c.createNotifier()
+		if err != nil {
+			log.Errorf("ignoring invalid notification channel %s: %v", c.Name, err)
+			continue
+		}
+		c.notifier = n
+		notificationChannels = append(notificationChannels, c)
+	}
+}
+
+// sendNotification queues the event for all matching channels.
+// when the notification workers are not running, the event is delivered right away (without retries)
+func sendNotification(event notificationEvent) (errs []error) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, c := range notificationChannels {
+		if !c.matches(event) {
+			continue
+		}
+		d := &notificationDelivery{
+			ID:        generateRandomID(),
+			Channel:   c.Name,
+			Event:     event,
+			CreatedAt: time.Now(),
+		}
+		if isNotificationQueueRunning() {
+			spoolDelivery(d)
+			enqueueDelivery(d)
+			continue
+		}
+		if err := attemptDelivery(d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+// newEnvEvent returns an event which describes the environment
+func newEnvEvent(eventType string, env environment) notificationEvent {
+	return notificationEvent{
+		Type:          eventType,
+		EnvID:         env.ID,
+		EnvName:       env.Name,
+		Region:        env.Region,
+		Owner:         env.Owner,
+		Team:          env.Team,
+		InstanceCount: env.TotalInstances,
+		VCPU:          env.TotalVCPU,
+		MemoryGB:      env.TotalMemoryGB,
+		env:           env,
+	}
+}
+
+// notifyPowerAction sends the outcome of a power action.
+// env is the state of the environment before the action
+func notifyPowerAction(action powerAction, env environment, err error) {
+	event := newEnvEvent("", env)
+	event.Action = action.Action
+	event.Actor = action.Actor
+	event.Source = action.Source
+
+	scope := "env"
+	if action.InstanceID != "" {
+		scope = "instance"
+		event.InstanceID = action.InstanceID
+		event.InstanceCount, event.VCPU, event.MemoryGB = 0, 0, 0
+		for _, instance := range env.Instances {
+			if instance.ID == action.InstanceID {
+				event.InstanceCount, event.VCPU, event.MemoryGB = 1, instance.VCPU, instance.MemoryGB
+				event.Details = map[string]string{"instance_name": instance.Name}
+			}
+		}
+	}
+	if len(action.Roles) > 0 {
+		// only the instances with these roles were toggled
+		event.InstanceCount, event.VCPU, event.MemoryGB = 0, 0, 0
+		for _, instance := range env.Instances {
+			if hasRole(instance, action.Roles) {
+				event.InstanceCount++
+				event.VCPU += instance.VCPU
+				event.MemoryGB += instance.MemoryGB
+			}
+		}
+		event.Details = map[string]string{"roles": strings.Join(action.Roles, ",")}
+	}
+	switch {
+	case err != nil:
+		event.Type = fmt.Sprintf("%s_%s_failed", scope, action.Action)
+		event.Error = err.Error()
+	case action.Source == ActionSourceLease && action.Action == "stop":
+		// the stop of an expired lease is only notified once
+		event.Type = EventLeaseExpired
+		event.Details = map[string]string{"lease_owner": action.Actor}
+	default:
+		event.Type = fmt.Sprintf("%s_%s", scope, map[string]string{"start": "started", "stop": "stopped"}[action.Action])
+	}
+	sendNotification(event)
+}
+
+// eventMarkup defines how text is emphasized by a channel
+type eventMarkup struct {
+	bold, code, italic string
+}
+
+var (
+	slackMarkup = eventMarkup{bold: "*", code: "`", italic: "_"}
+	teamsMarkup = eventMarkup{bold: "**", code: "`", italic: "_"}
+	plainMarkup = eventMarkup{}
+)
+
+// eventTitle returns a short summary of the event (ie. STOPPING)
+func eventTitle(event notificationEvent) string {
+	switch event.Type {
+	case EventEnvStarted, EventInstanceStarted:
+		return "STARTING"
+	case EventEnvStopped, EventInstanceStopped:
+		return "STOPPING"
+	case EventEnvStartFailed, EventInstanceStartFailed:
+		return "ERROR STARTING"
+	case EventEnvStopFailed, EventInstanceStopFailed:
+		return "ERROR STOPPING"
+	case EventApprovalDecided:
+		return "APPROVAL " + strings.ToUpper(event.Details["status"])
+	}
+	return strings.ToUpper(strings.Replace(event.Type, "_", " ", -1))
+}
+
+// eventText renders the event as a single line of text
+func eventText(event notificationEvent, m eventMarkup) string {
+	b := func(s string) string { return m.bold + s + m.bold }
+	target := fmt.Sprintf("environment %s in region %s", b(m.code+event.EnvName+m.code), m.italic+event.Region+m.italic)
+	if event.InstanceID != "" {
+		name := event.Details["instance_name"]
+		if name == "" {
+			name = event.InstanceID
+		}
+		target = fmt.Sprintf("instance %s of %s", b(m.code+name+m.code), target)
+	}
+	by := ""
+	if event.Actor != "" {
+		by = fmt.Sprintf(" (by %s)", event.Actor)
+	}
+
+	var text string
+	switch event.Type {
+	case EventEnvStarted, EventEnvStopped, EventInstanceStarted, EventInstanceStopped:
+		text = fmt.Sprintf(
+			"%s --> %s totaling %s & %s memory%s",
+			target,
+			b(fmt.Sprintf("%v instance(s)", event.InstanceCount)),
+			b(fmt.Sprintf("%v vCPU(s)", event.VCPU)),
+			b(fmt.Sprintf("%vGB", event.MemoryGB)),
+			by,
+		)
+	case EventEnvStartFailed, EventEnvStopFailed, EventInstanceStartFailed, EventInstanceStopFailed:
+		text = fmt.Sprintf("%s --> %s%s", target, m.code+event.Error+m.code, by)
+	case EventLeaseReminder:
+		text = fmt.Sprintf("%s will be stopped in %s (lease owner: %s)", target, b(event.Details["remaining"]), event.Details["lease_owner"])
+	case EventLeaseExpired:
+		text = fmt.Sprintf("%s has been stopped (lease owner: %s)", target, event.Details["lease_owner"])
+	case EventLeaseExpiryRefused:
+		text = fmt.Sprintf("%s was not stopped, its lease has been removed (lease owner: %s)", target, event.Details["lease_owner"])
+	case EventApprovalRequired:
+		text = fmt.Sprintf(
+			"to %s %s --> requested by %s, approval id %s expires in %s",
+			event.Action,
+			target,
+			b(event.Actor),
+			m.code+event.Details["approval_id"]+m.code,
+			event.Details["expires_in"],
+		)
+	case EventApprovalDecided:
+		text = fmt.Sprintf("to %s %s requested by %s --> decided by %s", event.Action, target, b(event.Details["requester"]), b(event.Actor))
+	case EventApprovalExpired:
+		text = fmt.Sprintf("to %s %s requested by %s", event.Action, target, b(event.Details["requester"]))
+	case EventBudgetThreshold:
+		text = fmt.Sprintf(
+			"%s has used %s of its monthly budget --> spent %s of %s, forecast %s",
+			target,
+			b(event.Details["threshold"]),
+			b(event.Details["spent"]),
+			event.Details["budget"],
+			event.Details["forecast"],
+		)
+	case EventCostReport:
+		text = fmt.Sprintf(
+			"%s to %s --> %s running hours costing %s, saved %s. top offenders: %s",
+			event.Details["from"],
+			event.Details["to"],
+			b(event.Details["running_hours"]),
+			b(event.Details["cost"]),
+			b(event.Details["saved"]),
+			event.Details["top_offenders"],
+		)
+		return fmt.Sprintf("%s %s", b(strings.ToUpper(event.Details["period"])+" COST REPORT"), text)
+	default:
+		text = target + by
+	}
+	if event.Error != "" && !strings.Contains(text, event.Error) {
+		text = fmt.Sprintf("%s --> %s", text, m.code+event.Error+m.code)
+	}
+	return fmt.Sprintf("%s %s", b(eventTitle(event)), text)
+}
+
+// isFailureEvent returns true for events which report an error
+func isFailureEvent(event notificationEvent) bool {
+	return event.Error != "" || strings.HasSuffix(event.Type, "_failed")
+}
+
+// postJSON sends a json body and expects a 2xx response
+func postJSON(client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("response code was not successful: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// teamsNotifier sends events to a Microsoft Teams incoming webhook.
+// templates which render json are sent as is (ie. adaptive cards)
+type teamsNotifier struct {
+	webhookURL string
+	templates  map[string]*template.Template
+}
+
+func (n teamsNotifier) notify(event notificationEvent) error {
+	message := renderMessage(event, teamsMarkup, n.templates)
+	if isJSONMessage(message) {
+		return postJSON(notificationClient, n.webhookURL, []byte(message), nil)
+	}
+	color := "2EB886"
+	if isFailureEvent(event) {
+		color = "D00000"
+	}
+	body, _ := json.Marshal(map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "http://schema.org/extensions",
+		"summary":    eventTitle(event),
+		"themeColor": color,
+		"text":       message,
+	})
+	return postJSON(notificationClient, n.webhookURL, body, nil)
+}
+
+// webhookNotifier sends events as json to a generic webhook.
+// when a secret is set, the body is signed with HMAC-SHA256
+type webhookNotifier struct {
+	url    string
+	secret string
+}
+
+func (n webhookNotifier) notify(event notificationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{webhookEventHeader: event.Type}
+	if n.secret != "" {
+		headers[webhookSignatureHeader] = "sha256=" + signPayload(n.secret, body)
+	}
+	return postJSON(notificationClient, n.url, body, headers)
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emailNotifier sends events as plain text emails
+type emailNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+	// see notificationChannel.NotifyOwner
+	notifyOwner bool
+	templates   map[string]*template.Template
+}
+
+func (n emailNotifier) notify(event notificationEvent) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	to := n.to
+	if n.notifyOwner && strings.Contains(event.Owner, "@") && !stringInSlice(event.Owner, to) {
+		to = append(append([]string{}, to...), event.Owner)
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	subject := fmt.Sprintf("[aws-power-toggle] %s %s", eventTitle(event), event.EnvName)
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		n.from,
+		strings.Join(to, ", "),
+		subject,
+		event.Time.Format(time.RFC1123Z),
+		renderMessage(event, plainMarkup, n.templates),
+	)
+	return smtpSendMail(n.addr, auth, n.from, to, []byte(msg))
+}
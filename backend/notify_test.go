@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// testNotifier records all events it receives
+type testNotifier struct {
+	events *[]notificationEvent
+}
+
+func (n testNotifier) notify(event notificationEvent) error {
+	*n.events = append(*n.events, event)
+	return nil
+}
+
+func TestLoadNotificationChannels(t *testing.T) {
+	viper.Set("notifications.channels", []map[string]interface{}{
+		{"name": "ops", "type": "teams", "url": "https://teams.example.com", "environments": []string{"prod-*"},
+			"templates": map[string]string{EventEnvStopped: "{{ .Env.Name ", templateKeyDefault: "{{ .Text }}"}},
+		{"type": "webhook", "url": "https://hooks.example.com", "secret": "s3cr3t", "events": []string{EventEnvStopped}},
+		{"type": "email", "smtp_host": "smtp.example.com", "from": "toggle@example.com", "to": []string{"ops@example.com"}},
+		{"name": "invalid", "type": "pager"},
+		{"name": "no-url", "type": "slack"},
+	})
+	defer viper.Set("notifications.channels", nil)
+	slackEnabled = true
+	slackWebHooks = []string{"https://slack.example.com"}
+	defer func() { slackEnabled = false; loadNotificationChannels() }()
+
+	loadNotificationChannels()
+	if len(notificationChannels) != 4 {
+		t.Fatalf("expected 4 valid channels but got %d", len(notificationChannels))
+	}
+	for i, expected := range []string{"ops", "webhook-2", "email-3", "slack-1"} {
+		if notificationChannels[i].Name != expected {
+			t.Errorf("expected channel %s but got %s", expected, notificationChannels[i].Name)
+		}
+	}
+	if email, ok := notificationChannels[2].notifier.(emailNotifier); !ok || email.addr != "smtp.example.com:25" {
+		t.Errorf("unexpected email notifier: %v", notificationChannels[2].notifier)
+	}
+	// an invalid template is ignored, the other templates of the channel are kept
+	if teams, ok := notificationChannels[0].notifier.(teamsNotifier); !ok || len(teams.templates) != 1 || teams.templates[templateKeyDefault] == nil {
+		t.Errorf("unexpected teams notifier templates: %v", notificationChannels[0].notifier)
+	}
+}
+
+func TestSendNotification(t *testing.T) {
+	var all, prod, stops, team []notificationEvent
+	notificationChannels = []notificationChannel{
+		{Name: "all", notifier: testNotifier{&all}},
+		{Name: "prod", Environments: []string{"prod-*"}, notifier: testNotifier{&prod}},
+		{Name: "stops", Events: []string{EventEnvStopped}, notifier: testNotifier{&stops}},
+		{Name: "team", Teams: []string{"ops"}, notifier: testNotifier{&team}},
+	}
+	defer func() { notificationChannels = nil }()
+
+	sendNotification(notificationEvent{Type: EventEnvStarted, EnvName: "prod-eu"})
+	sendNotification(notificationEvent{Type: EventEnvStopped, EnvName: "dev", Team: "ops"})
+	if len(all) != 2 || len(prod) != 1 || len(stops) != 1 || len(team) != 1 {
+		t.Errorf("unexpected routing: all=%d prod=%d stops=%d team=%d", len(all), len(prod), len(stops), len(team))
+	}
+	if all[0].Time.IsZero() {
+		t.Error("event time was not set")
+	}
+}
+
+func TestNotifyPowerAction(t *testing.T) {
+	var events []notificationEvent
+	notificationChannels = []notificationChannel{{Name: "all", notifier: testNotifier{&events}}}
+	defer func() { notificationChannels = nil }()
+
+	env := environment{
+		ID:             "env1",
+		Name:           "test",
+		TotalInstances: 2,
+		Instances:      []virtualMachine{{ID: "vm1", Name: "web", VCPU: 2, MemoryGB: 4}},
+	}
+	notifyPowerAction(powerAction{EnvID: "env1", Action: "stop", Actor: "jdoe"}, env, nil)
+	notifyPowerAction(powerAction{EnvID: "env1", Action: "start"}, env, http.ErrHandlerTimeout)
+	notifyPowerAction(powerAction{EnvID: "env1", InstanceID: "vm1", Action: "start"}, env, nil)
+
+	for i, expected := range []string{EventEnvStopped, EventEnvStartFailed, EventInstanceStarted} {
+		if events[i].Type != expected {
+			t.Errorf("expected %s but got %s", expected, events[i].Type)
+		}
+	}
+	if events[0].Actor != "jdoe" || events[0].InstanceCount != 2 {
+		t.Errorf("unexpected env event: %+v", events[0])
+	}
+	if events[1].Error == "" {
+		t.Error("error was not added to the event")
+	}
+	if events[2].InstanceCount != 1 || events[2].VCPU != 2 || events[2].Details["instance_name"] != "web" {
+		t.Errorf("unexpected instance event: %+v", events[2])
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	event := notificationEvent{Type: EventEnvStopped, EnvName: "test"}
+	expectedBody, _ := json.Marshal(event)
+	notificationClient = NewTestClient(func(req *http.Request) *http.Response {
+		body, _ := ioutil.ReadAll(req.Body)
+		if !bytes.Equal(body, expectedBody) {
+			t.Errorf("unexpected body: %s", body)
+		}
+		if req.Header.Get(webhookSignatureHeader) != "sha256="+signPayload("s3cr3t", expectedBody) {
+			t.Errorf("unexpected signature: %s", req.Header.Get(webhookSignatureHeader))
+		}
+		if req.Header.Get(webhookEventHeader) != EventEnvStopped {
+			t.Errorf("unexpected event header: %s", req.Header.Get(webhookEventHeader))
+		}
+		return &http.Response{StatusCode: 204, Body: ioutil.NopCloser(&bytes.Buffer{}), Header: make(http.Header)}
+	})
+	defer func() { notificationClient = createHTTPClient() }()
+
+	if err := (webhookNotifier{url: "https://hooks.example.com", secret: "s3cr3t"}).notify(event); err != nil {
+		t.Errorf("webhook notifier returned an error: %v", err)
+	}
+
+	// known HMAC-SHA256 test vector (RFC 4231, test case 2)
+	if signPayload("Jefe", []byte("what do ya want for nothing?")) != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Error("unexpected signature")
+	}
+}
+
+func TestTeamsNotifier(t *testing.T) {
+	notificationClient = NewTestClient(func(req *http.Request) *http.Response {
+		var card map[string]string
+		json.NewDecoder(req.Body).Decode(&card)
+		if card["@type"] != "MessageCard" || card["themeColor"] != "D00000" || !strings.HasPrefix(card["text"], "**ERROR STOPPING**") {
+			t.Errorf("unexpected message card: %v", card)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(&bytes.Buffer{}), Header: make(http.Header)}
+	})
+	defer func() { notificationClient = createHTTPClient() }()
+
+	event := notificationEvent{Type: EventEnvStopFailed, EnvName: "test", Error: "boom"}
+	if err := (teamsNotifier{webhookURL: "https://teams.example.com"}).notify(event); err != nil {
+		t.Errorf("teams notifier returned an error: %v", err)
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	var sent string
+	smtpSendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		if addr != "smtp.example.com:587" || from != "toggle@example.com" || len(to) != 2 || a == nil {
+			t.Errorf("unexpected smtp parameters: %s %s %v %v", addr, from, to, a)
+		}
+		sent = string(msg)
+		return nil
+	}
+	defer func() { smtpSendMail = smtp.SendMail }()
+
+	n := emailNotifier{
+		addr:     "smtp.example.com:587",
+		host:     "smtp.example.com",
+		username: "user",
+		password: "pass",
+		from:     "toggle@example.com",
+		to:       []string{"a@example.com", "b@example.com"},
+	}
+	event := notificationEvent{Type: EventEnvStarted, EnvName: "test", Region: "ca-central-1", InstanceCount: 1}
+	if err := n.notify(event); err != nil {
+		t.Errorf("email notifier returned an error: %v", err)
+	}
+	if !strings.Contains(sent, "Subject: [aws-power-toggle] STARTING test\r\n") ||
+		!strings.Contains(sent, "STARTING environment test in region ca-central-1 --> 1 instance(s)") {
+		t.Errorf("unexpected email: %s", sent)
+	}
+}
+
+func TestEmailNotifierOwner(t *testing.T) {
+	var recipients []string
+	smtpSendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		recipients = to
+		return nil
+	}
+	defer func() { smtpSendMail = smtp.SendMail }()
+
+	n := emailNotifier{addr: "smtp.example.com:25", host: "smtp.example.com", from: "toggle@example.com", to: []string{"ops@example.com"}, notifyOwner: true}
+	n.notify(notificationEvent{Type: EventEnvStarted, EnvName: "test", Owner: "alice@example.com"})
+	if !equalStrings(recipients, []string{"ops@example.com", "alice@example.com"}) {
+		t.Errorf("expected the owner to receive the email, got: %v", recipients)
+	}
+	// owners which are not email addresses are ignored
+	n.notify(notificationEvent{Type: EventEnvStarted, EnvName: "test", Owner: "alice"})
+	if !equalStrings(recipients, []string{"ops@example.com"}) {
+		t.Errorf("unexpected recipients: %v", recipients)
+	}
+}
@@ -0,0 +1,317 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// values are set by ConfigInit
+	notificationWorkers       int
+	notificationQueueSize     int
+	notificationMaxAttempts   int
+	notificationRetryBackoff  time.Duration
+	notificationMaxBackoff    time.Duration
+	notificationDeadLetterLog string
+	notificationSpoolDir      string
+
+	// deliveries waiting for a worker. nil until the workers are started
+	notificationQueue chan *notificationDelivery
+	// lock to prevent sending to the above queue while it is replaced or closed
+	notificationQueueLock sync.RWMutex
+	// running notification workers
+	notificationWorkersRunning sync.WaitGroup
+
+	// delivery statistics
+	notificationStats = deliveryStats{Channels: map[string]*channelDeliveryStats{}}
+	// lock to prevent concurrent access of the above stats and the dead letter log
+	notificationStatsLock sync.Mutex
+)
+
+// notificationDelivery is a single event which needs to be delivered to a single channel
+type notificationDelivery struct {
+	ID        string            `json:"id"`
+	Channel   string            `json:"channel"`
+	Event     notificationEvent `json:"event"`
+	Attempts  int               `json:"attempts"`
+	LastError string            `json:"last_error,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// deliveryStats is used for api responses
+type deliveryStats struct {
+	Queued         int                              `json:"queued"`
+	PendingRetries int                              `json:"pending_retries"`
+	Delivered      int                              `json:"delivered"`
+	FailedAttempts int                              `json:"failed_attempts"`
+	DeadLettered   int                              `json:"dead_lettered"`
+	Channels       map[string]*channelDeliveryStats `json:"channels"`
+}
+
+// channelDeliveryStats are the delivery statistics of a single channel
+type channelDeliveryStats struct {
+	Delivered      int        `json:"delivered"`
+	FailedAttempts int        `json:"failed_attempts"`
+	DeadLettered   int        `json:"dead_lettered"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastDelivered  *time.Time `json:"last_delivered,omitempty"`
+}
+
+// StartNotificationWorkers starts the workers which deliver queued notifications.
+// deliveries spooled to disk by a previous run are queued again
+func StartNotificationWorkers() {
+	workers := notificationWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *notificationDelivery, notificationQueueSize)
+	for i := 0; i < workers; i++ {
+		notificationWorkersRunning.Add(1)
+		go notificationWorker(queue)
+	}
+	notificationQueueLock.Lock()
+	notificationQueue = queue
+	notificationQueueLock.Unlock()
+	log.Infof("started %d notification worker(s)", workers)
+	loadSpooledDeliveries()
+}
+
+// StopNotificationWorkers stops accepting notifications and waits for the workers to finish.
+// notifications sent afterwards are delivered right away
+func StopNotificationWorkers() {
+	notificationQueueLock.Lock()
+	queue := notificationQueue
+	notificationQueue = nil
+	notificationQueueLock.Unlock()
+	if queue == nil {
+		return
+	}
+	close(queue)
+	notificationWorkersRunning.Wait()
+}
+
+// isNotificationQueueRunning returns true when notifications are delivered by the workers
+func isNotificationQueueRunning() bool {
+	notificationQueueLock.RLock()
+	defer notificationQueueLock.RUnlock()
+	return notificationQueue != nil
+}
+
+// notificationWorker delivers queued notifications until the queue is closed
+func notificationWorker(queue chan *notificationDelivery) {
+	defer notificationWorkersRunning.Done()
+	for d := range queue {
+		processDelivery(d)
+	}
+}
+
+// enqueueDelivery adds a delivery to the queue. A full queue dead-letters the delivery.
+// when the workers have been stopped, the delivery is only kept in the spool directory (if configured)
+func enqueueDelivery(d *notificationDelivery) {
+	notificationQueueLock.RLock()
+	defer notificationQueueLock.RUnlock()
+	if notificationQueue == nil {
+		log.Warningf("notification workers are stopped, %s notification to channel %s was not queued", d.Event.Type, d.Channel)
+		return
+	}
+
+	notificationStatsLock.Lock()
+	notificationStats.Queued++
+	notificationStatsLock.Unlock()
+
+	select {
+	case notificationQueue <- d:
+	default:
+		notificationStatsLock.Lock()
+		notificationStats.Queued--
+		notificationStatsLock.Unlock()
+		d.LastError = "notification queue is full"
+		deadLetterDelivery(d)
+	}
+}
+
+// processDelivery attempts a queued delivery and schedules a retry when it fails
+func processDelivery(d *notificationDelivery) {
+	notificationStatsLock.Lock()
+	notificationStats.Queued--
+	notificationStatsLock.Unlock()
+
+	if err := attemptDelivery(d); err == nil {
+		removeSpooledDelivery(d)
+		return
+	}
+	if d.Attempts >= notificationMaxAttempts {
+		deadLetterDelivery(d)
+		return
+	}
+	spoolDelivery(d)
+
+	backoff := getRetryBackoff(d.Attempts)
+	log.Debugf("retrying %s notification to channel %s in %v (attempt %d/%d)", d.Event.Type, d.Channel, backoff, d.Attempts, notificationMaxAttempts)
+	notificationStatsLock.Lock()
+	notificationStats.PendingRetries++
+	notificationStatsLock.Unlock()
+	time.AfterFunc(backoff, func() {
+		notificationStatsLock.Lock()
+		notificationStats.PendingRetries--
+		notificationStatsLock.Unlock()
+		enqueueDelivery(d)
+	})
+}
+
+// attemptDelivery sends the event to its channel once and updates the stats
+func attemptDelivery(d *notificationDelivery) (err error) {
+	d.Attempts++
+	var channel *notificationChannel
+	for i := range notificationChannels {
+		if notificationChannels[i].Name == d.Channel {
+			channel = &notificationChannels[i]
+		}
+	}
+	if channel == nil {
+		err = fmt.Errorf("channel no longer exists")
+		// retrying will not help
+		d.Attempts = notificationMaxAttempts
+	} else {
+		err = channel.notifier.notify(d.Event)
+	}
+
+	notificationStatsLock.Lock()
+	defer notificationStatsLock.Unlock()
+	stats := getChannelStats(d.Channel)
+	if err != nil {
+		log.Errorf("error sending %s notification to channel %s (attempt %d): %v", d.Event.Type, d.Channel, d.Attempts, err)
+		d.LastError = err.Error()
+		stats.FailedAttempts++
+		stats.LastError = d.LastError
+		notificationStats.FailedAttempts++
+		return
+	}
+	log.Debugf("sent %s notification to channel %s", d.Event.Type, d.Channel)
+	now := time.Now()
+	stats.Delivered++
+	stats.LastDelivered = &now
+	notificationStats.Delivered++
+	return
+}
+
+// getRetryBackoff returns the exponential backoff after the given amount of attempts
+func getRetryBackoff(attempts int) time.Duration {
+	backoff := notificationRetryBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if notificationMaxBackoff > 0 && backoff >= notificationMaxBackoff {
+			return notificationMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// deadLetterDelivery gives up on a delivery. It is logged and appended to the dead letter log (if configured)
+func deadLetterDelivery(d *notificationDelivery) {
+	log.Errorf("giving up on %s notification to channel %s after %d attempt(s): %s", d.Event.Type, d.Channel, d.Attempts, d.LastError)
+	removeSpooledDelivery(d)
+
+	notificationStatsLock.Lock()
+	defer notificationStatsLock.Unlock()
+	notificationStats.DeadLettered++
+	getChannelStats(d.Channel).DeadLettered++
+
+	if notificationDeadLetterLog == "" {
+		return
+	}
+	line, _ := json.Marshal(d)
+	f, err := os.OpenFile(notificationDeadLetterLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("could not open dead letter log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		log.Errorf("could not write to dead letter log: %v", err)
+	}
+}
+
+// getChannelStats returns the stats of a channel. notificationStatsLock must be held
+func getChannelStats(channel string) *channelDeliveryStats {
+	stats, found := notificationStats.Channels[channel]
+	if !found {
+		stats = &channelDeliveryStats{}
+		notificationStats.Channels[channel] = stats
+	}
+	return stats
+}
+
+// getDeliveryStats returns a copy of the delivery statistics
+func getDeliveryStats() deliveryStats {
+	notificationStatsLock.Lock()
+	defer notificationStatsLock.Unlock()
+
+	stats := notificationStats
+	stats.Channels = map[string]*channelDeliveryStats{}
+	for name, c := range notificationStats.Channels {
+		copied := *c
+		stats.Channels[name] = &copied
+	}
+	return stats
+}
+
+// spoolDelivery writes a delivery to the spool directory (if configured), so it survives a restart
+func spoolDelivery(d *notificationDelivery) {
+	if notificationSpoolDir == "" {
+		return
+	}
+	data, _ := json.Marshal(d)
+	if err := ioutil.WriteFile(filepath.Join(notificationSpoolDir, d.ID+".json"), data, 0600); err != nil {
+		log.Errorf("could not spool notification %s: %v", d.ID, err)
+	}
+}
+
+// removeSpooledDelivery removes a delivery from the spool directory
+func removeSpooledDelivery(d *notificationDelivery) {
+	if notificationSpoolDir == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(notificationSpoolDir, d.ID+".json")); err != nil && !os.IsNotExist(err) {
+		log.Errorf("could not remove spooled notification %s: %v", d.ID, err)
+	}
+}
+
+// loadSpooledDeliveries queues all deliveries found in the spool directory
+func loadSpooledDeliveries() {
+	if notificationSpoolDir == "" {
+		return
+	}
+	if err := os.MkdirAll(notificationSpoolDir, 0700); err != nil {
+		log.Errorf("could not create notification spool directory: %v", err)
+		return
+	}
+	files, err := ioutil.ReadDir(notificationSpoolDir)
+	if err != nil {
+		log.Errorf("could not read notification spool directory: %v", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(notificationSpoolDir, file.Name()))
+		if err != nil {
+			log.Errorf("could not read spooled notification %s: %v", file.Name(), err)
+			continue
+		}
+		var d notificationDelivery
+		if err = json.Unmarshal(data, &d); err != nil || d.ID == "" {
+			log.Errorf("ignoring invalid spooled notification %s: %v", file.Name(), err)
+			continue
+		}
+		log.Infof("queueing spooled %s notification to channel %s", d.Event.Type, d.Channel)
+		enqueueDelivery(&d)
+	}
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyNotifier fails a number of times before it succeeds
+type flakyNotifier struct {
+	lock     *sync.Mutex
+	failures *int
+	calls    *int
+}
+
+func (n flakyNotifier) notify(event notificationEvent) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	*n.calls++
+	if *n.failures > 0 {
+		*n.failures--
+		return errors.New("temporary failure")
+	}
+	return nil
+}
+
+// setupNotificationQueue starts the workers with a single flaky channel
+func setupNotificationQueue(t *testing.T, failures int) (calls *int, lock *sync.Mutex, cleanup func()) {
+	calls, lock = new(int), &sync.Mutex{}
+	notificationChannels = []notificationChannel{{Name: "flaky", notifier: flakyNotifier{lock, &failures, calls}}}
+	notificationStats = deliveryStats{Channels: map[string]*channelDeliveryStats{}}
+	notificationWorkers = 2
+	notificationQueueSize = 10
+	notificationMaxAttempts = 3
+	notificationRetryBackoff = time.Millisecond
+	notificationMaxBackoff = 5 * time.Millisecond
+	StartNotificationWorkers()
+
+	cleanup = func() {
+		StopNotificationWorkers()
+		notificationChannels = nil
+		notificationDeadLetterLog = ""
+		notificationSpoolDir = ""
+	}
+	return
+}
+
+// waitForStats waits until the condition on the delivery stats is true
+func waitForStats(t *testing.T, condition func(deliveryStats) bool) deliveryStats {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := getDeliveryStats()
+		if condition(stats) {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for delivery stats: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetRetryBackoff(t *testing.T) {
+	notificationRetryBackoff = 2 * time.Second
+	notificationMaxBackoff = 10 * time.Second
+	for attempts, expected := range map[int]time.Duration{
+		1: 2 * time.Second,
+		2: 4 * time.Second,
+		3: 8 * time.Second,
+		4: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		if backoff := getRetryBackoff(attempts); backoff != expected {
+			t.Errorf("attempt %d: expected %v but got %v", attempts, expected, backoff)
+		}
+	}
+}
+
+func TestNotificationRetry(t *testing.T) {
+	calls, lock, cleanup := setupNotificationQueue(t, 2)
+	defer cleanup()
+
+	if errs := sendNotification(notificationEvent{Type: EventEnvStopped}); len(errs) > 0 {
+		t.Errorf("queued notification returned errors: %v", errs)
+	}
+	stats := waitForStats(t, func(s deliveryStats) bool { return s.Delivered == 1 })
+	if stats.FailedAttempts != 2 || stats.DeadLettered != 0 || stats.Channels["flaky"].Delivered != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if *calls != 3 {
+		t.Errorf("expected 3 attempts but got %d", *calls)
+	}
+}
+
+func TestNotificationDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power-toggle-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, _, cleanup := setupNotificationQueue(t, 10)
+	defer cleanup()
+	notificationDeadLetterLog = filepath.Join(dir, "dead-letters.log")
+	notificationSpoolDir = dir
+
+	sendNotification(notificationEvent{Type: EventEnvStopped, EnvName: "test"})
+	stats := waitForStats(t, func(s deliveryStats) bool { return s.DeadLettered == 1 })
+	if stats.FailedAttempts != 3 || stats.Channels["flaky"].LastError != "temporary failure" {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	data, err := ioutil.ReadFile(notificationDeadLetterLog)
+	if err != nil {
+		t.Fatalf("dead letter log was not written: %v", err)
+	}
+	var d notificationDelivery
+	if err = json.Unmarshal([]byte(strings.TrimSpace(string(data))), &d); err != nil || d.Event.EnvName != "test" || d.Attempts != 3 {
+		t.Errorf("unexpected dead letter: %s", data)
+	}
+	// dead letters are removed from the spool
+	if spooled, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(spooled) != 0 {
+		t.Errorf("dead letter is still spooled: %v", spooled)
+	}
+}
+
+func TestLoadSpooledDeliveries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "power-toggle-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notificationSpoolDir = dir
+	spoolDelivery(&notificationDelivery{ID: "abc", Channel: "flaky", Event: notificationEvent{Type: EventEnvStarted}})
+	ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{"), 0600)
+
+	// the spooled delivery is sent once the workers start
+	_, _, cleanup := setupNotificationQueue(t, 0)
+	defer cleanup()
+	waitForStats(t, func(s deliveryStats) bool { return s.Delivered == 1 })
+	if _, err := os.Stat(filepath.Join(dir, "abc.json")); !os.IsNotExist(err) {
+		t.Errorf("delivered notification is still spooled: %v", err)
+	}
+}
@@ -0,0 +1,481 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defines operating systems of the pricing catalog
+
+	// PlatformLinux is linux/unix without license costs
+	PlatformLinux = "linux"
+	// PlatformRHEL is red hat enterprise linux
+	PlatformRHEL = "rhel"
+	// PlatformSUSE is suse linux enterprise server
+	PlatformSUSE = "suse"
+	// PlatformWindows is windows server
+	PlatformWindows = "windows"
+	// PlatformWindowsSQLWeb is windows server with sql server web
+	PlatformWindowsSQLWeb = "windows_sql_web"
+	// PlatformWindowsSQLStandard is windows server with sql server standard
+	PlatformWindowsSQLStandard = "windows_sql_std"
+	// PlatformWindowsSQLEnterprise is windows server with sql server enterprise
+	PlatformWindowsSQLEnterprise = "windows_sql_ent"
+
+	// defines purchase options
+
+	// PurchaseOnDemand is the regular price
+	PurchaseOnDemand = "ondemand"
+	// PurchaseSpot is used for spot instances
+	PurchaseSpot = "spot"
+	// PurchaseReserved is used for instances covered by reserved instances
+	PurchaseReserved = "reserved"
+	// PurchaseSavingsPlan is used for instances covered by a savings plan
+	PurchaseSavingsPlan = "savings_plan"
+
+	// the embedded catalog is used when no pricing source is configured
+	pricingSourceEmbedded = "embedded"
+
+	// catalogs can be large, so they get more time than other http requests
+	pricingDownloadTimeout = 2 * time.Minute
+)
+
+var (
+	// values are set by ConfigInit
+	pricingSource          string
+	pricingRefreshInterval time.Duration
+	pricingDiscounts       []pricingDiscount
+
+	// status of the last catalog (re)load
+	pricingStatus = pricingCatalogStatus{Source: pricingSourceEmbedded}
+	// lock to prevent concurrent access of the above status
+	pricingStatusLock sync.Mutex
+
+	// region codes by their location name, for offer files which do not contain the regionCode attribute
+	offerLocationRegions = map[string]string{
+		"Africa (Cape Town)":         "af-south-1",
+		"Asia Pacific (Hong Kong)":   "ap-east-1",
+		"Asia Pacific (Tokyo)":       "ap-northeast-1",
+		"Asia Pacific (Seoul)":       "ap-northeast-2",
+		"Asia Pacific (Osaka)":       "ap-northeast-3",
+		"Asia Pacific (Osaka-Local)": "ap-northeast-3",
+		"Asia Pacific (Mumbai)":      "ap-south-1",
+		"Asia Pacific (Singapore)":   "ap-southeast-1",
+		"Asia Pacific (Sydney)":      "ap-southeast-2",
+		"Canada (Central)":           "ca-central-1",
+		"EU (Frankfurt)":             "eu-central-1",
+		"EU (Stockholm)":             "eu-north-1",
+		"EU (Milan)":                 "eu-south-1",
+		"EU (Ireland)":               "eu-west-1",
+		"EU (London)":                "eu-west-2",
+		"EU (Paris)":                 "eu-west-3",
+		"Middle East (Bahrain)":      "me-south-1",
+		"South America (Sao Paulo)":  "sa-east-1",
+		"US East (N. Virginia)":      "us-east-1",
+		"US East (Ohio)":             "us-east-2",
+		"AWS GovCloud (US-East)":     "us-gov-east-1",
+		"AWS GovCloud (US-West)":     "us-gov-west-1",
+		"AWS GovCloud (US)":          "us-gov-west-1",
+		"US West (N. California)":    "us-west-1",
+		"US West (Oregon)":           "us-west-2",
+	}
+)
+
+// pricingDiscount applies a factor to the on-demand price of matching instances.
+// since aws does not tell which instances are covered by reserved instances or savings plans, these are configured
+type pricingDiscount struct {
+	Name           string `mapstructure:"name"`
+	PurchaseOption string `mapstructure:"purchase_option"`
+	// the on-demand price is multiplied by this factor (ie. 0.6 for 40% off)
+	Factor float64 `mapstructure:"factor"`
+	// all accounts, instance families (ie. m5) or operating systems when empty
+	Accounts         []string `mapstructure:"accounts"`
+	InstanceFamilies []string `mapstructure:"instance_families"`
+	Platforms        []string `mapstructure:"platforms"`
+}
+
+// validate checks the discount definition
+func (d pricingDiscount) validate() error {
+	switch d.PurchaseOption {
+	case PurchaseSpot, PurchaseReserved, PurchaseSavingsPlan:
+	default:
+		return fmt.Errorf("invalid purchase option: %s", d.PurchaseOption)
+	}
+	if d.Factor <= 0 || d.Factor > 1 {
+		return fmt.Errorf("factor must be greater than 0 and at most 1: %v", d.Factor)
+	}
+	return nil
+}
+
+// matches returns true if the discount applies to the instance
+func (d pricingDiscount) matches(instance virtualMachine, platform string) bool {
+	family := strings.SplitN(instance.InstanceType, ".", 2)[0]
+	return (len(d.Accounts) == 0 || stringInSlice(instance.AccountID, d.Accounts)) &&
+		(len(d.InstanceFamilies) == 0 || stringInSlice(family, d.InstanceFamilies)) &&
+		(len(d.Platforms) == 0 || stringInSlice(platform, d.Platforms))
+}
+
+// loadPricingDiscounts reads the discounts from the config file
+func loadPricingDiscounts() {
+	var configured []pricingDiscount
+	if err := viper.UnmarshalKey("pricing.discounts", &configured); err != nil {
+		log.Errorf("could not parse pricing discounts from config: %v", err)
+	}
+	pricingDiscounts = []pricingDiscount{}
+	for i, d := range configured {
+		if err := d.validate(); err != nil {
+			log.Errorf("ignoring invalid pricing discount #%d from config: %v", i+1, err)
+			continue
+		}
+		pricingDiscounts = append(pricingDiscounts, d)
+	}
+}
+
+// getPlatform returns the operating system of the pricing catalog,
+// based on the Platform of an instance and the PlatformDetails of its image (if known)
+func getPlatform(platform, platformDetails string) string {
+	switch {
+	// bring your own license is billed like linux
+	case strings.Contains(platformDetails, "BYOL"):
+		return PlatformLinux
+	case strings.HasPrefix(platformDetails, "Windows with SQL Server Enterprise"):
+		return PlatformWindowsSQLEnterprise
+	case strings.HasPrefix(platformDetails, "Windows with SQL Server Standard"):
+		return PlatformWindowsSQLStandard
+	case strings.HasPrefix(platformDetails, "Windows with SQL Server Web"):
+		return PlatformWindowsSQLWeb
+	case strings.HasPrefix(platformDetails, "Windows"):
+		return PlatformWindows
+	case strings.HasPrefix(platformDetails, "Red Hat Enterprise Linux"):
+		return PlatformRHEL
+	case strings.HasPrefix(platformDetails, "SUSE Linux"):
+		return PlatformSUSE
+	case platformDetails == "" && strings.EqualFold(platform, "windows"):
+		return PlatformWindows
+	}
+	return PlatformLinux
+}
+
+// applyInstancePricing sets the hourly price of an instance with the matching rate.
+// spot instances (PurchaseOption is set to spot) use the spot price of the catalog or a spot discount.
+// other instances use the on-demand price, reduced by the first matching reserved or savings plan discount
+func applyInstancePricing(instance *virtualMachine) {
+	spot := instance.PurchaseOption == PurchaseSpot
+	instance.PricingHourly = 0
+	instance.PurchaseOption = PurchaseOnDemand
+	if spot {
+		instance.PurchaseOption = PurchaseSpot
+	}
+	platform := instance.Platform
+	if platform == "" {
+		platform = PlatformLinux
+	}
+
+	details, found := getInstanceTypeDetails(instance.InstanceType)
+	if !found {
+		return
+	}
+	onDemand, found := details.getPricing(instance.Region, platform, PurchaseOnDemand)
+	if !found && platform != PlatformLinux {
+		// linux pricing is closer than no pricing at all
+		log.Debugf("no %s pricing found for %s in region %s, using linux pricing", platform, instance.InstanceType, instance.Region)
+		onDemand, _ = details.getPricing(instance.Region, PlatformLinux, PurchaseOnDemand)
+	}
+	instance.PricingHourly = onDemand
+
+	if spot {
+		if spotPrice, found := details.getPricing(instance.Region, platform, PurchaseSpot); found {
+			instance.PricingHourly = spotPrice
+			return
+		}
+	}
+	for _, d := range pricingDiscounts {
+		if (d.PurchaseOption == PurchaseSpot) != spot || !d.matches(*instance, platform) {
+			continue
+		}
+		instance.PricingHourly = onDemand * d.Factor
+		instance.PurchaseOption = d.PurchaseOption
+		return
+	}
+}
+
+// pricingCatalogStatus is used for api responses
+type pricingCatalogStatus struct {
+	Source        string     `json:"source"`
+	InstanceTypes int        `json:"instance_types"`
+	LoadedAt      *time.Time `json:"loaded_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// getPricingStatus returns a copy of the catalog status
+func getPricingStatus() pricingCatalogStatus {
+	pricingStatusLock.Lock()
+	defer pricingStatusLock.Unlock()
+	return pricingStatus
+}
+
+// mergeInstanceTypeDetails returns the details of an instance type from the embedded catalog, updated with a loaded catalog.
+// prices are replaced region by region, since a catalog is often generated from the offer file of a single region.
+// a region of the loaded catalog replaces both its default and operating system prices, so none of them are stale
+func mergeInstanceTypeDetails(embedded, loaded awsInstanceTypeDetails) (merged awsInstanceTypeDetails) {
+	merged = loaded
+	if merged.VCPU == 0 {
+		merged.VCPU = embedded.VCPU
+	}
+	if merged.MemoryGB == 0 {
+		merged.MemoryGB = embedded.MemoryGB
+	}
+	merged.PricingHourlyByRegion = map[string]string{}
+	merged.PricingByRegionOS = map[string]map[string]map[string]string{}
+	for region, price := range embedded.PricingHourlyByRegion {
+		merged.PricingHourlyByRegion[region] = price
+	}
+	for region, prices := range embedded.PricingByRegionOS {
+		merged.PricingByRegionOS[region] = prices
+	}
+	regions := map[string]bool{}
+	for region := range loaded.PricingHourlyByRegion {
+		regions[region] = true
+	}
+	for region := range loaded.PricingByRegionOS {
+		regions[region] = true
+	}
+	for region := range regions {
+		delete(merged.PricingHourlyByRegion, region)
+		delete(merged.PricingByRegionOS, region)
+		if price, found := loaded.PricingHourlyByRegion[region]; found {
+			merged.PricingHourlyByRegion[region] = price
+		}
+		if prices, found := loaded.PricingByRegionOS[region]; found {
+			merged.PricingByRegionOS[region] = prices
+		}
+	}
+	return
+}
+
+// refreshPricingCatalog (re)loads the catalog from the configured source.
+// instance types and regions missing from the source are taken from the embedded catalog.
+// when the source can not be loaded, the current catalog is kept
+func refreshPricingCatalog() (status pricingCatalogStatus, err error) {
+	var loaded map[string]awsInstanceTypeDetails
+	source := pricingSource
+	if source == "" {
+		source = pricingSourceEmbedded
+		loaded = embeddedInstanceTypeDetails
+	} else {
+		var data []byte
+		if data, err = readPricingSource(source); err == nil {
+			loaded, err = parseInstanceTypeDetails(data)
+		}
+	}
+
+	pricingStatusLock.Lock()
+	defer pricingStatusLock.Unlock()
+	pricingStatus.Source = source
+	if err != nil {
+		err = fmt.Errorf("could not load pricing catalog from %s: %v", source, err)
+		pricingStatus.LastError = err.Error()
+		return pricingStatus, err
+	}
+
+	details := make(map[string]awsInstanceTypeDetails, len(embeddedInstanceTypeDetails)+len(loaded))
+	for instanceType, d := range embeddedInstanceTypeDetails {
+		details[instanceType] = d
+	}
+	for instanceType, d := range loaded {
+		details[instanceType] = mergeInstanceTypeDetails(embeddedInstanceTypeDetails[instanceType], d)
+	}
+	instanceTypeDetailsLock.Lock()
+	instanceTypeDetailsCache = details
+	instanceTypeDetailsLock.Unlock()
+
+	now := time.Now()
+	pricingStatus.InstanceTypes = len(details)
+	pricingStatus.LoadedAt = &now
+	pricingStatus.LastError = ""
+	log.Infof("loaded pricing catalog from %s: %d instance type(s)", source, len(loaded))
+	return pricingStatus, nil
+}
+
+// readPricingSource reads a catalog from a file or a http(s) url
+func readPricingSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+	client := createHTTPClient()
+	client.Timeout = pricingDownloadTimeout
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response code was not successful: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// StartPricingRefresher is an infinite loop which periodically reloads the pricing catalog
+func StartPricingRefresher() {
+	if pricingSource == "" || pricingRefreshInterval <= 0 {
+		return
+	}
+	log.Infof("refreshing pricing catalog every %v", pricingRefreshInterval)
+	for range time.Tick(pricingRefreshInterval) {
+		if _, err := refreshPricingCatalog(); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+}
+
+// awsOfferFile contains the fields we need from an AWS Pricing API bulk offer file (ie. offers/v1.0/aws/AmazonEC2/current/index.json)
+type awsOfferFile struct {
+	Products map[string]struct {
+		ProductFamily string            `json:"productFamily"`
+		Attributes    map[string]string `json:"attributes"`
+	} `json:"products"`
+	Terms struct {
+		OnDemand map[string]map[string]awsOfferTerm `json:"OnDemand"`
+	} `json:"terms"`
+}
+
+// awsOfferTerm is a single price of a product
+type awsOfferTerm struct {
+	PriceDimensions map[string]struct {
+		Unit         string            `json:"unit"`
+		PricePerUnit map[string]string `json:"pricePerUnit"`
+	} `json:"priceDimensions"`
+}
+
+// hourlyUSD returns the hourly price of a term in USD
+func (t awsOfferTerm) hourlyUSD() (price float64, found bool) {
+	for _, dimension := range t.PriceDimensions {
+		if dimension.Unit != "Hrs" {
+			continue
+		}
+		if usd, ok := dimension.PricePerUnit["USD"]; ok {
+			price, err := strconv.ParseFloat(usd, 64)
+			return price, err == nil
+		}
+	}
+	return
+}
+
+// getOfferPlatform returns the operating system of the pricing catalog for a product of the offer file.
+// only shared instances without a license of their own (BYOL) are included
+func getOfferPlatform(attributes map[string]string) (platform string, ok bool) {
+	for key, expected := range map[string]string{
+		"tenancy":        "Shared",
+		"capacitystatus": "Used",
+		"licenseModel":   "No License required",
+	} {
+		// older offer files do not contain all attributes
+		if value, found := attributes[key]; found && value != expected {
+			return
+		}
+	}
+	software := attributes["preInstalledSw"]
+	switch attributes["operatingSystem"] {
+	case "Linux":
+		platform = PlatformLinux
+	case "RHEL":
+		platform = PlatformRHEL
+	case "SUSE":
+		platform = PlatformSUSE
+	case "Windows":
+		platform = PlatformWindows
+		switch software {
+		case "SQL Web":
+			platform, software = PlatformWindowsSQLWeb, "NA"
+		case "SQL Std":
+			platform, software = PlatformWindowsSQLStandard, "NA"
+		case "SQL Ent":
+			platform, software = PlatformWindowsSQLEnterprise, "NA"
+		}
+	}
+	return platform, platform != "" && (software == "" || software == "NA")
+}
+
+// GeneratePricingCatalog converts an AWS Pricing API bulk offer file for EC2 into a pricing catalog,
+// which can be used as pricing.source. It contains the on-demand pricing of each operating system
+// (offer files do not contain spot pricing)
+func GeneratePricingCatalog(offer io.Reader, catalog io.Writer) error {
+	var offerFile awsOfferFile
+	if err := json.NewDecoder(offer).Decode(&offerFile); err != nil {
+		return fmt.Errorf("could not decode offer file: %v", err)
+	}
+
+	details := map[string]*awsInstanceTypeDetails{}
+	for sku, product := range offerFile.Products {
+		attributes := product.Attributes
+		if product.ProductFamily != "Compute Instance" || attributes["instanceType"] == "" {
+			continue
+		}
+		platform, ok := getOfferPlatform(attributes)
+		if !ok {
+			continue
+		}
+		region := attributes["regionCode"]
+		if region == "" {
+			region = offerLocationRegions[attributes["location"]]
+		}
+		if region == "" {
+			continue
+		}
+		var price float64
+		var found bool
+		for _, term := range offerFile.Terms.OnDemand[sku] {
+			if price, found = term.hourlyUSD(); found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		d, exists := details[attributes["instanceType"]]
+		if !exists {
+			d = &awsInstanceTypeDetails{InstanceType: attributes["instanceType"], PricingHourlyByRegion: map[string]string{}}
+			d.VCPU, _ = strconv.Atoi(attributes["vcpu"])
+			// memory is formatted like "1,952 GiB"
+			memory, _ := strconv.ParseFloat(strings.Replace(strings.TrimSuffix(attributes["memory"], " GiB"), ",", "", -1), 32)
+			d.MemoryGB = float32(memory)
+			details[d.InstanceType] = d
+		}
+		pricing := strconv.FormatFloat(price, 'f', -1, 64)
+		if platform == PlatformLinux {
+			d.PricingHourlyByRegion[region] = pricing
+			continue
+		}
+		if d.PricingByRegionOS == nil {
+			d.PricingByRegionOS = map[string]map[string]map[string]string{}
+		}
+		if d.PricingByRegionOS[region] == nil {
+			d.PricingByRegionOS[region] = map[string]map[string]string{}
+		}
+		d.PricingByRegionOS[region][platform] = map[string]string{PurchaseOnDemand: pricing}
+	}
+	if len(details) == 0 {
+		return fmt.Errorf("offer file does not contain any instance pricing")
+	}
+
+	list := make([]awsInstanceTypeDetails, 0, len(details))
+	for _, d := range details {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].InstanceType < list[j].InstanceType })
+	encoder := json.NewEncoder(catalog)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(list)
+}
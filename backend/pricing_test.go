@@ -0,0 +1,257 @@
+package backend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGeneratePricingCatalog(t *testing.T) {
+	offer, err := os.Open("../testdata/pricing/ec2-offer-fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offer.Close()
+
+	var catalog bytes.Buffer
+	if err = GeneratePricingCatalog(offer, &catalog); err != nil {
+		t.Fatalf("GeneratePricingCatalog returned an error: %v", err)
+	}
+	details, err := parseInstanceTypeDetails(catalog.Bytes())
+	if err != nil {
+		t.Fatalf("generated catalog can not be parsed: %v", err)
+	}
+	if len(details) != 2 {
+		t.Fatalf("expected 2 instance types, got: %v", details)
+	}
+	// dedicated pricing is ignored, regions are taken from the location when needed
+	micro := details["t3.micro"]
+	if micro.VCPU != 2 || micro.MemoryGB != 1 || micro.PricingHourlyByRegion["us-east-1"] != "0.0104" || micro.PricingHourlyByRegion["ca-central-1"] != "0.0116" {
+		t.Errorf("unexpected t3.micro details: %+v", micro)
+	}
+	if pricing, found := micro.getPricing("us-east-1", PlatformWindows, PurchaseOnDemand); !found || pricing != 0.0196 {
+		t.Errorf("unexpected t3.micro windows pricing: %v", micro.PricingByRegionOS)
+	}
+	if details["x1e.32xlarge"].MemoryGB != 3904 {
+		t.Errorf("unexpected x1e.32xlarge details: %+v", details["x1e.32xlarge"])
+	}
+
+	if err = GeneratePricingCatalog(bytes.NewBufferString(`{"products":{}}`), &catalog); err == nil {
+		t.Error("expected an empty offer file to return an error")
+	}
+}
+
+func TestRefreshPricingCatalog(t *testing.T) {
+	if err := loadAwsInstanceDetailsJSON(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		pricingSource = ""
+		refreshPricingCatalog()
+	}()
+
+	dir, err := ioutil.TempDir("", "pricing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	catalog := `[{"instance_type": "t2.medium", "vCPU": 2, "memory": 4, "pricing": {"ca-central-1": "1.5"}}, {"instance_type": "z9.custom", "vCPU": 1, "memory": 1, "pricing": {}}]`
+	pricingSource = filepath.Join(dir, "catalog.json")
+	if err = ioutil.WriteFile(pricingSource, []byte(catalog), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the source overrides the embedded catalog, other instance types and regions are kept
+	embedded, _ := getInstanceTypeDetails("t2.medium")
+	if _, err = refreshPricingCatalog(); err != nil {
+		t.Fatalf("refreshPricingCatalog returned an error: %v", err)
+	}
+	details, _ := getInstanceTypeDetails("t2.medium")
+	if details.PricingHourlyByRegion["ca-central-1"] != "1.5" {
+		t.Errorf("expected t2.medium pricing to be taken from the source, got: %v", details.PricingHourlyByRegion)
+	}
+	if len(embedded.PricingHourlyByRegion) < 2 || len(details.PricingHourlyByRegion) != len(embedded.PricingHourlyByRegion) {
+		t.Errorf("expected the other regions of t2.medium to be kept, got: %v", details.PricingHourlyByRegion)
+	}
+	for region, price := range embedded.PricingHourlyByRegion {
+		if region != "ca-central-1" && details.PricingHourlyByRegion[region] != price {
+			t.Errorf("expected the embedded price of t2.medium in %s to be kept, got: %s", region, details.PricingHourlyByRegion[region])
+		}
+	}
+	if embedded.PricingHourlyByRegion["ca-central-1"] == "1.5" {
+		t.Error("the embedded catalog was modified")
+	}
+	for _, instanceType := range []string{"z9.custom", "c5d.4xlarge"} {
+		if _, found := getInstanceTypeDetails(instanceType); !found {
+			t.Errorf("expected %s to be found", instanceType)
+		}
+	}
+
+	// an invalid source keeps the current catalog
+	pricingSource = filepath.Join(dir, "missing.json")
+	if status, err := refreshPricingCatalog(); err == nil || status.LastError == "" {
+		t.Error("expected a missing source to return an error")
+	}
+	if _, found := getInstanceTypeDetails("z9.custom"); !found {
+		t.Error("expected the catalog to be kept")
+	}
+
+	// catalogs can be downloaded
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/catalog.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `[{"instance_type": "z8.custom", "vCPU": 1, "memory": 1, "pricing": {}}]`)
+	}))
+	defer server.Close()
+	pricingSource = server.URL + "/catalog.json"
+	if status, err := refreshPricingCatalog(); err != nil || status.Source != pricingSource {
+		t.Fatalf("refreshPricingCatalog returned an error: %v", err)
+	}
+	if _, found := getInstanceTypeDetails("z8.custom"); !found {
+		t.Error("expected z8.custom to be found")
+	}
+	if _, found := getInstanceTypeDetails("z9.custom"); found {
+		t.Error("expected z9.custom to be gone after reloading")
+	}
+	pricingSource = server.URL + "/invalid.json"
+	if _, err := refreshPricingCatalog(); err == nil {
+		t.Error("expected an unsuccessful response to return an error")
+	}
+}
+
+func TestGetPlatform(t *testing.T) {
+	testCases := []struct {
+		platform        string
+		platformDetails string
+		expected        string
+	}{
+		{"", "", PlatformLinux},
+		{"", "Linux/UNIX", PlatformLinux},
+		{"windows", "", PlatformWindows},
+		{"windows", "Windows", PlatformWindows},
+		{"windows", "Windows BYOL", PlatformLinux},
+		{"windows", "Windows with SQL Server Standard", PlatformWindowsSQLStandard},
+		{"windows", "Windows with SQL Server Enterprise", PlatformWindowsSQLEnterprise},
+		{"", "Red Hat Enterprise Linux", PlatformRHEL},
+		{"", "SUSE Linux", PlatformSUSE},
+	}
+	for _, tc := range testCases {
+		if platform := getPlatform(tc.platform, tc.platformDetails); platform != tc.expected {
+			t.Errorf("getPlatform(%q, %q): expected %s, got %s", tc.platform, tc.platformDetails, tc.expected, platform)
+		}
+	}
+}
+
+func TestApplyInstancePricing(t *testing.T) {
+	if err := loadAwsInstanceDetailsJSON(); err != nil {
+		t.Fatal(err)
+	}
+	instanceTypeDetailsLock.Lock()
+	instanceTypeDetailsCache["z9.custom"] = awsInstanceTypeDetails{
+		InstanceType:          "z9.custom",
+		PricingHourlyByRegion: map[string]string{"us-east-1": "1.0"},
+		PricingByRegionOS: map[string]map[string]map[string]string{
+			"us-east-1": {PlatformWindows: {PurchaseOnDemand: "2.0", PurchaseSpot: "0.5"}},
+		},
+	}
+	instanceTypeDetailsLock.Unlock()
+	defer func() {
+		pricingDiscounts = []pricingDiscount{}
+		refreshPricingCatalog()
+	}()
+	pricingDiscounts = []pricingDiscount{
+		{Name: "ri", PurchaseOption: PurchaseReserved, Factor: 0.6, Accounts: []string{"111111111111"}, InstanceFamilies: []string{"z9"}},
+		{Name: "spot", PurchaseOption: PurchaseSpot, Factor: 0.3},
+	}
+
+	testCases := []struct {
+		instance       virtualMachine
+		pricing        float64
+		purchaseOption string
+	}{
+		// linux on-demand
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1"}, 1.0, PurchaseOnDemand},
+		// operating system pricing
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1", Platform: PlatformWindows}, 2.0, PurchaseOnDemand},
+		// linux pricing when the operating system is not priced
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1", Platform: PlatformRHEL}, 1.0, PurchaseOnDemand},
+		// spot price of the catalog
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1", Platform: PlatformWindows, PurchaseOption: PurchaseSpot}, 0.5, PurchaseSpot},
+		// spot discount
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1", PurchaseOption: PurchaseSpot}, 0.3, PurchaseSpot},
+		// reserved discount of the account
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1", AccountID: "111111111111"}, 0.6, PurchaseReserved},
+		{virtualMachine{InstanceType: "z9.custom", Region: "us-east-1", AccountID: "222222222222"}, 1.0, PurchaseOnDemand},
+		// unknown region or instance type
+		{virtualMachine{InstanceType: "z9.custom", Region: "eu-west-1"}, 0, PurchaseOnDemand},
+		{virtualMachine{InstanceType: "z8.unknown", Region: "us-east-1"}, 0, PurchaseOnDemand},
+	}
+	for i, tc := range testCases {
+		instance := tc.instance
+		applyInstancePricing(&instance)
+		if math.Abs(instance.PricingHourly-tc.pricing) > 0.0001 || instance.PurchaseOption != tc.purchaseOption {
+			t.Errorf("test case #%d: expected %v (%s), got %v (%s)", i+1, tc.pricing, tc.purchaseOption, instance.PricingHourly, instance.PurchaseOption)
+		}
+	}
+}
+
+func TestLoadPricingDiscounts(t *testing.T) {
+	defer func() {
+		viper.Set("pricing.discounts", nil)
+		loadPricingDiscounts()
+	}()
+	viper.Set("pricing.discounts", []map[string]interface{}{
+		{"name": "valid", "purchase_option": "savings_plan", "factor": 0.7},
+		{"name": "invalid-option", "purchase_option": "ondemand", "factor": 0.7},
+		{"name": "invalid-factor", "purchase_option": "reserved", "factor": 1.5},
+	})
+	loadPricingDiscounts()
+	if len(pricingDiscounts) != 1 || pricingDiscounts[0].Name != "valid" {
+		t.Errorf("expected only the valid discount to be loaded, got: %+v", pricingDiscounts)
+	}
+}
+
+func TestMergeInstanceTypeDetails(t *testing.T) {
+	embedded := awsInstanceTypeDetails{
+		InstanceType:          "m5.large",
+		VCPU:                  2,
+		MemoryGB:              8,
+		PricingHourlyByRegion: map[string]string{"us-east-1": "0.096", "eu-west-1": "0.107"},
+		PricingByRegionOS: map[string]map[string]map[string]string{
+			"us-east-1": {PlatformWindows: {PurchaseOnDemand: "0.188"}},
+			"eu-west-1": {PlatformWindows: {PurchaseOnDemand: "0.199"}},
+		},
+	}
+	loaded := awsInstanceTypeDetails{
+		InstanceType:          "m5.large",
+		PricingHourlyByRegion: map[string]string{"eu-west-1": "0.2"},
+	}
+
+	merged := mergeInstanceTypeDetails(embedded, loaded)
+	if merged.VCPU != 2 || merged.MemoryGB != 8 {
+		t.Errorf("expected cpu and memory of the embedded catalog, got: %d %v", merged.VCPU, merged.MemoryGB)
+	}
+	if merged.PricingHourlyByRegion["eu-west-1"] != "0.2" || merged.PricingHourlyByRegion["us-east-1"] != "0.096" {
+		t.Errorf("unexpected prices: %v", merged.PricingHourlyByRegion)
+	}
+	// the prices of a loaded region are all replaced
+	if _, found := merged.PricingByRegionOS["eu-west-1"]; found {
+		t.Errorf("expected stale operating system prices of eu-west-1 to be removed: %v", merged.PricingByRegionOS)
+	}
+	if merged.PricingByRegionOS["us-east-1"][PlatformWindows][PurchaseOnDemand] != "0.188" {
+		t.Errorf("expected operating system prices of us-east-1 to be kept: %v", merged.PricingByRegionOS)
+	}
+	if len(embedded.PricingHourlyByRegion) != 2 || embedded.PricingHourlyByRegion["eu-west-1"] != "0.107" {
+		t.Errorf("the embedded details were modified: %v", embedded.PricingHourlyByRegion)
+	}
+}
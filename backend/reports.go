@@ -0,0 +1,336 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// defines report periods
+
+	// ReportPeriodDaily covers the current day
+	ReportPeriodDaily = "daily"
+	// ReportPeriodWeekly covers the last 7 days (including the current day)
+	ReportPeriodWeekly = "weekly"
+	// ReportPeriodMonthly covers the last 30 days (including the current day)
+	ReportPeriodMonthly = "monthly"
+
+	// EventCostReport is sent when a scheduled report is generated
+	EventCostReport = "cost_report"
+
+	// amount of environments listed as top offenders
+	reportTopOffenders = 5
+)
+
+var (
+	// values are set by ConfigInit
+	reportSchedules []reportSchedule
+
+	// days covered by each report period
+	reportPeriodDays = map[string]int{
+		ReportPeriodDaily:   1,
+		ReportPeriodWeekly:  7,
+		ReportPeriodMonthly: 30,
+	}
+
+	// last time a scheduled report was sent (by index of the schedule)
+	reportsSent = map[int]time.Time{}
+)
+
+// reportSchedule sends a report through the notification channels at a specific time
+type reportSchedule struct {
+	Period string `mapstructure:"period"`
+	// time of day (HH:MM) at which the report is sent
+	Time string `mapstructure:"time"`
+	// weekday (mon, tue, ...) on which a weekly report is sent, defaults to mon
+	Day string `mapstructure:"day"`
+	// IANA timezone name, defaults to UTC
+	Timezone string `mapstructure:"timezone"`
+}
+
+// envReport is the summary of a single environment within a report
+type envReport struct {
+	EnvID         string  `json:"env_id"`
+	EnvName       string  `json:"env_name"`
+	Region        string  `json:"region"`
+	RunningHours  float64 `json:"running_hours"`
+	InstanceHours float64 `json:"instance_hours"`
+	Cost          float64 `json:"cost"`
+	Saved         float64 `json:"saved"`
+	Starts        int     `json:"starts"`
+	Stops         int     `json:"stops"`
+}
+
+// costReport summarizes runtime, cost and savings of all environments over a period
+type costReport struct {
+	Period       string      `json:"period"`
+	From         time.Time   `json:"from"`
+	To           time.Time   `json:"to"`
+	GeneratedAt  time.Time   `json:"generated_at"`
+	RunningHours float64     `json:"total_running_hours"`
+	Cost         float64     `json:"total_cost"`
+	Saved        float64     `json:"total_saved"`
+	Environments []envReport `json:"environments"`
+	// environments with the highest cost
+	TopOffenders []envReport `json:"top_offenders"`
+}
+
+// validate checks the schedule definition
+func (s reportSchedule) validate() (err error) {
+	if _, found := reportPeriodDays[s.Period]; !found {
+		return fmt.Errorf("invalid report period: %s", s.Period)
+	}
+	if _, err = time.Parse("15:04", s.Time); err != nil {
+		return fmt.Errorf("invalid report time (expected HH:MM): %s", s.Time)
+	}
+	if _, found := weekdayNames[strings.ToLower(s.Day)]; s.Day != "" && !found {
+		return fmt.Errorf("invalid report day: %s", s.Day)
+	}
+	if _, err = time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid report timezone: %s", s.Timezone)
+	}
+	return
+}
+
+// loadReportSchedules reads the report schedules from the config file
+func loadReportSchedules() {
+	var configured []reportSchedule
+	if err := viper.UnmarshalKey("reports.schedules", &configured); err != nil {
+		log.Errorf("could not parse report schedules from config: %v", err)
+	}
+	reportSchedules = []reportSchedule{}
+	for i, s := range configured {
+		if err := s.validate(); err != nil {
+			log.Errorf("ignoring invalid report schedule #%d from config: %v", i+1, err)
+			continue
+		}
+		reportSchedules = append(reportSchedules, s)
+	}
+}
+
+// isDue returns true if the report should be sent at the given time.
+// lastSent prevents sending the same report twice
+func (s reportSchedule) isDue(now, lastSent time.Time) bool {
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return false
+	}
+	now = now.In(location)
+	at, _ := time.Parse("15:04", s.Time)
+	due := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, location)
+	switch s.Period {
+	case ReportPeriodWeekly:
+		day := time.Monday
+		if s.Day != "" {
+			day = weekdayNames[strings.ToLower(s.Day)]
+		}
+		if now.Weekday() != day {
+			return false
+		}
+	case ReportPeriodMonthly:
+		if now.Day() != 1 {
+			return false
+		}
+	}
+	return !now.Before(due) && lastSent.Before(due)
+}
+
+// getReportRange returns the time range covered by a report period
+func getReportRange(period string, now time.Time) (from, to time.Time, err error) {
+	days, found := reportPeriodDays[period]
+	if !found {
+		err = fmt.Errorf("invalid report period: %s", period)
+		return
+	}
+	now = now.UTC()
+	to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	from = to.AddDate(0, 0, -days)
+	return
+}
+
+// generateReport builds the report of a period from the recorded history
+func generateReport(period string, now time.Time) (report costReport, err error) {
+	from, to, err := getReportRange(period, now)
+	if err != nil {
+		return
+	}
+	report = costReport{
+		Period:       period,
+		From:         from,
+		To:           to,
+		GeneratedAt:  now,
+		Environments: []envReport{},
+		TopOffenders: []envReport{},
+	}
+
+	transitions, usage := getHistory(from, to)
+	byEnv := map[string]*envReport{}
+	getEnvReport := func(envID, envName string) *envReport {
+		r, found := byEnv[envID]
+		if !found {
+			r = &envReport{EnvID: envID, EnvName: envName}
+			byEnv[envID] = r
+		}
+		return r
+	}
+	for _, u := range usage {
+		r := getEnvReport(u.EnvID, u.EnvName)
+		r.Region = u.Region
+		r.RunningHours += u.RunningHours
+		r.InstanceHours += u.InstanceHours
+		r.Cost += u.Cost
+		r.Saved += u.Saved
+	}
+	for _, t := range transitions {
+		r := getEnvReport(t.EnvID, t.EnvName)
+		switch t.To {
+		case EnvStateRunning:
+			r.Starts++
+		case EnvStateStopped:
+			r.Stops++
+		}
+	}
+
+	for _, r := range byEnv {
+		report.RunningHours += r.RunningHours
+		report.Cost += r.Cost
+		report.Saved += r.Saved
+		report.Environments = append(report.Environments, *r)
+	}
+	sort.Slice(report.Environments, func(i, j int) bool {
+		a, b := report.Environments[i], report.Environments[j]
+		if a.Cost != b.Cost {
+			return a.Cost > b.Cost
+		}
+		if a.RunningHours != b.RunningHours {
+			return a.RunningHours > b.RunningHours
+		}
+		return a.EnvName < b.EnvName
+	})
+	for _, r := range report.Environments {
+		if len(report.TopOffenders) == reportTopOffenders {
+			break
+		}
+		if r.Cost > 0 || r.RunningHours > 0 {
+			report.TopOffenders = append(report.TopOffenders, r)
+		}
+	}
+	return
+}
+
+// reportCSV renders the environments of a report as csv
+func reportCSV(report costReport) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"env_id", "env_name", "region", "running_hours", "instance_hours", "cost", "saved", "starts", "stops"})
+	for _, r := range report.Environments {
+		w.Write([]string{
+			r.EnvID,
+			r.EnvName,
+			r.Region,
+			fmt.Sprintf("%.02f", r.RunningHours),
+			fmt.Sprintf("%.02f", r.InstanceHours),
+			fmt.Sprintf("%.02f", r.Cost),
+			fmt.Sprintf("%.02f", r.Saved),
+			fmt.Sprintf("%d", r.Starts),
+			fmt.Sprintf("%d", r.Stops),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// reportHTMLTemplate renders a report as a simple html page
+var reportHTMLTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"money": func(v float64) string { return fmt.Sprintf("%.02f", v) },
+	"date":  func(t time.Time) string { return t.Format(usageDateFormat) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>aws-power-toggle {{ .Period }} report</title></head>
+<body>
+<h1>aws-power-toggle {{ .Period }} report</h1>
+<p>{{ date .From }} - {{ date .To }}: {{ money .RunningHours }} running hours, cost {{ money .Cost }}, saved {{ money .Saved }}</p>
+<h2>Top Offenders</h2>
+<ol>
+{{- range .TopOffenders }}
+<li>{{ .EnvName }} ({{ .Region }}): {{ money .RunningHours }} hours, cost {{ money .Cost }}</li>
+{{- end }}
+</ol>
+<h2>Environments</h2>
+<table border="1">
+<tr><th>Environment</th><th>Region</th><th>Running Hours</th><th>Instance Hours</th><th>Cost</th><th>Saved</th><th>Starts</th><th>Stops</th></tr>
+{{- range .Environments }}
+<tr><td>{{ .EnvName }}</td><td>{{ .Region }}</td><td>{{ money .RunningHours }}</td><td>{{ money .InstanceHours }}</td><td>{{ money .Cost }}</td><td>{{ money .Saved }}</td><td>{{ .Starts }}</td><td>{{ .Stops }}</td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+// reportHTML renders a report as html
+func reportHTML(report costReport) ([]byte, error) {
+	var buf bytes.Buffer
+	err := reportHTMLTemplate.Execute(&buf, report)
+	return buf.Bytes(), err
+}
+
+// reportEvent returns the notification event of a report. the event has no environment or team,
+// so it only matches channels without an environments or teams filter
+func reportEvent(report costReport) notificationEvent {
+	top := []string{}
+	for i, r := range report.TopOffenders {
+		top = append(top, fmt.Sprintf("%d. %s (%.01fh, %.02f)", i+1, r.EnvName, r.RunningHours, r.Cost))
+	}
+	return notificationEvent{
+		Type: EventCostReport,
+		Details: map[string]string{
+			"period":        report.Period,
+			"from":          report.From.Format(usageDateFormat),
+			"to":            report.To.Format(usageDateFormat),
+			"running_hours": fmt.Sprintf("%.01f", report.RunningHours),
+			"cost":          fmt.Sprintf("%.02f", report.Cost),
+			"saved":         fmt.Sprintf("%.02f", report.Saved),
+			"top_offenders": strings.Join(top, "; "),
+		},
+	}
+}
+
+// checkReportSchedules sends all reports which are due
+func checkReportSchedules(now time.Time) {
+	for i, s := range reportSchedules {
+		if !s.isDue(now, reportsSent[i]) {
+			continue
+		}
+		reportsSent[i] = now
+		report, err := generateReport(s.Period, now)
+		if err != nil {
+			log.Errorf("could not generate %s report: %v", s.Period, err)
+			continue
+		}
+		log.Infof("sending %s report", s.Period)
+		sendNotification(reportEvent(report))
+	}
+}
+
+// StartReportScheduler is an infinite loop which sends scheduled reports
+func StartReportScheduler() {
+	if len(reportSchedules) == 0 {
+		return
+	}
+	// reports which were due before startup are not sent
+	now := time.Now()
+	for i := range reportSchedules {
+		reportsSent[i] = now
+	}
+	log.Infof("started report scheduler with %d schedule(s)", len(reportSchedules))
+	for now := range time.Tick(time.Minute) {
+		checkReportSchedules(now)
+	}
+}
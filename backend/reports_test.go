@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateReport(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	envHistory = envHistoryData{
+		Transitions: []stateTransition{
+			{EnvID: "a", EnvName: "env-a", From: EnvStateStopped, To: EnvStateRunning, Time: now.Add(-time.Hour)},
+			{EnvID: "a", EnvName: "env-a", From: EnvStateRunning, To: EnvStateStopped, Time: now},
+			{EnvID: "b", EnvName: "env-b", From: EnvStateStopped, To: EnvStateRunning, Time: now.AddDate(0, 0, -3)},
+		},
+		Usage: map[string]*envDailyUsage{},
+	}
+	for _, u := range []envDailyUsage{
+		{Date: "2020-03-10", EnvID: "a", EnvName: "env-a", RunningHours: 1, Cost: 0.5, Saved: 4},
+		{Date: "2020-03-10", EnvID: "b", EnvName: "env-b", RunningHours: 12, Cost: 6},
+		{Date: "2020-03-07", EnvID: "b", EnvName: "env-b", RunningHours: 24, Cost: 12},
+		{Date: "2020-01-01", EnvID: "c", EnvName: "env-c", RunningHours: 24, Cost: 100},
+	} {
+		u := u
+		envHistory.Usage[usageKey(u.Date, u.EnvID)] = &u
+	}
+	defer func() { envHistory = envHistoryData{Usage: map[string]*envDailyUsage{}} }()
+
+	daily, err := generateReport(ReportPeriodDaily, now)
+	if err != nil {
+		t.Fatalf("generateReport returned an error: %v", err)
+	}
+	if len(daily.Environments) != 2 || daily.Cost != 6.5 || daily.Saved != 4 {
+		t.Errorf("unexpected daily report: %+v", daily)
+	}
+	if daily.TopOffenders[0].EnvID != "b" || daily.Environments[1].Starts != 1 || daily.Environments[1].Stops != 1 {
+		t.Errorf("unexpected daily report environments: %+v", daily.Environments)
+	}
+
+	weekly, _ := generateReport(ReportPeriodWeekly, now)
+	if weekly.From.Format(usageDateFormat) != "2020-03-04" || weekly.Cost != 18.5 || weekly.RunningHours != 37 {
+		t.Errorf("unexpected weekly report: %+v", weekly)
+	}
+	if _, err = generateReport("yearly", now); err == nil {
+		t.Error("expected an invalid period to return an error")
+	}
+
+	csv, err := reportCSV(weekly)
+	if err != nil || !strings.Contains(string(csv), "b,env-b,,36.00,0.00,18.00,0.00,1,0") {
+		t.Errorf("unexpected csv (%v):\n%s", err, csv)
+	}
+	html, err := reportHTML(weekly)
+	if err != nil || !strings.Contains(string(html), "<li>env-b ():") {
+		t.Errorf("unexpected html (%v):\n%s", err, html)
+	}
+	event := reportEvent(weekly)
+	if text := eventText(event, plainMarkup); !strings.Contains(text, "WEEKLY COST REPORT") || !strings.Contains(text, "1. env-b") {
+		t.Errorf("unexpected report text: %s", text)
+	}
+}
+
+func TestReportScheduleIsDue(t *testing.T) {
+	monday := time.Date(2020, 3, 9, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		schedule reportSchedule
+		now      time.Time
+		lastSent time.Time
+		due      bool
+	}{
+		{reportSchedule{Period: ReportPeriodDaily, Time: "08:00"}, monday, time.Time{}, true},
+		{reportSchedule{Period: ReportPeriodDaily, Time: "08:00"}, monday.Add(-time.Minute), time.Time{}, false},
+		{reportSchedule{Period: ReportPeriodDaily, Time: "08:00"}, monday.Add(time.Hour), monday, false},
+		{reportSchedule{Period: ReportPeriodWeekly, Time: "08:00"}, monday, time.Time{}, true},
+		{reportSchedule{Period: ReportPeriodWeekly, Time: "08:00", Day: "tue"}, monday, time.Time{}, false},
+		{reportSchedule{Period: ReportPeriodMonthly, Time: "08:00"}, monday, time.Time{}, false},
+		{reportSchedule{Period: ReportPeriodDaily, Time: "09:00", Timezone: "Europe/Berlin"}, monday, time.Time{}, true},
+	}
+	for i, test := range tests {
+		if due := test.schedule.isDue(test.now, test.lastSent); due != test.due {
+			t.Errorf("test #%d: expected due to be %v, got %v", i, test.due, due)
+		}
+	}
+	if err := (reportSchedule{Period: ReportPeriodWeekly, Time: "25:00"}).validate(); err == nil {
+		t.Error("expected an invalid time to be refused")
+	}
+}
+
+func TestCheckReportSchedules(t *testing.T) {
+	monday := time.Date(2020, 3, 9, 8, 0, 0, 0, time.UTC)
+	reportSchedules = []reportSchedule{
+		{Period: ReportPeriodDaily, Time: "08:00"},
+		{Period: ReportPeriodDaily, Time: "09:00", Timezone: "Europe/Berlin"},
+	}
+	reportsSent = map[int]time.Time{}
+	var events, filtered []notificationEvent
+	notificationChannels = []notificationChannel{
+		{Name: "all", notifier: testNotifier{&events}},
+		{Name: "prod", Environments: []string{"prod-*"}, notifier: testNotifier{&filtered}},
+	}
+	defer func() { reportSchedules = nil; reportsSent = map[int]time.Time{}; notificationChannels = nil }()
+
+	// schedules with the same period are sent independently
+	checkReportSchedules(monday)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 reports to be sent, got %d", len(events))
+	}
+	// reports cover all environments, channels filtered by environment do not receive them
+	if len(filtered) != 0 {
+		t.Errorf("expected no reports on a filtered channel, got %d", len(filtered))
+	}
+	checkReportSchedules(monday.Add(time.Minute))
+	if len(events) != 2 {
+		t.Errorf("expected no more reports to be sent, got %d", len(events))
+	}
+}
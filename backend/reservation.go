@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// values are set by ConfigInit
+	reservationDefaultDuration time.Duration
+	reservationMaxDuration     time.Duration
+
+	// active reservations by env ID
+	envReservations = map[string]envReservation{}
+	// lock to prevent concurrent access of the above map
+	envReservationsLock sync.Mutex
+)
+
+// envReservation prevents anyone but the owner from stopping an environment
+type envReservation struct {
+	EnvID     string    `json:"env_id" groups:"summary,details"`
+	Owner     string    `json:"owner" groups:"summary,details"`
+	Reason    string    `json:"reason,omitempty" groups:"summary,details"`
+	CreatedAt time.Time `json:"created_at" groups:"summary,details"`
+	ExpiresAt time.Time `json:"expires_at" groups:"summary,details"`
+}
+
+// parseReservationDuration determines the duration of a reservation from the request parameters
+func parseReservationDuration(req *http.Request) (duration time.Duration, err error) {
+	duration = reservationDefaultDuration
+	if d := req.FormValue("duration"); d != "" {
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 {
+			err = fmt.Errorf("invalid duration: %s", d)
+			return
+		}
+	}
+	if duration <= 0 {
+		err = fmt.Errorf("duration is required")
+	} else if reservationMaxDuration > 0 && duration > reservationMaxDuration {
+		err = fmt.Errorf("reservation exceeds the maximum allowed duration of %v", reservationMaxDuration)
+	}
+	return
+}
+
+// reserveEnv creates (or renews) a reservation for an environment.
+// An active reservation of another owner can only be replaced with force
+func reserveEnv(envID, owner, reason string, duration time.Duration, force bool) (reservation envReservation, err error) {
+	if owner == "" {
+		err = actionError{Status: http.StatusBadRequest, Message: "owner is required"}
+		return
+	}
+
+	now := time.Now()
+	envReservationsLock.Lock()
+	defer envReservationsLock.Unlock()
+
+	if existing, found := envReservations[envID]; found && now.Before(existing.ExpiresAt) && existing.Owner != owner && !force {
+		err = actionError{Status: http.StatusConflict, Message: fmt.Sprintf("environment is already reserved by %s", existing.Owner)}
+		return
+	}
+
+	reservation = envReservation{
+		EnvID:     envID,
+		Owner:     owner,
+		Reason:    reason,
+		CreatedAt: now,
+		ExpiresAt: now.Add(duration),
+	}
+	envReservations[envID] = reservation
+	log.Infof("env [%s] reserved by %s until %s: %s", envID, owner, reservation.ExpiresAt.Format(time.RFC3339), reason)
+	return
+}
+
+// releaseEnv removes a reservation. Only the owner can release it, unless force is used
+func releaseEnv(envID, actor string, force bool) (reservation envReservation, err error) {
+	envReservationsLock.Lock()
+	defer envReservationsLock.Unlock()
+
+	reservation, found := envReservations[envID]
+	if !found || !time.Now().Before(reservation.ExpiresAt) {
+		err = actionError{Status: http.StatusNotFound, Message: "reservation not found"}
+		return
+	}
+	if reservation.Owner != actor && !force {
+		err = actionError{Status: http.StatusConflict, Message: fmt.Sprintf("environment is reserved by %s", reservation.Owner)}
+		return
+	}
+	delete(envReservations, envID)
+	log.Infof("reservation of env [%s] (owner: %s) released by '%s'", envID, reservation.Owner, actor)
+	return
+}
+
+// getEnvReservation returns the active reservation of an environment.
+// expired reservations are released automatically
+func getEnvReservation(envID string) (reservation envReservation, found bool) {
+	envReservationsLock.Lock()
+	defer envReservationsLock.Unlock()
+
+	if reservation, found = envReservations[envID]; found && !time.Now().Before(reservation.ExpiresAt) {
+		log.Infof("reservation of env [%s] (owner: %s) has expired", envID, reservation.Owner)
+		delete(envReservations, envID)
+		return envReservation{}, false
+	}
+	return
+}
+
+// checkReservation is an actionGuard which refuses to stop a reserved environment,
+// unless it is requested by the owner or forced. the owner must be authenticated (or own the expired lease)
+func checkReservation(action powerAction) error {
+	if action.Action != "stop" || action.Force {
+		return nil
+	}
+	reservation, found := getEnvReservation(action.EnvID)
+	if !found || (reservation.Owner == action.Actor && (action.ActorTrusted || action.Source == ActionSourceLease)) {
+		return nil
+	}
+	message := fmt.Sprintf("environment is reserved by %s until %s", reservation.Owner, reservation.ExpiresAt.Format(time.RFC3339))
+	if reservation.Reason != "" {
+		message = fmt.Sprintf("%s: %s", message, reservation.Reason)
+	}
+	return actionError{Status: http.StatusConflict, Message: message}
+}
+
+// applyEnvReservations adds reservation information to the cached environments
+func applyEnvReservations() {
+	for i := range cachedTable {
+		cachedTable[i].Reservation = nil
+		if reservation, found := getEnvReservation(cachedTable[i].ID); found {
+			cachedTable[i].Reservation = &reservation
+		}
+	}
+}
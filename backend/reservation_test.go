@@ -0,0 +1,88 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseReservationDuration(t *testing.T) {
+	reservationDefaultDuration = 8 * time.Hour
+	reservationMaxDuration = 24 * time.Hour
+
+	for query, expected := range map[string]time.Duration{
+		"":                8 * time.Hour,
+		"?duration=2h":    2 * time.Hour,
+		"?duration=48h":   -1,
+		"?duration=-1h":   -1,
+		"?duration=wrong": -1,
+	} {
+		req, _ := http.NewRequest("POST", "/"+query, nil)
+		duration, err := parseReservationDuration(req)
+		if expected < 0 && err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+		if expected > 0 && (err != nil || duration != expected) {
+			t.Errorf("%s: got %v (err: %v) but expected %v", query, duration, err, expected)
+		}
+	}
+}
+
+func TestReservation(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	if _, err := reserveEnv(envID, "owner1", "testing", time.Hour, false); err != nil {
+		t.Fatalf("reserveEnv returned an error: %v", err)
+	}
+	if _, err := reserveEnv(envID, "owner2", "", time.Hour, false); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected a conflict when reserving a reserved env, got: %v", err)
+	}
+	updateEnvDetails()
+	if env, _ := getEnvironmentByID(envID); env.Reservation == nil || env.Reservation.Owner != "owner1" {
+		t.Errorf("reservation is not reflected in env: %v", env.Reservation)
+	}
+
+	// only the owner (or force) may stop the env
+	stop := powerAction{EnvID: envID, Action: "stop", Actor: "owner2"}
+	if _, err := performPowerAction(stop); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected stop to be refused, got: %v", err)
+	}
+	if _, err := releaseEnv(envID, "owner2", false); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected release to be refused, got: %v", err)
+	}
+	stop.Actor = "owner1"
+	if err := checkPowerAction(stop); getStatusCode(err) != http.StatusConflict {
+		t.Errorf("expected an unauthenticated owner to be refused, got: %v", err)
+	}
+	stop.ActorTrusted = true
+	if err := checkPowerAction(stop); err != nil {
+		t.Errorf("owner was refused: %v", err)
+	}
+	stop.ActorTrusted = false
+	stop.Actor = "owner2"
+	stop.Force = true
+	if err := checkPowerAction(stop); err != nil {
+		t.Errorf("forced action was refused: %v", err)
+	}
+
+	// release the reservation
+	if _, err := releaseEnv(envID, "owner1", false); err != nil {
+		t.Errorf("releaseEnv returned an error: %v", err)
+	}
+	if _, found := getEnvReservation(envID); found {
+		t.Error("reservation was not released")
+	}
+
+	// expired reservations are released automatically
+	envReservations[envID] = envReservation{EnvID: envID, Owner: "owner1", ExpiresAt: time.Now().Add(-time.Second)}
+	if _, found := getEnvReservation(envID); found {
+		t.Error("expired reservation was not released")
+	}
+}
@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"fmt"
+	"sort"
+)
+
+var (
+	// values are set by ConfigInit
+	roleTagKey string
+)
+
+// envRole is the state of the instances of an environment with the same role, used for api responses.
+// instances without a role tag have an empty role
+type envRole struct {
+	Role             string `json:"role" groups:"details"`
+	State            string `json:"state" groups:"details"`
+	RunningInstances int    `json:"running_instances" groups:"details"`
+	StoppedInstances int    `json:"stopped_instances" groups:"details"`
+	TotalInstances   int    `json:"total_instances" groups:"details"`
+}
+
+// hasRole returns true if the instance has one of the roles, or when no roles are given
+func hasRole(instance virtualMachine, roles []string) bool {
+	return len(roles) == 0 || stringInSlice(instance.Role, roles)
+}
+
+// computeEnvState determines the state of an environment from the counts of its instances
+func computeEnvState(total, running, stopped int) string {
+	switch {
+	case total == running:
+		return EnvStateRunning
+	case total == stopped:
+		return EnvStateStopped
+	case total == running+stopped:
+		return EnvStateMixed
+	}
+	return EnvStateChanging
+}
+
+// getEnvRoles returns the state of an environment for each role, sorted by role.
+// environments without role tags have no breakdown
+func getEnvRoles(env environment) (roles []envRole) {
+	byRole := map[string]*envRole{}
+	tagged := false
+	for _, instance := range env.Instances {
+		role, found := byRole[instance.Role]
+		if !found {
+			role = &envRole{Role: instance.Role}
+			byRole[instance.Role] = role
+		}
+		tagged = tagged || instance.Role != ""
+		role.TotalInstances++
+		switch instance.State {
+		case "running":
+			role.RunningInstances++
+		case "stopped":
+			role.StoppedInstances++
+		}
+	}
+	if !tagged {
+		return nil
+	}
+	for _, role := range byRole {
+		role.State = computeEnvState(role.TotalInstances, role.RunningInstances, role.StoppedInstances)
+		roles = append(roles, *role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Role < roles[j].Role })
+	return
+}
+
+// validateRoles returns an error if one of the roles has no instances in the environment
+func validateRoles(env environment, roles []string) error {
+	for _, role := range roles {
+		found := false
+		for _, instance := range env.Instances {
+			if instance.Role == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("env %s has no instances with role: %s", env.Name, role)
+		}
+	}
+	return nil
+}
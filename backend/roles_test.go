@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPartialToggleByRole(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	for e := range cachedTable {
+		if cachedTable[e].ID == envID {
+			for i, role := range []string{"app", "app", "db", "loadgen", "loadgen", ""} {
+				cachedTable[e].Instances[i].Role = role
+			}
+		}
+	}
+	updateEnvDetails()
+
+	env, _ := getEnvironmentByID(envID)
+	if err := validateRoles(env, []string{"app", "unknown"}); err == nil {
+		t.Error("expected an unknown role to be invalid")
+	}
+	action := powerAction{EnvID: envID, Action: "start", Roles: []string{"app", "db"}, Force: true}
+	if count, _ := getActionImpact(action); count != 3 {
+		t.Errorf("expected 3 instances to be started, got %d", count)
+	}
+	if _, err := performPowerAction(action); err != nil {
+		t.Fatalf("partial start returned an error: %v", err)
+	}
+	updateEnvDetails()
+
+	env, _ = getEnvironmentByID(envID)
+	if env.State != EnvStateMixed || env.RunningInstances != 3 {
+		t.Errorf("expected a mixed env with 3 running instances, got %s with %d", env.State, env.RunningInstances)
+	}
+	expected := map[string]string{"": EnvStateStopped, "app": EnvStateRunning, "db": EnvStateRunning, "loadgen": EnvStateStopped}
+	if len(env.Roles) != len(expected) {
+		t.Fatalf("unexpected roles: %+v", env.Roles)
+	}
+	for _, role := range env.Roles {
+		if role.State != expected[role.Role] {
+			t.Errorf("role %q: expected %s, got %s", role.Role, expected[role.Role], role.State)
+		}
+	}
+
+	// stopping a role keeps the other roles running
+	if _, err := performPowerAction(powerAction{EnvID: envID, Action: "stop", Roles: []string{"db"}, Force: true}); err != nil {
+		t.Fatalf("partial stop returned an error: %v", err)
+	}
+	updateEnvDetails()
+	if env, _ = getEnvironmentByID(envID); env.RunningInstances != 2 {
+		t.Errorf("expected 2 running instances, got %d", env.RunningInstances)
+	}
+
+	// a lease would stop the roles which were not started
+	checkHandlerStatus(t, "POST", getEndpoint("env/"+envID+"/start?role=loadgen&ttl=2h"), "", http.StatusBadRequest)
+	if _, found := getEnvLease(envID); found {
+		t.Error("expected no lease for a partial start")
+	}
+}
+
+func TestGetEnvRolesWithoutTags(t *testing.T) {
+	env := environment{Instances: []virtualMachine{{State: "running"}, {State: "stopped"}}}
+	if roles := getEnvRoles(env); roles != nil {
+		t.Errorf("expected no role breakdown, got: %+v", roles)
+	}
+}
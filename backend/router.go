@@ -65,12 +65,114 @@ var routes = Routes{
 		getEndpoint("env/{env-id}/{state:start|stop}"),
 		handlerEnvPowerToggle,
 	},
+	Route{
+		"GroupSummary",
+		"GET",
+		getEndpoint("group/{group-name}/summary"),
+		handlerGroupSummary,
+	},
+	Route{
+		"GroupPowerToggle",
+		"POST",
+		getEndpoint("group/{group-name}/{state:start|stop}"),
+		handlerGroupPowerToggle,
+	},
+	Route{
+		"GroupAction",
+		"GET",
+		getEndpoint("group/{group-name}/action/{action-id}"),
+		handlerGroupAction,
+	},
+	Route{
+		"EnvForecast",
+		"GET",
+		getEndpoint("env/{env-id}/forecast"),
+		handlerEnvForecast,
+	},
+	Route{
+		"EnvLease",
+		"POST",
+		getEndpoint("env/{env-id}/lease/{action:extend|cancel}"),
+		handlerEnvLease,
+	},
+	Route{
+		"EnvReservation",
+		"POST",
+		getEndpoint("env/{env-id}/{action:reserve|release}"),
+		handlerEnvReservation,
+	},
 	Route{
 		"InstancePowerToggle",
 		"POST",
 		getEndpoint("instance/{instance-id}/{state:start|stop}"),
 		handlerInstancePowerToggle,
 	},
+	Route{
+		"FreezeList",
+		"GET",
+		getEndpoint("freezes"),
+		handlerFreezeList,
+	},
+	Route{
+		"FreezeCreate",
+		"POST",
+		getEndpoint("freezes"),
+		requireAdmin(handlerFreezeCreate),
+	},
+	Route{
+		"FreezeDelete",
+		"DELETE",
+		getEndpoint("freezes/{freeze-id}"),
+		requireAdmin(handlerFreezeDelete),
+	},
+	Route{
+		"ApprovalList",
+		"GET",
+		getEndpoint("approvals"),
+		handlerApprovalList,
+	},
+	Route{
+		"ApprovalDecision",
+		"POST",
+		getEndpoint("approvals/{approval-id}/{decision:approve|reject}"),
+		handlerApprovalDecision,
+	},
+	Route{
+		"NotificationStats",
+		"GET",
+		getEndpoint("notifications/stats"),
+		handlerNotificationStats,
+	},
+	Route{
+		"Pricing",
+		"GET",
+		getEndpoint("pricing"),
+		handlerPricing,
+	},
+	Route{
+		"PricingRefresh",
+		"POST",
+		getEndpoint("pricing/refresh"),
+		requireAdmin(handlerPricingRefresh),
+	},
+	Route{
+		"Report",
+		"GET",
+		getEndpoint("reports/{period:daily|weekly|monthly}"),
+		handlerReport,
+	},
+	Route{
+		"SlackCommand",
+		"POST",
+		getEndpoint("slack/command"),
+		requireSlackSignature(handlerSlackCommand),
+	},
+	Route{
+		"SlackInteractive",
+		"POST",
+		getEndpoint("slack/interactive"),
+		requireSlackSignature(handlerSlackInteractive),
+	},
 	Route{
 		"Config",
 		"GET",
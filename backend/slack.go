@@ -1,12 +1,12 @@
 package backend
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"text/template"
 	"time"
 )
 
@@ -55,29 +55,30 @@ func createHTTPClient() *http.Client {
 	}
 }
 
-// slackSendMessage boradcasts a text message to all configured webhooks
-func slackSendMessage(message string) (errs []error) {
-	if !slackEnabled || len(slackWebHooks) == 0 || message == "" {
-		return
-	}
+// slackNotifier sends events to a slack incoming webhook
+type slackNotifier struct {
+	webhookURL string
+	templates  map[string]*template.Template
+}
 
-	for i, hookURL := range slackWebHooks {
-		body := map[string]string{"text": message}
-		jsonBytes, _ := json.Marshal(body)
-		res, err := slackClient.Post(hookURL, "application/json", bytes.NewBuffer(jsonBytes))
-		if err != nil {
-			log.Errorf("error sending slack message (%d/%d) %s", i+1, len(slackWebHooks), err)
-			errs = append(errs, err)
-			continue
-		}
-		defer res.Body.Close()
-		if res.StatusCode == 200 {
-			log.Infof("sent slack message successfully (%d/%d)", i+1, len(slackWebHooks))
-		} else {
-			log.Errorf("slack API response code was not successful (%d/%d): %v", i+1, len(slackWebHooks), res.StatusCode)
-			errs = append(errs, fmt.Errorf("slack API response code was not successful (%d/%d): %v", i+1, len(slackWebHooks), res.StatusCode))
-		}
+func (n slackNotifier) notify(event notificationEvent) error {
+	message := renderMessage(event, slackMarkup, n.templates)
+	// lease reminders get interactive buttons, unless they are templated
+	if event.Type == EventLeaseReminder && slackSigningSecret != "" && getMessageTemplate(event, n.templates) == nil {
+		message = slackLeaseReminderMessage(event, message)
 	}
+	return slackPostMessage(n.webhookURL, message)
+}
 
-	return
+// slackPostMessage sends a message to a webhook.
+// json messages (ie. block kit) are sent as is, anything else as text
+func slackPostMessage(hookURL, message string) error {
+	body := []byte(message)
+	if !isJSONMessage(message) {
+		body, _ = json.Marshal(map[string]string{"text": message})
+	}
+	if err := postJSON(slackClient, hookURL, body, nil); err != nil {
+		return fmt.Errorf("slack API: %v", err)
+	}
+	return nil
 }
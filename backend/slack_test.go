@@ -2,7 +2,6 @@ package backend
 
 import (
 	"bytes"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"testing"
@@ -18,11 +17,13 @@ func TestCreateHTTPClient(t *testing.T) {
 	}
 }
 
-// TestSlackSendMessage tests the slack client behaviour
-func TestSlackSendMessage(t *testing.T) {
+// TestSlackNotifier tests the slack client behaviour
+func TestSlackNotifier(t *testing.T) {
 
-	slackEnabled = true
 	slackWebHooks = []string{"https://slack.linuxctl.com"}
+	n := slackNotifier{webhookURL: slackWebHooks[0]}
+	event := notificationEvent{Type: EventEnvStopped, EnvName: "test", Region: "ca-central-1", InstanceCount: 2, VCPU: 4, MemoryGB: 8}
+	expectedBody := `{"text":"*STOPPING* environment *` + "`test`" + `* in region _ca-central-1_ --\u003e *2 instance(s)* totaling *4 vCPU(s)* \u0026 *8GB* memory"}`
 
 	// replace slackClient to avoid making a real http request
 	slackClient = NewTestClient(func(req *http.Request) *http.Response {
@@ -33,8 +34,8 @@ func TestSlackSendMessage(t *testing.T) {
 		if req.URL.String() != slackWebHooks[0] {
 			t.Errorf("slack client sent to unexpected endpoint: %v", req.URL.String())
 		}
-		if fmt.Sprintf("%s", req.Body) != "{{\"text\":\"test data\"}}" {
-			t.Errorf("slack client sent unexpected request body: %v", req.Body)
+		if body, _ := ioutil.ReadAll(req.Body); string(body) != expectedBody {
+			t.Errorf("slack client sent unexpected request body: %s", body)
 		}
 
 		// response to slack client
@@ -46,9 +47,8 @@ func TestSlackSendMessage(t *testing.T) {
 		}
 	})
 
-	errs := slackSendMessage("test data")
-	if len(errs) > 0 {
-		t.Errorf("unexpected errors occured during slack client test: %v", errs)
+	if err := n.notify(event); err != nil {
+		t.Errorf("unexpected error occured during slack client test: %v", err)
 	}
 
 	// this time, we respond with a non-200 code
@@ -62,9 +62,8 @@ func TestSlackSendMessage(t *testing.T) {
 		}
 	})
 
-	errs = slackSendMessage("test data")
-	if len(errs) != 1 {
-		t.Errorf("expected 1 error but got: %v", errs)
+	if err := n.notify(event); err == nil {
+		t.Error("expected an error but got none")
 	}
 }
 
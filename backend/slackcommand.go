@@ -0,0 +1,280 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// requests with an older timestamp are refused to prevent replay attacks
+	slackMaxRequestAge = 5 * time.Minute
+
+	// action ids of the interactive buttons
+	slackActionKeepRunning = "keep_running"
+	slackActionStopNow     = "stop_now"
+)
+
+var (
+	// values are set by ConfigInit
+	slackSigningSecret       string
+	slackUsers               map[string]string
+	slackKeepRunningDuration time.Duration
+)
+
+// slackInteraction is the payload of an interactive button click
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// verifySlackSignature checks the signature of a slack request.
+// see https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > slackMaxRequestAge || age < -slackMaxRequestAge {
+		return fmt.Errorf("request timestamp is too old")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("invalid request signature")
+	}
+	return nil
+}
+
+// requireSlackSignature wraps a handler so that it can only be called by slack.
+// slack endpoints are disabled when no signing secret is configured
+func requireSlackSignature(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if slackSigningSecret == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "{\"error\":\"slack endpoints are disabled\"}\n")
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err == nil {
+			err = verifySlackSignature(slackSigningSecret, req.Header, body, time.Now())
+		}
+		if err != nil {
+			log.Warningf("refused slack request: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "{\"error\":\"%v\"}\n", err)
+			return
+		}
+		// the body has been consumed, restore it for the form parser
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler(w, req)
+	}
+}
+
+// getSlackActor maps a slack user to an actor. unmapped users are recorded by their user id
+// (prefixed with slack:), user names are not unique and can be changed by the users themselves
+func getSlackActor(userID string) string {
+	// viper lowercases map keys
+	if actor, found := slackUsers[strings.ToLower(userID)]; found {
+		return actor
+	}
+	return "slack:" + userID
+}
+
+// runSlackCommand executes a slash command and returns the response text.
+// supported commands: list, start <env> [ttl], stop <env>
+func runSlackCommand(text, actor string) string {
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	switch {
+	case args[0] == "list":
+		if len(cachedTable) == 0 {
+			return "no environments found"
+		}
+		lines := []string{}
+		for _, env := range cachedTable {
+			lines = append(lines, fmt.Sprintf("`%s` (%s) *%s* --> %d/%d instance(s) running", env.Name, env.Region, env.State, env.RunningInstances, env.TotalInstances))
+		}
+		return strings.Join(lines, "\n")
+
+	case (args[0] == "start" && (len(args) == 2 || len(args) == 3)) || (args[0] == "stop" && len(args) == 2):
+		env, found := getEnvironmentByName(args[1])
+		if !found {
+			return fmt.Sprintf("environment `%s` not found", args[1])
+		}
+		var leaseExpiresAt time.Time
+		if len(args) == 3 {
+			ttl, err := time.ParseDuration(args[2])
+			if err != nil || ttl <= 0 {
+				return fmt.Sprintf("invalid ttl: %s", args[2])
+			}
+			if leaseMaxTTL > 0 && ttl > leaseMaxTTL {
+				return fmt.Sprintf("lease exceeds the maximum allowed ttl of %v", leaseMaxTTL)
+			}
+			leaseExpiresAt = time.Now().Add(ttl)
+		}
+		action := powerAction{EnvID: env.ID, Action: args[0], Actor: actor, Source: ActionSourceSlack, ActorTrusted: true}
+		if _, err := performPowerAction(action); err != nil {
+			return slackActionError(action, env, err)
+		}
+		if !leaseExpiresAt.IsZero() {
+			setEnvLease(env.ID, actor, leaseExpiresAt)
+			return fmt.Sprintf("starting `%s` until %s", env.Name, leaseExpiresAt.Format(time.RFC3339))
+		}
+		return fmt.Sprintf("%s of `%s` was requested", args[0], env.Name)
+	}
+	return "usage: `list`, `start <env> [ttl]` or `stop <env>`"
+}
+
+// slackActionError returns the response text for a refused or failed power action
+func slackActionError(action powerAction, env environment, err error) string {
+	if aErr, ok := err.(actionError); ok && aErr.Details["approval_id"] != nil {
+		return fmt.Sprintf("%s of `%s` is waiting for approval `%v`", action.Action, env.Name, aErr.Details["approval_id"])
+	}
+	return fmt.Sprintf("%s of `%s` was not performed: %v", action.Action, env.Name, err)
+}
+
+// runSlackInteraction executes a button click and returns the response text
+func runSlackInteraction(actionID, envID, actor string) string {
+	env, found := getEnvironmentByID(envID)
+	if !found {
+		return "environment not found"
+	}
+
+	switch actionID {
+	case slackActionKeepRunning:
+		lease, found := getEnvLease(envID)
+		if !found {
+			return fmt.Sprintf("`%s` has no lease anymore", env.Name)
+		}
+		expiresAt := time.Now().Add(slackKeepRunningDuration)
+		if expiresAt.After(lease.ExpiresAt) {
+			lease, _ = extendEnvLease(envID, expiresAt)
+		}
+		log.Infof("lease for env %s [%s] kept running by %s", env.Name, envID, actor)
+		return fmt.Sprintf("`%s` keeps running until %s (by %s)", env.Name, lease.ExpiresAt.Format(time.RFC3339), actor)
+	case slackActionStopNow:
+		action := powerAction{EnvID: envID, Action: "stop", Actor: actor, Source: ActionSourceSlack, ActorTrusted: true}
+		if _, err := performPowerAction(action); err != nil {
+			return slackActionError(action, env, err)
+		}
+		return fmt.Sprintf("stop of `%s` was requested by %s", env.Name, actor)
+	}
+	return fmt.Sprintf("unknown action: %s", actionID)
+}
+
+// slackLeaseReminderMessage returns a block kit message with interactive buttons for a lease reminder
+func slackLeaseReminderMessage(event notificationEvent, text string) string {
+	button := func(label, actionID, style string) map[string]interface{} {
+		b := map[string]interface{}{
+			"type":      "button",
+			"text":      map[string]string{"type": "plain_text", "text": label},
+			"action_id": actionID,
+			"value":     event.EnvID,
+		}
+		if style != "" {
+			b["style"] = style
+		}
+		return b
+	}
+	message, _ := json.Marshal(map[string]interface{}{
+		"text": text,
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": text},
+			},
+			map[string]interface{}{
+				"type": "actions",
+				"elements": []interface{}{
+					button(fmt.Sprintf("Keep running %v", shortDuration(slackKeepRunningDuration)), slackActionKeepRunning, "primary"),
+					button("Stop now", slackActionStopNow, "danger"),
+				},
+			},
+		},
+	})
+	return string(message)
+}
+
+// shortDuration formats a duration without zero units (ie. 2h instead of 2h0m0s)
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// slackRespond posts a message to the response url of a slash command or an interaction
+func slackRespond(responseURL, text string) {
+	if responseURL == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{"text": text, "response_type": "in_channel", "replace_original": false})
+	if err := postJSON(slackClient, responseURL, body, nil); err != nil {
+		log.Errorf("error responding to slack interaction: %v", err)
+	}
+}
+
+// handler for slack slash commands
+func handlerSlackCommand(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	actor := getSlackActor(req.FormValue("user_id"))
+	command := req.FormValue("text")
+	if args := strings.Fields(command); len(args) > 0 && (args[0] == "start" || args[0] == "stop") {
+		// power actions can take longer than slack waits for a response (3s),
+		// acknowledge right away and post the result to the response url
+		responseURL := req.FormValue("response_url")
+		go func() {
+			slackRespond(responseURL, runSlackCommand(command, actor))
+		}()
+		response, err := json.Marshal(map[string]string{"response_type": "ephemeral", "text": fmt.Sprintf("`%s` is being processed", command)})
+		writeJSONResponse(w, err, response)
+		return
+	}
+	text := runSlackCommand(command, actor)
+	response, err := json.Marshal(map[string]string{"response_type": "in_channel", "text": text})
+	writeJSONResponse(w, err, response)
+}
+
+// handler for slack interactive components (buttons)
+func handlerSlackInteractive(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var interaction slackInteraction
+	if err := json.Unmarshal([]byte(req.FormValue("payload")), &interaction); err != nil || len(interaction.Actions) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "{\"error\":\"invalid payload\"}\n")
+		return
+	}
+	actor := getSlackActor(interaction.User.ID)
+	text := runSlackInteraction(interaction.Actions[0].ActionID, interaction.Actions[0].Value, actor)
+	slackRespond(interaction.ResponseURL, text)
+	fmt.Fprint(w, "{\"status\":\"OK\"}\n")
+}
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signSlackRequest adds valid slack signature headers to the request
+func signSlackRequest(req *http.Request, secret string, body string, timestamp time.Time) {
+	ts := fmt.Sprintf("%d", timestamp.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", ts, body)
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Now()
+	body := "text=list"
+	for _, test := range []struct {
+		secret    string
+		timestamp time.Time
+		valid     bool
+	}{
+		{"s3cr3t", now, true},
+		{"wrong", now, false},
+		{"s3cr3t", now.Add(-10 * time.Minute), false},
+	} {
+		req, _ := http.NewRequest("POST", "/", nil)
+		signSlackRequest(req, test.secret, body, test.timestamp)
+		if err := verifySlackSignature("s3cr3t", req.Header, []byte(body), now); (err == nil) != test.valid {
+			t.Errorf("%+v: unexpected result: %v", test, err)
+		}
+	}
+}
+
+func TestSlackCommandHandler(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	slackUsers = map[string]string{"u012abc": "jdoe"}
+	responded := make(chan string, 1)
+	slackClient = NewTestClient(func(req *http.Request) *http.Response {
+		b, _ := ioutil.ReadAll(req.Body)
+		responded <- string(b)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(&bytes.Buffer{}), Header: make(http.Header)}
+	})
+	defer func() { slackSigningSecret = ""; slackUsers = nil; slackClient = createHTTPClient() }()
+
+	body := url.Values{"text": {"start mockenv7"}, "user_id": {"U012ABC"}, "user_name": {"john"},
+		"response_url": {"https://hooks.slack.com/commands/1"}}.Encode()
+	for _, test := range []struct {
+		secret string
+		sign   string
+		status int
+	}{
+		{"", "s3cr3t", http.StatusForbidden},
+		{"s3cr3t", "wrong", http.StatusUnauthorized},
+		{"s3cr3t", "s3cr3t", http.StatusOK},
+	} {
+		slackSigningSecret = test.secret
+		req, _ := http.NewRequest("POST", getEndpoint("slack/command"), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		signSlackRequest(req, test.sign, body, time.Now())
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("expected status %d but got %d: %s", test.status, rr.Code, rr.Body.String())
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		if !strings.Contains(rr.Body.String(), "`start mockenv7` is being processed") {
+			t.Errorf("unexpected response: %s", rr.Body.String())
+		}
+		select {
+		case text := <-responded:
+			if !strings.Contains(text, "start of `mockenv7` was requested") {
+				t.Errorf("unexpected slack response: %s", text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("the result was not posted to the response url")
+		}
+	}
+}
+
+func TestRunSlackCommand(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	leaseMaxTTL = 0
+
+	for _, test := range []struct {
+		text     string
+		expected string
+	}{
+		{"", "usage:"},
+		{"reboot mockenv7", "usage:"},
+		{"list", "`mockenv7`"},
+		{"start unknown", "environment `unknown` not found"},
+		{"start mockenv7 never", "invalid ttl"},
+		{"start mockenv7 2h", "starting `mockenv7` until"},
+		{"stop mockenv7", "stop of `mockenv7` was requested"},
+	} {
+		if text := runSlackCommand(test.text, "jdoe"); !strings.Contains(text, test.expected) {
+			t.Errorf("%q: expected %q in %q", test.text, test.expected, text)
+		}
+	}
+}
+
+func TestRunSlackInteraction(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+	if _, err := startupEnv(envID, false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+	slackKeepRunningDuration = 2 * time.Hour
+	setEnvLease(envID, "jdoe", time.Now().Add(10*time.Minute))
+	defer deleteEnvLease(envID)
+
+	if text := runSlackInteraction(slackActionKeepRunning, envID, "jdoe"); !strings.Contains(text, "keeps running until") {
+		t.Errorf("unexpected response: %s", text)
+	}
+	if lease, _ := getEnvLease(envID); lease.ExpiresAt.Before(time.Now().Add(time.Hour)) {
+		t.Errorf("lease was not extended: %v", lease.ExpiresAt)
+	}
+	if text := runSlackInteraction(slackActionStopNow, envID, "jdoe"); !strings.Contains(text, "was requested") {
+		t.Errorf("unexpected response: %s", text)
+	}
+	if text := runSlackInteraction(slackActionKeepRunning, "invalid", "jdoe"); text != "environment not found" {
+		t.Errorf("unexpected response: %s", text)
+	}
+}
+
+func TestSlackInteractiveHandler(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	if _, err := startupEnv("4f9f1afb29f1", false); err != nil {
+		t.Fatalf("startupEnv returned an error: %v", err)
+	}
+	updateEnvDetails()
+	slackSigningSecret = "s3cr3t"
+	defer func() { slackSigningSecret = "" }()
+
+	var responded string
+	slackClient = NewTestClient(func(req *http.Request) *http.Response {
+		b, _ := ioutil.ReadAll(req.Body)
+		responded = string(b)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(&bytes.Buffer{}), Header: make(http.Header)}
+	})
+	defer func() { slackClient = createHTTPClient() }()
+
+	payload := `{"type":"block_actions","user":{"id":"U1","username":"john"},"response_url":"https://hooks.slack.com/actions/1",` +
+		`"actions":[{"action_id":"stop_now","value":"4f9f1afb29f1"}]}`
+	body := url.Values{"payload": {payload}}.Encode()
+	req, _ := http.NewRequest("POST", getEndpoint("slack/interactive"), strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signSlackRequest(req, "s3cr3t", body, time.Now())
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(responded, "requested by slack:U1") {
+		t.Errorf("unexpected slack response: %s", responded)
+	}
+}
+
+func TestSlackLeaseReminderMessage(t *testing.T) {
+	slackKeepRunningDuration = 2 * time.Hour
+	message := slackLeaseReminderMessage(notificationEvent{Type: EventLeaseReminder, EnvID: "env1"}, "reminder")
+	for _, expected := range []string{`"action_id":"keep_running"`, `"action_id":"stop_now"`, `"text":"Keep running 2h"`, `"value":"env1"`} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("expected %s in %s", expected, message)
+		}
+	}
+	if !isJSONMessage(message) {
+		t.Error("reminder message is not valid json")
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		2 * time.Hour:    "2h",
+		90 * time.Minute: "1h30m",
+		30 * time.Second: "30s",
+	} {
+		if s := shortDuration(d); s != expected {
+			t.Errorf("expected %s but got %s", expected, s)
+		}
+	}
+}
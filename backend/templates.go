@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// template keys which are used when no template exists for the event type
+
+	// templateKeyError is used for events which report an error
+	templateKeyError = "error"
+	// templateKeyDefault is used for all other events
+	templateKeyDefault = "default"
+)
+
+var (
+	// values are set by ConfigInit
+	messageTemplates map[string]*template.Template
+
+	// functions available in message templates
+	templateFuncs = template.FuncMap{
+		"json":  templateJSON,
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"join":  strings.Join,
+		"money": func(v float64) string { return fmt.Sprintf("%.02f", v) },
+	}
+)
+
+// messageTemplateData is passed to message templates
+type messageTemplateData struct {
+	Event notificationEvent
+	// state of the environment when the event was created
+	Env   environment
+	Actor string
+	// affected instances: the toggled instance or all instances of the environment
+	Instances []virtualMachine
+	// hourly cost of the affected instances
+	HourlyCost float64
+	// the default message text of the channel
+	Text string
+}
+
+// templateJSON encodes a value as json. useful to escape strings in slack block kit templates
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// parseMessageTemplates parses templates by event type (or templateKeyError, templateKeyDefault)
+func parseMessageTemplates(raw map[string]string) (templates map[string]*template.Template, err error) {
+	templates = map[string]*template.Template{}
+	for key, text := range raw {
+		t, parseErr := template.New(key).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid template %s: %v", key, parseErr)
+			continue
+		}
+		templates[key] = t
+	}
+	return
+}
+
+// loadMessageTemplates parses the global message templates from the config file.
+// invalid templates are ignored
+func loadMessageTemplates() {
+	var err error
+	if messageTemplates, err = parseMessageTemplates(viper.GetStringMapString("notifications.templates")); err != nil {
+		log.Errorf("could not parse notifications.templates from config: %v", err)
+	}
+}
+
+// getMessageTemplate returns the template for the event.
+// channel templates take precedence over global templates
+func getMessageTemplate(event notificationEvent, channelTemplates map[string]*template.Template) *template.Template {
+	keys := []string{event.Type}
+	if isFailureEvent(event) {
+		keys = append(keys, templateKeyError)
+	}
+	keys = append(keys, templateKeyDefault)
+	for _, key := range keys {
+		if t, found := channelTemplates[key]; found {
+			return t
+		}
+		if t, found := messageTemplates[key]; found {
+			return t
+		}
+	}
+	return nil
+}
+
+// newMessageTemplateData returns the template data for the event
+func newMessageTemplateData(event notificationEvent, m eventMarkup) (data messageTemplateData) {
+	// the environment snapshot is lost when an event was spooled to disk
+	if event.env.ID == "" && event.EnvID != "" {
+		event.env, _ = getEnvironmentByID(event.EnvID)
+	}
+	data = messageTemplateData{
+		Event:     event,
+		Env:       event.env,
+		Actor:     event.Actor,
+		Instances: []virtualMachine{},
+		Text:      eventText(event, m),
+	}
+	for _, instance := range event.env.Instances {
+		if event.InstanceID != "" && instance.ID != event.InstanceID {
+			continue
+		}
+		data.Instances = append(data.Instances, instance)
+		data.HourlyCost += instance.PricingHourly
+	}
+	return
+}
+
+// renderMessage renders the event with a matching template, or with the default text when there is none.
+// the default text is also used when the template fails
+func renderMessage(event notificationEvent, m eventMarkup, channelTemplates map[string]*template.Template) string {
+	data := newMessageTemplateData(event, m)
+	t := getMessageTemplate(event, channelTemplates)
+	if t == nil {
+		return data.Text
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.Errorf("error rendering template %s: %v", t.Name(), err)
+		return data.Text
+	}
+	return buf.String()
+}
+
+// isJSONMessage returns true if a rendered message is a json payload (ie. slack block kit)
+// which should be sent as is
+func isJSONMessage(message string) bool {
+	message = strings.TrimSpace(message)
+	return strings.HasPrefix(message, "{") && json.Valid([]byte(message))
+}
@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseMessageTemplates(t *testing.T) {
+	templates, err := parseMessageTemplates(map[string]string{
+		EventEnvStopped: "{{ .Env.Name }} stopped",
+		"invalid":       "{{ .Env.Name ",
+	})
+	if err == nil {
+		t.Error("expected an error for the invalid template")
+	}
+	if _, found := templates[EventEnvStopped]; !found || len(templates) != 1 {
+		t.Errorf("unexpected templates: %v", templates)
+	}
+}
+
+func TestRenderMessage(t *testing.T) {
+	viper.Set("notifications.templates", map[string]string{
+		templateKeyDefault: "default: {{ .Text }}",
+		templateKeyError:   "error: {{ .Event.Error }}",
+	})
+	defer func() { viper.Set("notifications.templates", nil); loadMessageTemplates() }()
+	loadMessageTemplates()
+
+	env := environment{
+		Name:   "test",
+		Region: "ca-central-1",
+		Instances: []virtualMachine{
+			{ID: "vm1", Name: "web", PricingHourly: 0.5},
+			{ID: "vm2", Name: "db", PricingHourly: 1.25},
+		},
+	}
+	channelTemplates, _ := parseMessageTemplates(map[string]string{
+		EventEnvStopped:      `{{ upper .Env.Name }} stopped by {{ .Actor }}: {{ range .Instances }}{{ .Name }} {{ end }}costing {{ money .HourlyCost }}/h`,
+		EventInstanceStopped: `{{ range .Instances }}{{ .Name }}{{ end }} costing {{ money .HourlyCost }}/h`,
+		EventEnvStarted:      `{{ .Env.Name.Invalid }}`,
+	})
+
+	stopped := newEnvEvent(EventEnvStopped, env)
+	stopped.Actor = "jdoe"
+	instanceStopped := newEnvEvent(EventInstanceStopped, env)
+	instanceStopped.InstanceID = "vm2"
+	failed := newEnvEvent(EventEnvStopFailed, env)
+	failed.Error = "boom"
+	started := newEnvEvent(EventEnvStarted, env)
+
+	for _, test := range []struct {
+		event     notificationEvent
+		templates map[string]*template.Template
+		expected  string
+	}{
+		{stopped, channelTemplates, "TEST stopped by jdoe: web db costing 1.75/h"},
+		{instanceStopped, channelTemplates, "db costing 1.25/h"},
+		{failed, channelTemplates, "error: boom"},
+		{stopped, nil, "default: " + eventText(stopped, slackMarkup)},
+		// a failing template falls back to the default text
+		{started, channelTemplates, eventText(started, slackMarkup)},
+	} {
+		if message := renderMessage(test.event, slackMarkup, test.templates); message != test.expected {
+			t.Errorf("%s: expected %q but got %q", test.event.Type, test.expected, message)
+		}
+	}
+}
+
+func TestSlackBlockKitMessage(t *testing.T) {
+	templates, err := parseMessageTemplates(map[string]string{
+		templateKeyDefault: `{"blocks":[{"type":"section","text":{"type":"mrkdwn","text":{{ json .Text }}}}]}`,
+	})
+	if err != nil {
+		t.Fatalf("parseMessageTemplates returned an error: %v", err)
+	}
+	event := notificationEvent{Type: EventEnvStopped, EnvName: "te\"st"}
+	expectedBody := `{"blocks":[{"type":"section","text":{"type":"mrkdwn","text":` + mustJSON(eventText(event, slackMarkup)) + `}}]}`
+
+	slackClient = NewTestClient(func(req *http.Request) *http.Response {
+		if body, _ := ioutil.ReadAll(req.Body); string(body) != expectedBody {
+			t.Errorf("unexpected block kit body: %s", body)
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(&bytes.Buffer{}), Header: make(http.Header)}
+	})
+	defer func() { slackClient = createHTTPClient() }()
+
+	if err := (slackNotifier{webhookURL: "https://slack.example.com", templates: templates}).notify(event); err != nil {
+		t.Errorf("slack notifier returned an error: %v", err)
+	}
+}
+
+func TestIsJSONMessage(t *testing.T) {
+	for message, expected := range map[string]bool{
+		` {"text":"hi"}`: true,
+		`{not json}`:     false,
+		`*STOPPING*`:     false,
+	} {
+		if isJSONMessage(message) != expected {
+			t.Errorf("%s: expected %v", message, expected)
+		}
+	}
+}
+
+func mustJSON(v interface{}) string {
+	s, _ := templateJSON(v)
+	return s
+}
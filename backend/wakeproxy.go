@@ -0,0 +1,244 @@
+package backend
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// values are set by ConfigInit
+	wakeProxyEnabled       bool
+	wakeProxyHoldTimeout   time.Duration
+	wakeProxyStartTimeout  time.Duration
+	wakeProxyCheckInterval time.Duration
+	wakeProxyRoutes        []wakeRoute
+
+	// environments started by the proxy (by env ID), so that they are only started once
+	wakeStarts = map[string]time.Time{}
+	// lock to prevent concurrent access of the above map
+	wakeStartsLock sync.Mutex
+
+	// page shown to browsers while the environment is starting
+	wakePageTemplate = template.Must(template.New("wake").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta http-equiv="refresh" content="{{ .Refresh }}">
+  <title>{{ .Title }}</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 10%;">
+  <h1>{{ .Title }}</h1>
+  <p>{{ .Message }}</p>
+  <p><small>this page reloads every {{ .Refresh }} seconds</small></p>
+</body>
+</html>
+`))
+)
+
+// wakeRoute maps a hostname of the proxy to an environment and the backend which serves it
+type wakeRoute struct {
+	Host        string `mapstructure:"host"`
+	Environment string `mapstructure:"environment"`
+	Target      string `mapstructure:"target"`
+	// when set, an environment started by the proxy gets a lease, which is extended by requests (idle auto-stop)
+	LeaseTTL time.Duration `mapstructure:"lease_ttl"`
+
+	targetURL *url.URL
+	proxy     *httputil.ReverseProxy
+}
+
+// loadWakeRoutes parses the routes of the proxy from the config file
+func loadWakeRoutes() {
+	var configured []wakeRoute
+	if err := viper.UnmarshalKey("wake_proxy.routes", &configured); err != nil {
+		log.Errorf("could not parse wake_proxy.routes from config: %v", err)
+	}
+
+	wakeProxyRoutes = nil
+	for _, route := range configured {
+		target, err := url.Parse(route.Target)
+		if err != nil || target.Host == "" || route.Host == "" || route.Environment == "" {
+			log.Errorf("ignoring invalid wake proxy route %s: host, environment and target (url) are required", route.Host)
+			continue
+		}
+		route.Host = strings.ToLower(route.Host)
+		route.targetURL = target
+		route.proxy = httputil.NewSingleHostReverseProxy(target)
+		wakeProxyRoutes = append(wakeProxyRoutes, route)
+	}
+}
+
+// getWakeRoute returns the route of a request by its hostname (without port)
+func getWakeRoute(req *http.Request) (route wakeRoute, found bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, route := range wakeProxyRoutes {
+		if route.Host == host {
+			return route, true
+		}
+	}
+	return
+}
+
+// isTargetReady returns true if the backend of the route accepts connections
+func isTargetReady(route wakeRoute) bool {
+	address := route.targetURL.Host
+	if route.targetURL.Port() == "" {
+		port := "80"
+		if route.targetURL.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(route.targetURL.Hostname(), port)
+	}
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// wakeEnv starts the environment of the route, unless the proxy already started it within wake_proxy.start_timeout
+func wakeEnv(route wakeRoute, env environment, now time.Time) error {
+	// the start is reserved, so that concurrent requests do not start the environment again while it is sent
+	wakeStartsLock.Lock()
+	if startedAt, found := wakeStarts[env.ID]; found && now.Sub(startedAt) < wakeProxyStartTimeout {
+		wakeStartsLock.Unlock()
+		return nil
+	}
+	wakeStarts[env.ID] = now
+	wakeStartsLock.Unlock()
+
+	log.Infof("wake proxy: starting env %s [%s] for a request to %s", env.Name, env.ID, route.Host)
+	action := powerAction{
+		EnvID:  env.ID,
+		Action: "start",
+		Actor:  route.Host,
+		Source: ActionSourceWakeProxy,
+	}
+	if _, err := performPowerAction(action); err != nil {
+		wakeStartsLock.Lock()
+		if wakeStarts[env.ID].Equal(now) {
+			delete(wakeStarts, env.ID)
+		}
+		wakeStartsLock.Unlock()
+		return err
+	}
+	if route.LeaseTTL > 0 {
+		setEnvLease(env.ID, route.Host, now.Add(route.LeaseTTL))
+	}
+	return nil
+}
+
+// keepEnvAwake extends the lease of an environment which was started by the proxy, once half of its ttl has passed
+func keepEnvAwake(route wakeRoute, envID string, now time.Time) {
+	if route.LeaseTTL <= 0 {
+		return
+	}
+	if lease, found := getEnvLease(envID); found && lease.Owner == route.Host && lease.ExpiresAt.Before(now.Add(route.LeaseTTL/2)) {
+		extendEnvLease(envID, now.Add(route.LeaseTTL))
+	}
+}
+
+// acceptsHTML returns true if the request comes from a browser
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// writeWakePage shows a page which reloads until the environment has started
+func writeWakePage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(status)
+	wakePageTemplate.Execute(w, map[string]interface{}{"Title": title, "Message": message, "Refresh": 5})
+}
+
+// writeWakeError writes an error of the proxy as a page (for browsers) or json
+func writeWakeError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	if acceptsHTML(req) {
+		writeWakePage(w, status, http.StatusText(status), message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "{\"error\":%q}\n", message)
+}
+
+// handlerWakeProxy proxies requests to the backend of the environment mapped to their hostname.
+// when the backend does not answer, the environment is started. browsers receive a "starting" page,
+// other requests are held until the backend answers (up to wake_proxy.hold_timeout)
+func handlerWakeProxy(w http.ResponseWriter, req *http.Request) {
+	route, found := getWakeRoute(req)
+	if !found {
+		writeWakeError(w, req, http.StatusNotFound, fmt.Sprintf("no environment is mapped to %s", req.Host))
+		return
+	}
+	env, found := getEnvironmentByName(route.Environment)
+	if !found {
+		writeWakeError(w, req, http.StatusBadGateway, fmt.Sprintf("environment %s was not found", route.Environment))
+		return
+	}
+
+	if !isTargetReady(route) {
+		// a changing environment is already starting (or stopping)
+		if env.State == EnvStateStopped || env.State == EnvStateMixed {
+			if err := wakeEnv(route, env, time.Now()); err != nil {
+				log.Warningf("wake proxy: could not start env %s [%s]: %v", env.Name, env.ID, err)
+				writeWakeError(w, req, getStatusCode(err), fmt.Sprintf("environment %s could not be started: %v", env.Name, err))
+				return
+			}
+		}
+		if acceptsHTML(req) {
+			writeWakePage(w, http.StatusServiceUnavailable, fmt.Sprintf("Starting %s", env.Name),
+				fmt.Sprintf("environment %s is starting, please wait", env.Name))
+			return
+		}
+		deadline := time.Now().Add(wakeProxyHoldTimeout)
+		for !isTargetReady(route) {
+			if time.Now().After(deadline) {
+				writeWakeError(w, req, http.StatusGatewayTimeout, fmt.Sprintf("environment %s is starting, try again later", env.Name))
+				return
+			}
+			time.Sleep(wakeProxyCheckInterval)
+		}
+	}
+
+	// the environment is up, it may be started by the proxy again once it is stopped
+	wakeStartsLock.Lock()
+	delete(wakeStarts, env.ID)
+	wakeStartsLock.Unlock()
+	keepEnvAwake(route, env.ID, time.Now())
+	route.proxy.ServeHTTP(w, req)
+}
+
+// StartWakeProxy is a blocking function which serves the wake proxy (if enabled)
+func StartWakeProxy() {
+	if !wakeProxyEnabled {
+		return
+	}
+	address := fmt.Sprintf("%s:%s", viper.GetString("wake_proxy.bind_address"), viper.GetString("wake_proxy.bind_port"))
+	srv := &http.Server{
+		Addr:    address,
+		Handler: http.HandlerFunc(handlerWakeProxy),
+		// no write timeout: proxied responses may be streamed for a long time,
+		// and requests held while the environment is starting are bounded by wake_proxy.hold_timeout
+		ReadTimeout: httpReadTimeout,
+		IdleTimeout: httpIdleTimeout,
+	}
+	log.Infof("starting wake proxy on %s with %d route(s)", address, len(wakeProxyRoutes))
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalf("failed to start wake proxy: %s", err)
+	}
+}
@@ -0,0 +1,141 @@
+package backend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// startTestTarget serves a backend of an environment on the address
+func startTestTarget(address string) (*httptest.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "hello from %s", req.URL.Path)
+	}))
+	target.Listener.Close()
+	target.Listener = listener
+	target.Start()
+	return target, nil
+}
+
+func TestWakeProxy(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	envID := "4f9f1afb29f1"
+
+	// reserve an address for the backend, which is down until the environment is started
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not reserve an address: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	viper.Set("wake_proxy.routes", []map[string]interface{}{
+		{"host": "mockenv7.example.com", "environment": "mockenv7", "target": "http://" + address, "lease_ttl": "1h"},
+		{"host": "invalid.example.com", "environment": "mockenv7"},
+	})
+	defer viper.Set("wake_proxy.routes", nil)
+	loadWakeRoutes()
+	wakeProxyHoldTimeout = 5 * time.Second
+	wakeProxyStartTimeout = time.Minute
+	wakeProxyCheckInterval = 10 * time.Millisecond
+	defer func() {
+		wakeProxyRoutes = nil
+		wakeStarts = map[string]time.Time{}
+		deleteEnvLease(envID)
+	}()
+	if len(wakeProxyRoutes) != 1 {
+		t.Fatalf("expected 1 valid route, got %d", len(wakeProxyRoutes))
+	}
+
+	request := func(host, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+"/app", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handlerWakeProxy(w, req)
+		return w
+	}
+
+	if w := request("unknown.example.com", "application/json"); w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown host to be refused, got %d", w.Code)
+	}
+
+	// a browser request starts the environment and receives the starting page
+	w := request("mockenv7.example.com:8081", "text/html")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "mockenv7 is starting") {
+		t.Errorf("expected the starting page, got %d: %s", w.Code, w.Body.String())
+	}
+	updateEnvDetails()
+	if state, _ := getEnvState(envID); state != EnvStateRunning {
+		t.Errorf("expected the env to be started, got: %s", state)
+	}
+	if lease, found := getEnvLease(envID); !found || lease.Owner != "mockenv7.example.com" {
+		t.Errorf("expected a lease for the started env, got: %+v", lease)
+	}
+
+	// api requests are held until the backend answers
+	targets := make(chan *httptest.Server, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		target, err := startTestTarget(address)
+		if err != nil {
+			t.Errorf("could not start the backend: %v", err)
+		}
+		targets <- target
+	}()
+	w = request("mockenv7.example.com", "application/json")
+	if target := <-targets; target != nil {
+		defer target.Close()
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != http.StatusOK || string(body) != "hello from /app" {
+		t.Errorf("expected the request to be proxied, got %d: %s", w.Code, body)
+	}
+	if _, found := wakeStarts[envID]; found {
+		t.Error("expected the wake start to be cleared once the backend answers")
+	}
+}
+
+func TestWakeEnvFailure(t *testing.T) {
+	if err := resetMockData(); err != nil {
+		t.Fatalf("mockRefreshTable failed: %v", err)
+	}
+	env, found := getEnvironmentByName("mockenv7")
+	if !found {
+		t.Fatal("mockenv7 was not found")
+	}
+	wakeProxyStartTimeout = time.Minute
+	defer func() { wakeStarts = map[string]time.Time{} }()
+
+	f, err := addFreezeWindow(freezeWindow{
+		Reason:       "testing",
+		Environments: []string{"mockenv7"},
+		Actions:      []string{"start"},
+		Start:        time.Now().Add(-time.Hour).Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatalf("addFreezeWindow returned an error: %v", err)
+	}
+	defer deleteFreezeWindow(f.ID)
+
+	// a failed start is not reserved, so the next request tries again
+	route := wakeRoute{Host: "mockenv7.example.com", Environment: "mockenv7"}
+	if err := wakeEnv(route, env, time.Now()); getStatusCode(err) != http.StatusLocked {
+		t.Errorf("expected the start to be refused, got: %v", err)
+	}
+	if _, found := wakeStarts[env.ID]; found {
+		t.Error("expected the wake start to be removed after a failure")
+	}
+}
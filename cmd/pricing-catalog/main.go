@@ -0,0 +1,60 @@
+// pricing-catalog converts an AWS Pricing API bulk offer file for EC2 into a pricing catalog for aws-power-toggle.
+//
+// usage:
+//
+//	curl -sO https://pricing.us-east-1.amazonaws.com/offers/v1.0/aws/AmazonEC2/current/ca-central-1/index.json
+//	go run ./cmd/pricing-catalog -offer index.json -out pricing-catalog.json
+//
+// the generated catalog can be used as pricing.source in the config file
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gbolo/aws-power-toggle/backend"
+)
+
+func main() {
+	offerFile := flag.String("offer", "", "path to the offer file (use - for stdin)")
+	outFile := flag.String("out", "-", "path to the generated catalog (use - for stdout)")
+	flag.Parse()
+
+	if *offerFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := generate(*offerFile, *outFile); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(offerFile, outFile string) (err error) {
+	var offer io.Reader = os.Stdin
+	if offerFile != "-" {
+		in, openErr := os.Open(offerFile)
+		if openErr != nil {
+			return openErr
+		}
+		defer in.Close()
+		offer = in
+	}
+
+	var catalog io.Writer = os.Stdout
+	if outFile != "-" {
+		out, createErr := os.Create(outFile)
+		if createErr != nil {
+			return createErr
+		}
+		defer func() {
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		catalog = out
+	}
+	return backend.GeneratePricingCatalog(offer, catalog)
+}
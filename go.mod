@@ -10,4 +10,5 @@ require (
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/spf13/viper v1.7.1
 	golang.org/x/tools v0.0.0-20201207191902-7bb39e4ca9ac // indirect
+	gopkg.in/yaml.v2 v2.2.4
 )